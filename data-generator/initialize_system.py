@@ -79,7 +79,7 @@ def create_post(userID, token, post):
 def feed_posts(users):
     numberOfUsers = len(users)
     randomUsers = random.sample(list(users.keys()), 1)
-    r = send_request(method='GET', url=BACKEND_LOCAL_URL+API_PREFIX+'/post/feed?offset=0&limit=2', token=users[randomUsers[0]])
+    r = send_request(method='GET', url=BACKEND_LOCAL_URL+API_PREFIX+'/post/feed?limit=2', token=users[randomUsers[0]])
     if r.status_code != 200:
         print(r)
     else:
@@ -6,6 +6,52 @@ CREATE TABLE IF NOT EXISTS unread_messages (
     id UUID DEFAULT uuid_generate_v4(),
     author_id UUID NOT NULL, 
     recepient_id UUID NOT NULL,
-    count INTEGER DEFAULT 1 NOT NULL,
+    count INTEGER DEFAULT 1 NOT NULL CHECK (count >= 0),
+    last_message_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
     PRIMARY KEY(author_id, recepient_id) 
-);
\ No newline at end of file
+);
+
+-- Databases created before the unread totals
+ALTER TABLE unread_messages ADD COLUMN IF NOT EXISTS last_message_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc');
+ALTER TABLE unread_messages ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc');
+
+-- Databases created before the counters were kept from going negative, the
+-- negative ones are reset and left to the reconciliation to repair
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'unread_messages'::regclass AND conname = 'unread_messages_count_check') THEN
+        UPDATE unread_messages SET count = 0 WHERE count < 0;
+        ALTER TABLE unread_messages ADD CONSTRAINT unread_messages_count_check CHECK (count >= 0);
+    END IF;
+END $$;
+
+-- Unread group messages of every member, counted in the totals as well
+CREATE TABLE IF NOT EXISTS group_unread_messages (
+    group_id UUID NOT NULL,
+    recepient_id UUID NOT NULL,
+    count INTEGER DEFAULT 1 NOT NULL CHECK (count >= 0),
+    last_message_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    PRIMARY KEY(group_id, recepient_id)
+);
+
+CREATE TABLE IF NOT EXISTS unread_totals (
+    recepient_id UUID PRIMARY KEY,
+    count INTEGER DEFAULT 0 NOT NULL CHECK (count >= 0)
+);
+
+INSERT INTO unread_totals (recepient_id, count)
+    SELECT recepient_id, SUM(count) FROM unread_messages GROUP BY recepient_id
+    ON CONFLICT (recepient_id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS processed_messages (
+    message_id VARCHAR(100) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    processed_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(message_id, action)
+);
+
+CREATE INDEX IF NOT EXISTS processed_messages_processed_idx ON processed_messages(processed_at);
+CREATE INDEX IF NOT EXISTS unread_messages_recepient_idx ON unread_messages(recepient_id, last_message_at DESC) WHERE count > 0;
+CREATE INDEX IF NOT EXISTS group_unread_messages_recepient_idx ON group_unread_messages(recepient_id, last_message_at DESC) WHERE count > 0;
\ No newline at end of file
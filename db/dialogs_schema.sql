@@ -10,5 +10,128 @@ CREATE TABLE IF NOT EXISTS dialogs (
     created_at TIMESTAMP NOT NULL,
     text VARCHAR(1000) NOT NULL,
     state VARCHAR(50) NOT NULL,
+    state_updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+    saga_attempts INTEGER NOT NULL DEFAULT 0,
+    read_at TIMESTAMP,
+    edited_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    deleted_by_author BOOLEAN NOT NULL DEFAULT false,
+    deleted_by_recepient BOOLEAN NOT NULL DEFAULT false,
     PRIMARY KEY(id, dialog_id) 
-);
\ No newline at end of file
+);
+
+-- Databases created before the saga watchdog
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS state_updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc');
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS saga_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS read_at TIMESTAMP;
+
+-- Databases created before the message edits
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS deleted_by_author BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS deleted_by_recepient BOOLEAN NOT NULL DEFAULT false;
+
+-- The texts replaced by the edits of a message
+CREATE TABLE IF NOT EXISTS message_edits (
+    message_id UUID NOT NULL,
+    text VARCHAR(1000) NOT NULL,
+    edited_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(message_id, edited_at)
+);
+
+CREATE TABLE IF NOT EXISTS groups (
+    id UUID PRIMARY KEY,
+    title VARCHAR(200) NOT NULL,
+    created_by UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    joined_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(group_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS group_messages (
+    id UUID DEFAULT uuid_generate_v4(),
+    group_id UUID NOT NULL,
+    author_id UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    text VARCHAR(1000) NOT NULL,
+    PRIMARY KEY(id, group_id)
+);
+
+-- The state of a group message for every member but the author, the counter saga runs per receipt
+CREATE TABLE IF NOT EXISTS group_receipts (
+    message_id UUID NOT NULL,
+    group_id UUID NOT NULL,
+    member_id UUID NOT NULL,
+    state VARCHAR(50) NOT NULL,
+    state_updated_at TIMESTAMP NOT NULL,
+    saga_attempts INTEGER NOT NULL DEFAULT 0,
+    read_at TIMESTAMP,
+    PRIMARY KEY(message_id, member_id)
+);
+
+CREATE TABLE IF NOT EXISTS saga_log (
+    id BIGSERIAL PRIMARY KEY,
+    message_id UUID NOT NULL,
+    member_id UUID,
+    from_state VARCHAR(50),
+    to_state VARCHAR(50) NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    attempt INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Databases created before the groups
+ALTER TABLE saga_log ADD COLUMN IF NOT EXISTS member_id UUID;
+
+-- One row per participant of a dialog, maintained along with the messages
+CREATE TABLE IF NOT EXISTS conversations (
+    user_id UUID NOT NULL,
+    peer_id UUID NOT NULL,
+    dialog_id VARCHAR(100) NOT NULL,
+    last_message_id UUID NOT NULL,
+    last_author_id UUID NOT NULL,
+    last_message_text VARCHAR(1000) NOT NULL,
+    last_message_at TIMESTAMP NOT NULL,
+    unread_count INTEGER NOT NULL DEFAULT 0 CHECK (unread_count >= 0),
+    PRIMARY KEY(user_id, peer_id)
+);
+
+-- Databases created before the conversations
+INSERT INTO conversations (user_id, peer_id, dialog_id, last_message_id, last_author_id, last_message_text, last_message_at, unread_count)
+SELECT DISTINCT ON (p.user_id, p.peer_id) p.user_id, p.peer_id, d.dialog_id, d.id, d.author_id, LEFT(d.text, 100), d.created_at,
+    (SELECT COUNT(*) FROM dialogs u WHERE u.dialog_id = d.dialog_id AND u.recepient_id = p.user_id AND u.state IN ('PENDING_UNREAD', 'UNREAD'))
+FROM dialogs d CROSS JOIN LATERAL (VALUES (d.author_id, d.recepient_id), (d.recepient_id, d.author_id)) AS p(user_id, peer_id)
+WHERE d.deleted_at IS NULL AND NOT (d.author_id = p.user_id AND d.deleted_by_author) AND NOT (d.recepient_id = p.user_id AND d.deleted_by_recepient)
+ORDER BY p.user_id, p.peer_id, d.created_at DESC, d.id DESC
+ON CONFLICT (user_id, peer_id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    exchange VARCHAR(100) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL,
+    payload BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS dialogs_dialog_created_idx ON dialogs(dialog_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS dialogs_pending_idx ON dialogs(state_updated_at) WHERE state IN ('PENDING_UNREAD', 'PENDING_READ');
+CREATE INDEX IF NOT EXISTS dialogs_author_recepient_idx ON dialogs(author_id, recepient_id);
+CREATE INDEX IF NOT EXISTS dialogs_recepient_created_idx ON dialogs(recepient_id, created_at);
+-- The configuration has to match SEARCH_TS_CONFIG of the dialogs service
+CREATE INDEX IF NOT EXISTS dialogs_text_search_idx ON dialogs USING GIN (to_tsvector('simple', text));
+CREATE INDEX IF NOT EXISTS conversations_dialog_idx ON conversations(dialog_id);
+CREATE INDEX IF NOT EXISTS conversations_user_activity_idx ON conversations(user_id, last_message_at DESC, peer_id DESC);
+CREATE INDEX IF NOT EXISTS group_members_user_idx ON group_members(user_id, group_id);
+CREATE INDEX IF NOT EXISTS group_messages_group_created_idx ON group_messages(group_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS group_receipts_member_idx ON group_receipts(group_id, member_id, state);
+CREATE INDEX IF NOT EXISTS group_receipts_pending_idx ON group_receipts(state_updated_at) WHERE state IN ('PENDING_UNREAD', 'PENDING_READ');
+CREATE INDEX IF NOT EXISTS saga_log_message_idx ON saga_log(message_id);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(id) WHERE sent_at IS NULL;
\ No newline at end of file
@@ -16,12 +16,57 @@ CREATE TABLE IF NOT EXISTS user_credentials (
     password TEXT NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL,
+    user_agent TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
 CREATE TABLE IF NOT EXISTS user_tokens (
-    id UUID PRIMARY KEY,
-    token TEXT NOT NULL,
+    token TEXT PRIMARY KEY,
+    id UUID NOT NULL,
+    session_id UUID NOT NULL,
     valid_until TIMESTAMP NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    session_id UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    valid_until TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+-- Databases created before the sessions: the tokens issued without a session
+-- cannot be revoked with it, so they are dropped and their users log in again
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS session_id UUID;
+DELETE FROM user_tokens WHERE session_id IS NULL;
+ALTER TABLE user_tokens ALTER COLUMN session_id SET NOT NULL;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id UUID;
+DELETE FROM refresh_tokens WHERE session_id IS NULL;
+ALTER TABLE refresh_tokens ALTER COLUMN session_id SET NOT NULL;
+
+-- A login token is looked up by the token, not by the user id anymore
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = 'user_tokens'::regclass AND i.indisprimary
+        AND 'token' = ANY (SELECT a.attname FROM pg_attribute a WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey))) THEN
+        ALTER TABLE user_tokens DROP CONSTRAINT IF EXISTS user_tokens_pkey;
+        ALTER TABLE user_tokens ADD PRIMARY KEY (token);
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    retired_at TIMESTAMP
+);
+
 CREATE TABLE IF NOT EXISTS friends (
     id UUID REFERENCES users(id)  NOT NULL,
     friend_id UUID NOT NULL,
@@ -37,4 +82,23 @@ CREATE TABLE IF NOT EXISTS posts (
     PRIMARY KEY(id, author_user_id)
 );
 
-CREATE INDEX IF NOT EXISTS users_idx ON users(first_name, second_name);
\ No newline at end of file
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    exchange VARCHAR(100) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL,
+    payload BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+-- The created posts moved from the non-durable createdPosts exchange to postsCreated
+UPDATE outbox SET exchange = 'postsCreated' WHERE exchange = 'createdPosts' AND sent_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS users_idx ON users(first_name, second_name);
+CREATE INDEX IF NOT EXISTS friends_friend_idx ON friends(friend_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens(session_id);
+CREATE INDEX IF NOT EXISTS user_sessions_user_idx ON user_sessions(user_id);
+CREATE INDEX IF NOT EXISTS user_tokens_session_idx ON user_tokens(session_id);
+CREATE INDEX IF NOT EXISTS posts_author_created_idx ON posts(author_user_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(id) WHERE sent_at IS NULL;
\ No newline at end of file
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"highload-arch/pkg/backend"
+	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
 	"highload-arch/pkg/storage"
+	"highload-arch/pkg/tracing"
 	"log"
 	"net/http"
 	"os"
@@ -25,6 +28,7 @@ func main() {
 	defer f.Close()*/
 
 	config.Load("local-config.yaml")
+	defer tracing.Init("backend")()
 	log.Println("Connecting to Postgres")
 
 	storage.CreateConnectionPool()
@@ -39,10 +43,14 @@ func main() {
 	log.Printf("Connecting to RabbitMQ")
 	storage.ConnectToRabbitMQ()
 	defer storage.CloseRabbitMQ()
+	go storage.RunOutboxRelay(context.Background())
+
+	log.Printf("Loading access token keys")
+	common.LoadKeySet()
 
 	log.Printf("Server started")
 	router := backend.NewRouter()
 
-	log.Fatal(http.ListenAndServe(config.GetString("server.port"), router))
+	log.Fatal(http.ListenAndServe(config.Get().Server.Port, router))
 
 }
@@ -0,0 +1,105 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"highload-arch/pkg/auth_service/storage"
+	"highload-arch/pkg/common"
+	"log"
+	"net/http"
+	"time"
+)
+
+type LoginBody struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+}
+
+type RefreshBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResp struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func writeTokens(w http.ResponseWriter, pair *storage.TokenPair) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	resp := &TokenResp{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(pair.ExpiresAt).Seconds()),
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func LoginPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var rb LoginBody
+	err := decoder.Decode(&rb)
+	if err != nil || rb.ID == "" {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	pair, err := storage.LoginUser(r.Context(), rb.ID, rb.Password, r.UserAgent())
+	if err == common.ErrUserNotFound {
+		common.RespondError(w, r, http.StatusNotFound)
+		return
+	}
+	if err == common.ErrPasswordInvalid {
+		common.RespondError(w, r, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	writeTokens(w, pair)
+}
+
+func TokenRefreshPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var rb RefreshBody
+	err := decoder.Decode(&rb)
+	if err != nil || rb.RefreshToken == "" {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	pair, err := storage.RefreshTokens(r.Context(), rb.RefreshToken)
+	if err == common.ErrTokenNotFound || err == common.ErrTokenExpired || err == common.ErrTokenRevoked {
+		common.RespondError(w, r, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	writeTokens(w, pair)
+}
+
+func LogoutPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var rb RefreshBody
+	err := decoder.Decode(&rb)
+	if err != nil || rb.RefreshToken == "" {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = storage.Logout(r.Context(), rb.RefreshToken)
+	if err != nil && err != common.ErrTokenNotFound {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	// Logging out twice is not an error
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,35 @@
+package endpoints
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"highload-arch/pkg/auth_service/storage"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"log"
+	"net/http"
+)
+
+const ADMIN_TOKEN_HEADER = "X-Admin-Token"
+
+func KeySetGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(storage.KeySet())
+}
+
+func KeysRotatePost(w http.ResponseWriter, r *http.Request) {
+	adminToken := config.Get().Auth.AdminToken
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(ADMIN_TOKEN_HEADER)), []byte(adminToken)) != 1 {
+		common.RespondError(w, r, http.StatusForbidden)
+		return
+	}
+
+	if err := storage.RotateSigningKey(r.Context(), true); err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	log.Println("Signing key rotated on demand")
+	w.WriteHeader(http.StatusOK)
+}
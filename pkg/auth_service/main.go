@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"highload-arch/pkg/auth_service/routes"
+	"highload-arch/pkg/auth_service/storage"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/tracing"
+	"log"
+	"os"
+
+	"net/http"
+)
+
+func setLoggerFile(filename string) *os.File {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("error opening file: %v", err)
+	}
+
+	log.SetOutput(f)
+	return f
+}
+
+func main() {
+	/*f := setLoggerFile("./logs/auth-service.log")
+	defer f.Close()*/
+	config.Load("local-config.yaml")
+	defer tracing.Init("auth")()
+	log.Printf("Connecting to Postgres")
+	storage.CreateConnectionPool()
+
+	log.Printf("Connecting to Cache")
+	storage.ConnectToCache()
+
+	log.Printf("Loading signing keys")
+	storage.RunKeyRotation(context.Background())
+
+	log.Printf("Server started")
+	router := routes.NewRouter()
+
+	log.Fatal(http.ListenAndServe(config.Get().Auth.Port, router))
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"fmt"
+	"highload-arch/pkg/auth_service/endpoints"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/middleware"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type Route struct {
+	Name        string
+	Method      string
+	Pattern     string
+	HandlerFunc http.HandlerFunc
+	Auth        bool
+}
+
+const PREFIX_V2 = "/api/v2"
+
+type Routes []Route
+
+func NewRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	for _, route := range routes {
+		handler := middleware.Wrap(route.HandlerFunc, route.Name, nil)
+
+		router.
+			Methods(route.Method).
+			Path(route.Pattern).
+			Name(route.Name).
+			Handler(handler)
+	}
+
+	router.Handle(metrics.METRICS_PATH, metrics.Handler())
+	return router
+}
+
+func Index(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Welcome to highload architecture homework!")
+}
+
+var routes = Routes{
+	Route{
+		"Index",
+		"GET",
+		PREFIX_V2,
+		Index,
+		false,
+	},
+
+	Route{
+		"LoginPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/login",
+		endpoints.LoginPost,
+		false,
+	},
+
+	Route{
+		"TokenRefreshPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/token/refresh",
+		endpoints.TokenRefreshPost,
+		false,
+	},
+
+	Route{
+		"LogoutPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/logout",
+		endpoints.LogoutPost,
+		false,
+	},
+
+	Route{
+		"KeysRotatePost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/keys/rotate",
+		endpoints.KeysRotatePost,
+		false,
+	},
+
+	Route{
+		"KeySetGet",
+		strings.ToUpper("Get"),
+		common.KEY_SET_PATH,
+		endpoints.KeySetGet,
+		false,
+	},
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func CheckUserPassword(ctx context.Context, userID string, password string) error {
+	var hash string
+	err := db.QueryRow(ctx, `SELECT password FROM user_credentials WHERE id = $1`, userID).Scan(&hash)
+	if err == pgx.ErrNoRows {
+		return common.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return common.ErrPasswordInvalid
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var db *pgxpool.Pool
+
+/* Credentials live in the main database, so the auth service shares it with the backend */
+func CreateConnectionPool() {
+	var err error
+	dsn := config.Get().DB.Master
+	if config.Get().Citus.Enabled {
+		dsn = config.Get().Citus.Master
+	}
+	db, err = tracing.ConnectPool(context.Background(), dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.RegisterPool("master", db)
+}
+
+type Callback func(context.Context, pgx.Tx) (interface{}, error)
+
+func HandleInTransaction(ctx context.Context, callback Callback) (interface{}, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	val, err := callback(ctx, tx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+/* Context of the work following a commit, which must not be abandoned along with the request */
+func afterCommit(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+}
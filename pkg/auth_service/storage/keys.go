@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Access tokens are signed with the newest key of signing_keys. A rotated out
+ * key stays in the published key set until the tokens signed with it expire.
+ * Keys are shared by all the auth service instances through the database.
+ */
+
+const (
+	SIGNING_KEY_BITS = 2048
+	// Period of picking up the keys rotated by other instances
+	SIGNING_KEYS_RELOAD_PERIOD = time.Minute
+	// Advisory lock held while rotating, so concurrent instances rotate once
+	SIGNING_KEYS_LOCK = 7301
+)
+
+var ErrNoSigningKey = errors.Errorf("No signing key")
+
+type signingKey struct {
+	kid       string
+	key       *rsa.PrivateKey
+	createdAt time.Time
+}
+
+type keyRing struct {
+	sync.RWMutex
+	active *signingKey
+	// Keys to publish, including the active one
+	keys []*signingKey
+}
+
+var ring = &keyRing{}
+
+func (r *keyRing) get() (*signingKey, []*signingKey) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.active, r.keys
+}
+
+func dbLoadSigningKeys(ctx context.Context) (*signingKey, []*signingKey, error) {
+	rows, err := db.Query(ctx,
+		`SELECT kid, private_key, created_at, retired_at IS NULL FROM signing_keys
+		WHERE retired_at IS NULL OR retired_at > $1 ORDER BY created_at DESC`,
+		time.Now().UTC().Add(-config.Get().Auth.AccessTokenTTL))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var active *signingKey
+	var keys []*signingKey
+	for rows.Next() {
+		var kid, encoded string
+		var createdAt time.Time
+		var current bool
+		if err := rows.Scan(&kid, &encoded, &createdAt, &current); err != nil {
+			return nil, nil, err
+		}
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			log.Printf("Signing key %s is malformed", kid)
+			continue
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			log.Printf("Signing key %s is malformed: %s", kid, err)
+			continue
+		}
+		sk := &signingKey{kid: kid, key: key, createdAt: createdAt}
+		if current && active == nil {
+			active = sk
+		}
+		keys = append(keys, sk)
+	}
+	return active, keys, rows.Err()
+}
+
+func LoadSigningKeys(ctx context.Context) error {
+	active, keys, err := dbLoadSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if active == nil {
+		return ErrNoSigningKey
+	}
+	ring.Lock()
+	ring.active = active
+	ring.keys = keys
+	ring.Unlock()
+	return nil
+}
+
+/* Replace the active signing key, unless forced the key is replaced only when it is due */
+func RotateSigningKey(ctx context.Context, force bool) error {
+	_, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, SIGNING_KEYS_LOCK); err != nil {
+			return nil, err
+		}
+		var createdAt time.Time
+		err := tx.QueryRow(ctx, `SELECT created_at FROM signing_keys WHERE retired_at IS NULL ORDER BY created_at DESC LIMIT 1`).Scan(&createdAt)
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, err
+		}
+		if err == nil && !force && time.Since(createdAt) < config.Get().Auth.KeyRotationPeriod {
+			// Rotated by another instance in the meantime
+			return nil, nil
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, SIGNING_KEY_BITS)
+		if err != nil {
+			return nil, err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		kid := make([]byte, 8)
+		if _, err := rand.Read(kid); err != nil {
+			return nil, err
+		}
+
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec(ctx, `UPDATE signing_keys SET retired_at = $1 WHERE retired_at IS NULL`, now); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO signing_keys (kid, private_key, created_at) VALUES ($1, $2, $3)`,
+			hex.EncodeToString(kid), string(encoded), now)
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	return LoadSigningKeys(ctx)
+}
+
+/* Load the signing keys, rotate them when due and pick up rotations of other instances */
+func RunKeyRotation(ctx context.Context) {
+	rotate := func() {
+		active, _ := ring.get()
+		if active != nil && time.Since(active.createdAt) < config.Get().Auth.KeyRotationPeriod {
+			return
+		}
+		log.Println("Rotating the signing key")
+		if err := RotateSigningKey(ctx, false); err != nil {
+			log.Println("Signing key rotation failed: ", err)
+		}
+	}
+
+	if err := LoadSigningKeys(ctx); err != nil && err != ErrNoSigningKey {
+		log.Fatal(err)
+	}
+	rotate()
+	go func() {
+		ticker := time.NewTicker(SIGNING_KEYS_RELOAD_PERIOD)
+		for range ticker.C {
+			if err := LoadSigningKeys(ctx); err != nil {
+				log.Println("Signing keys reload failed: ", err)
+			}
+			rotate()
+		}
+	}()
+}
+
+func KeySet() common.JSONWebKeySet {
+	_, keys := ring.get()
+	set := common.JSONWebKeySet{Keys: make([]common.JSONWebKey, 0, len(keys))}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, common.NewJSONWebKey(key.kid, &key.key.PublicKey))
+	}
+	return set
+}
+
+func signAccessToken(userID, sessionID string) (string, time.Time, error) {
+	active, _ := ring.get()
+	if active == nil {
+		return "", time.Time{}, ErrNoSigningKey
+	}
+	now := time.Now()
+	expiresAt := now.Add(config.Get().Auth.AccessTokenTTL)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &common.AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    config.Get().Auth.Issuer,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        hex.EncodeToString(jti),
+		},
+		SessionID: sessionID,
+	})
+	token.Header["kid"] = active.kid
+	signed, err := token.SignedString(active.key)
+	return signed, expiresAt, err
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/tracing"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+var cache *redis.Client
+
+/* Revoked sessions are marked in the cache shared with the backend, so the backend rejects them at once */
+func ConnectToCache() {
+	opt, err := redis.ParseURL(config.Get().Cache.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache = redis.NewClient(opt)
+	tracing.InstrumentRedis(cache)
+}
+
+func dbAddSession(ctx context.Context, tx pgx.Tx, userID, userAgent string) (string, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	var sessionID string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO user_sessions (user_id, user_agent, created_at, last_seen) VALUES ($1, $2, $3, $3) RETURNING id`,
+		userID, userAgent, now).Scan(&sessionID)
+	return sessionID, err
+}
+
+func dbTouchSession(ctx context.Context, tx pgx.Tx, sessionID string) error {
+	_, err := tx.Exec(ctx, `UPDATE user_sessions SET last_seen = $1 WHERE id = $2`,
+		time.Now().UTC().Truncate(time.Microsecond), sessionID)
+	return err
+}
+
+/* Revoke the session along with its refresh and login tokens */
+func revokeSession(ctx context.Context, sessionID string) error {
+	_, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec(ctx, `UPDATE user_sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, now, sessionID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE session_id = $2 AND revoked_at IS NULL`, now, sessionID); err != nil {
+			return nil, err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM user_tokens WHERE session_id = $1`, sessionID)
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	err = cache.Set(ctx, common.SessionKey(sessionID), common.SESSION_STATE_REVOKED, common.SESSION_REVOKED_CACHE_TTL).Err()
+	if err != nil {
+		// The cached active state expires shortly, so revocation is only delayed
+		log.Println("Session cache update failed: ", err)
+	}
+	return nil
+}
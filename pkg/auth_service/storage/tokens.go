@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * Refresh tokens are opaque, only their hashes are stored. Every refresh
+ * revokes the presented token and issues a new one. A revoked token presented
+ * again means it has leaked, so the whole session is revoked.
+ */
+
+const REFRESH_TOKEN_LENGTH = 32
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRefreshToken() (string, error) {
+	b := make([]byte, REFRESH_TOKEN_LENGTH)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func dbAddRefreshToken(ctx context.Context, tx pgx.Tx, userID, sessionID string) (string, error) {
+	token, err := generateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO refresh_tokens (token_hash, user_id, session_id, created_at, valid_until) VALUES ($1, $2, $3, $4, $5)`,
+		hashRefreshToken(token), userID, sessionID, now, now.Add(config.Get().Auth.RefreshTokenTTL))
+	return token, err
+}
+
+func issueTokens(ctx context.Context, tx pgx.Tx, userID, sessionID string) (*TokenPair, error) {
+	refreshToken, err := dbAddRefreshToken(ctx, tx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, expiresAt, err := signAccessToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt}, nil
+}
+
+/* Every login starts a new session, so the user can stay logged in on several devices */
+func LoginUser(ctx context.Context, userID, password, userAgent string) (*TokenPair, error) {
+	if err := CheckUserPassword(ctx, userID, password); err != nil {
+		return nil, err
+	}
+	pair, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		sessionID, err := dbAddSession(ctx, tx, userID, userAgent)
+		if err != nil {
+			return nil, err
+		}
+		return issueTokens(ctx, tx, userID, sessionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair.(*TokenPair), nil
+}
+
+func RefreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	var userID, sessionID string
+	pair, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		var validUntil time.Time
+		var revoked bool
+		err := tx.QueryRow(ctx,
+			`SELECT t.user_id, t.session_id, t.valid_until, t.revoked_at IS NOT NULL OR s.revoked_at IS NOT NULL
+			FROM refresh_tokens t JOIN user_sessions s ON s.id = t.session_id
+			WHERE t.token_hash = $1 FOR UPDATE OF t`,
+			hashRefreshToken(refreshToken)).Scan(&userID, &sessionID, &validUntil, &revoked)
+		if err == pgx.ErrNoRows {
+			return nil, common.ErrTokenNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, common.ErrTokenRevoked
+		}
+		if validUntil.Before(time.Now().UTC()) {
+			return nil, common.ErrTokenExpired
+		}
+		if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE token_hash = $2`,
+			time.Now().UTC(), hashRefreshToken(refreshToken)); err != nil {
+			return nil, err
+		}
+		if err := dbTouchSession(ctx, tx, sessionID); err != nil {
+			return nil, err
+		}
+		return issueTokens(ctx, tx, userID, sessionID)
+	})
+	if err == common.ErrTokenRevoked {
+		log.Printf("Revoked refresh token reused, revoking session %s of user %s", sessionID, userID)
+		if err := revokeSession(ctx, sessionID); err != nil {
+			log.Println("Session revocation failed: ", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pair.(*TokenPair), nil
+}
+
+/* Log out of the session the refresh token belongs to */
+func Logout(ctx context.Context, refreshToken string) error {
+	var sessionID string
+	err := db.QueryRow(ctx, `SELECT session_id FROM refresh_tokens WHERE token_hash = $1`,
+		hashRefreshToken(refreshToken)).Scan(&sessionID)
+	if err == pgx.ErrNoRows {
+		return common.ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return revokeSession(ctx, sessionID)
+}
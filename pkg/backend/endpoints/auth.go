@@ -1,12 +1,11 @@
 package endpoints
 
 import (
-	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/storage"
+	"log"
 	"net/http"
-	"strings"
 )
 
 type Auth struct {
@@ -15,31 +14,40 @@ type Auth struct {
 
 const DateFormat = "2006-01-02"
 
-func CheckAuthorization(ctx context.Context, r *http.Request) (string, error) {
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	if len(splitToken) <= 1 {
-		return "", common.ErrRequestNotAuthorized
+/* Authenticate the request, returns the user and the session the token belongs to */
+func Authenticate(r *http.Request) (string, string, error) {
+	ctx := r.Context()
+	reqToken := common.BearerToken(r)
+	if reqToken == "" {
+		return "", "", common.ErrRequestNotAuthorized
 	}
-	reqToken = splitToken[1]
 
-	userID, err := storage.ValidateLoginToken(ctx, reqToken)
-	if err != nil {
-		return "", common.ErrRequestNotAuthorized
+	var userID, sessionID string
+	if common.IsAccessToken(reqToken) {
+		claims, err := common.VerifyAccessToken(reqToken)
+		if err != nil {
+			return "", "", common.ErrRequestNotAuthorized
+		}
+		userID, sessionID = claims.Subject, claims.SessionID
+	} else {
+		var err error
+		userID, sessionID, err = storage.ValidateLoginToken(ctx, reqToken)
+		if err != nil {
+			return "", "", common.ErrRequestNotAuthorized
+		}
 	}
-	return userID, nil
+
+	if err := storage.CheckSession(ctx, userID, sessionID); err != nil {
+		if err != common.ErrTokenRevoked {
+			log.Println("Session check failed: ", err)
+		}
+		return "", "", common.ErrRequestNotAuthorized
+	}
+	return userID, sessionID, nil
 }
 
 func CheckAuthGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
-	userID, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
 	w.WriteHeader(http.StatusOK)
-	resp := &Auth{UserID: userID}
+	resp := &Auth{UserID: common.UserIDFromContext(r.Context())}
 	json.NewEncoder(w).Encode(resp)
 }
@@ -1,7 +1,11 @@
 package endpoints
 
 import (
+	"context"
+	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/tracing"
+	"io"
 	"log"
 	"net/http"
 )
@@ -15,14 +19,16 @@ type DialogListBody struct {
 	Text string `json:"text"`
 }
 
-func DialogUserIdSendMessage(w http.ResponseWriter, req *http.Request) {
+/* Forward the request to the dialogs service and copy its response back to the client */
+func proxyToDialogs(w http.ResponseWriter, req *http.Request) {
 	url := req.URL
-	url.Host = config.GetString("dialogs.host")
+	url.Host = config.Get().Dialogs.Host
 	url.Scheme = "http"
 
-	proxyReq, err := http.NewRequest(req.Method, url.String(), req.Body)
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, url.String(), req.Body)
 	if err != nil {
 		log.Println(err)
+		common.RespondError(w, req, http.StatusInternalServerError)
 		return
 	}
 
@@ -34,35 +40,86 @@ func DialogUserIdSendMessage(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	client := &http.Client{}
-	_, err = client.Do(proxyReq)
-	if err != nil {
-		log.Println(err)
-	}
-}
-
-func DialogUserIdListGet(w http.ResponseWriter, req *http.Request) {
-	url := req.URL
-	url.Host = config.GetString("dialogs.host")
-	url.Scheme = "http"
-	proxyReq, err := http.NewRequest(req.Method, url.String(), req.Body)
+	client := tracing.NewClient()
+	resp, err := client.Do(proxyReq)
 	if err != nil {
 		log.Println(err)
+		if req.Context().Err() == context.DeadlineExceeded {
+			common.RespondError(w, req, http.StatusGatewayTimeout)
+		} else {
+			common.RespondError(w, req, http.StatusBadGateway)
+		}
 		return
 	}
+	defer resp.Body.Close()
 
-	proxyReq.Header.Set("Host", req.Host)
-	proxyReq.Header.Set("X-Forwarded-For", req.RemoteAddr)
-
-	for header, values := range req.Header {
+	for header, values := range resp.Header {
 		for _, value := range values {
-			proxyReq.Header.Add(header, value)
+			w.Header().Add(header, value)
 		}
 	}
-
-	client := &http.Client{}
-	_, err = client.Do(proxyReq)
-	if err != nil {
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
 		log.Println(err)
 	}
 }
+
+func DialogUserIdSendMessage(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogUserIdListGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogUserIdReadPost(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogUserIdMessagePut(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogUserIdMessageDelete(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogsGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func DialogsSearchGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupCreatePost(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdMembersPost(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdMembersUserIdDelete(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdSendMessage(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdListGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupGroupIdReadPost(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
+
+func GroupsGet(w http.ResponseWriter, req *http.Request) {
+	proxyToDialogs(w, req)
+}
@@ -1,7 +1,6 @@
 package endpoints
 
 import (
-	"context"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/storage"
 	"log"
@@ -11,32 +10,27 @@ import (
 )
 
 func FriendAddPut(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	friendID, ok := vars["user_id"]
 	if !ok {
 		log.Println("user_id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
-		return
-	}
-	userID, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
 	if friendID == userID {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	err = storage.AddFriend(context.Background(), userID, friendID)
+	err := storage.AddFriend(ctx, userID, friendID)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrUserNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
@@ -44,32 +38,27 @@ func FriendAddPut(w http.ResponseWriter, r *http.Request) {
 }
 
 func FriendDeletePut(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	friendID, ok := vars["user_id"]
 	if !ok {
 		log.Println("user_id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	userID, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
 	if friendID == userID {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
-	err = storage.DeleteFriend(context.Background(), userID, friendID)
+	err := storage.DeleteFriend(ctx, userID, friendID)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrUserNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
@@ -1,7 +1,6 @@
 package endpoints
 
 import (
-	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/storage"
@@ -19,38 +18,36 @@ type LoginResp struct {
 }
 
 func LoginPost(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
 	decoder := json.NewDecoder(r.Body)
 	var rb LoginBody
 	err := decoder.Decode(&rb)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
 	/* Get user and return error if the user doesn't exist */
-	_, err = storage.GetUser(context.Background(), rb.ID)
+	ctx := common.ContextWithUserID(r.Context(), rb.ID)
+	_, err = storage.GetUser(ctx, rb.ID)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrUserNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
 
 	/* Login the  user if the user exists */
-	login, err := storage.LoginUser(context.Background(), &storage.Login{rb.ID, rb.Password})
+	login, err := storage.LoginUser(ctx, &storage.Login{ID: rb.ID, Password: rb.Password}, r.UserAgent())
 	if err == common.ErrPasswordInvalid {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+		common.RespondError(w, r, http.StatusUnauthorized)
 		return
 	}
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
 	"highload-arch/pkg/storage"
 	"log"
 	"net/http"
@@ -14,7 +15,10 @@ import (
 	websocket "github.com/gorilla/websocket"
 )
 
-const WEBSOCKET_ENABLED = true
+const (
+	FEED_DEFAULT_LIMIT = 10
+	FEED_MAX_LIMIT     = 100
+)
 
 type PostCreateBody struct {
 	Text string `json:"text"`
@@ -26,31 +30,31 @@ type PostGetBody struct {
 	Text     string `json:"text"`
 }
 
+type PostFeedResp struct {
+	Posts      []*PostGetBody `json:"posts"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
 type PostUpdateBody struct {
 	Id   string `json:"id"`
 	Text string `json:"text"`
 }
 
 func PostCreatePost(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	decoder := json.NewDecoder(r.Body)
 	var pb PostCreateBody
 	err := decoder.Decode(&pb)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
-		return
-	}
-	userID, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
 
-	err = storage.CreatePost(context.Background(), userID, pb.Text)
+	err = storage.CreatePost(ctx, userID, pb.Text)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 
@@ -58,55 +62,43 @@ func PostCreatePost(w http.ResponseWriter, r *http.Request) {
 }
 
 func PostDeletePut(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 
 	if !ok {
 		log.Println("id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
-		return
-	}
-	_, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
-
-	err = storage.DeletePost(context.Background(), id)
+	err := storage.DeletePost(r.Context(), id)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		if err == common.ErrPostNotFound {
+			common.RespondError(w, r, http.StatusNotFound)
+		} else {
+			common.RespondServerError(w, r, err)
+		}
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func PostGetGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 
 	if !ok {
 		log.Println("id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
-	_, err := CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
-
-	post, err := storage.GetPost(context.Background(), id)
+	post, err := storage.GetPost(r.Context(), id)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrPostNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
@@ -118,26 +110,22 @@ func PostGetGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func PostUpdatePut(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	decoder := json.NewDecoder(r.Body)
 	var pb PostUpdateBody
 	err := decoder.Decode(&pb)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	_, err = CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
-
-	err = storage.UpdatePost(context.Background(), pb.Id, pb.Text)
+	err = storage.UpdatePost(r.Context(), pb.Id, pb.Text)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		if err == common.ErrPostNotFound {
+			common.RespondError(w, r, http.StatusNotFound)
+		} else {
+			common.RespondServerError(w, r, err)
+		}
 		return
 	}
 
@@ -153,12 +141,11 @@ func sendPostViaWebsocket(conn *websocket.Conn, post []byte) {
 }
 
 func PostFeedGetWebsocket(w http.ResponseWriter, r *http.Request) {
-	userID, err := CheckAuthorization(context.Background(), r)
-
-	if err != nil {
-		log.Println("Authorization failed for websocket")
+	if !config.Get().Server.WebsocketEnabled {
+		http.NotFound(w, r)
 		return
 	}
+	userID := common.UserIDFromContext(r.Context())
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -172,16 +159,28 @@ func PostFeedGetWebsocket(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
+	defer ws.Close()
 
 	err = ws.WriteMessage(1, []byte("Hi Client!"))
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	// listen indefinitely for new messages coming
-	// through on our WebSocket connection
+	// listen for new messages coming through on our WebSocket
+	// connection until the client disconnects, the client sends
+	// nothing, so reading only detects the disconnect
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
 
-	err = ReadPostCreatedMessageFromQueue(context.Background(), userID, sendPostViaWebsocket, ws)
+	err = ReadPostCreatedMessageFromQueue(ctx, userID, sendPostViaWebsocket, ws)
 	if err != nil {
 		log.Println("Cannot read messages from queue on the client side")
 		return
@@ -189,52 +188,44 @@ func PostFeedGetWebsocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func PostFeedGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
 	parsedQuery, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
-	var offset, limit int
-
-	if len(parsedQuery) == 0 {
-		offset = 0
-		limit = 10
-	}
-	var err1, err2 error
-	for key, values := range parsedQuery {
-		if key == "offset" {
-			offset, err1 = strconv.Atoi(values[0])
-		}
-		if key == "limit" {
-			limit, err2 = strconv.Atoi(values[0])
+	limit := FEED_DEFAULT_LIMIT
+	if parsedQuery.Has("limit") {
+		limit, err = strconv.Atoi(parsedQuery.Get("limit"))
+		if err != nil || limit <= 0 || limit > FEED_MAX_LIMIT {
+			log.Println("Invalid limit: ", parsedQuery.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
 		}
 	}
-	if err1 != nil || err2 != nil {
-		log.Println(err1, err2)
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
-		return
-	}
-	userID, err := CheckAuthorization(context.Background(), r)
+	cursor, err := common.DecodeCursor(parsedQuery.Get("cursor"))
 	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+		log.Println(err)
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
 
-	posts, err := storage.FeedPosts(context.Background(), userID, offset, limit)
+	posts, err := storage.FeedPosts(ctx, userID, cursor, limit)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 
-	/* FIXME: empty array is considered as null */
-	var resp []*PostGetBody
+	resp := &PostFeedResp{Posts: []*PostGetBody{}}
 	for _, post := range posts {
-		resp = append(resp, &PostGetBody{Id: post.ID, AuthorId: post.AuthorUserID, Text: post.Text})
+		resp.Posts = append(resp.Posts, &PostGetBody{Id: post.ID, AuthorId: post.AuthorUserID, Text: post.Text})
+	}
+	if len(posts) == limit {
+		last := posts[len(posts)-1]
+		resp.NextCursor = common.EncodeCursor(last.CreatedAt, last.ID)
 	}
 	json.NewEncoder(w).Encode(resp)
 
@@ -3,7 +3,9 @@ package endpoints
 import (
 	"context"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
 	"highload-arch/pkg/storage"
+	"highload-arch/pkg/tracing"
 	"log"
 
 	"github.com/gorilla/websocket"
@@ -11,7 +13,7 @@ import (
 )
 
 func ConnectClientToRabbitMQ() (*amqp.Connection, error) {
-	url := config.GetString("rabbitmq.url")
+	url := config.Get().RabbitMQ.URL
 	var err error
 	rbmqClient, err := amqp.Dial(url)
 	if err != nil {
@@ -44,13 +46,13 @@ func ReadPostCreatedMessageFromQueue(ctx context.Context, userID string, callbac
 	defer ch.Close()
 
 	err = ch.ExchangeDeclare(
-		"createdPosts", // name
-		"topic",        // type
-		false,          // durable
-		false,          // auto-deleted
-		false,          // internal
-		false,          // no-wait
-		nil,            // arguments
+		storage.POSTS_CREATED_EXCHANGE, // name
+		"topic",                        // type
+		true,                           // durable
+		false,                          // auto-deleted
+		false,                          // internal
+		false,                          // no-wait
+		nil,                            // arguments
 	)
 
 	if err != nil {
@@ -80,9 +82,9 @@ func ReadPostCreatedMessageFromQueue(ctx context.Context, userID string, callbac
 	for _, friend := range friends {
 		routingKey = friend.FriendID + ".*"
 		err = ch.QueueBind(
-			q.Name,         // queue name
-			routingKey,     // routing key
-			"createdPosts", // exchange
+			q.Name,                         // queue name
+			routingKey,                     // routing key
+			storage.POSTS_CREATED_EXCHANGE, // exchange
 			false,
 			nil)
 	}
@@ -97,17 +99,19 @@ func ReadPostCreatedMessageFromQueue(ctx context.Context, userID string, callbac
 		nil,    // args
 	)
 
-	var forever chan struct{}
-
 	go func() {
 		for d := range msgs {
 			log.Printf(" [x] %s", d.Body)
+			metrics.QueueConsumed(storage.POSTS_CREATED_EXCHANGE)
+			_, span := tracing.StartConsume(ctx, storage.POSTS_CREATED_EXCHANGE, d.Headers)
 			callback(ws, d.Body)
+			span.End()
 		}
 	}()
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	log.Printf(" [*] Waiting for messages until the client disconnects")
+	// Closing the channel on return stops the delivery
+	<-ctx.Done()
 	return nil
 
 }
@@ -0,0 +1,76 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+type SessionBody struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+type SessionsRevokeResp struct {
+	Revoked int `json:"revoked"`
+}
+
+func SessionsGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
+	sessionID := common.SessionIDFromContext(ctx)
+
+	sessions, err := storage.ListSessions(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	resp := []*SessionBody{}
+	for _, session := range sessions {
+		resp = append(resp, &SessionBody{
+			ID:        session.ID,
+			UserAgent: session.UserAgent,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			Current:   session.ID == sessionID,
+		})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+/* Log out of the current session */
+func LogoutPost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
+	sessionID := common.SessionIDFromContext(ctx)
+
+	if err := storage.RevokeSession(ctx, userID, sessionID); err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func SessionsRevokeOthersPost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := common.UserIDFromContext(ctx)
+	sessionID := common.SessionIDFromContext(ctx)
+
+	revoked, err := storage.RevokeOtherSessions(ctx, userID, sessionID)
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&SessionsRevokeResp{Revoked: revoked})
+}
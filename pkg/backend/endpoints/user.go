@@ -1,7 +1,6 @@
 package endpoints
 
 import (
-	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/storage"
@@ -35,7 +34,7 @@ type UserGetResponse struct {
 }
 
 type UserGetResponseID struct {
-	ID         string `json:id`
+	ID         string `json:"id"`
 	FirstName  string `json:"first_name,omitempty"`
 	SecondName string `json:"second_name,omitempty"`
 	Birthdate  string `json:"birthdate,omitempty"`
@@ -44,8 +43,6 @@ type UserGetResponseID struct {
 }
 
 func UserGetIdGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	userID, ok := vars["id"]
 	if !ok {
@@ -53,23 +50,18 @@ func UserGetIdGet(w http.ResponseWriter, r *http.Request) {
 	}
 	var err error
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	_, err = CheckAuthorization(context.Background(), r)
-	if err != nil {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
 	var user *storage.User
-	user, err = storage.GetUser(context.Background(), userID)
+	user, err = storage.GetUser(r.Context(), userID)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrUserNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
@@ -79,25 +71,23 @@ func UserGetIdGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func UserRegisterPost(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	decoder := json.NewDecoder(r.Body)
 	var rb UserRegisterBody
 	err := decoder.Decode(&rb)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 	birthdate, err := time.Parse(time.DateOnly, rb.Birthdate)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondError(w, r, http.StatusInternalServerError)
 		return
 	}
-	id, err := storage.AddUser(context.Background(), &storage.User{ID: "", FirstName: rb.FirstName, SecondName: rb.SecondName, Birthdate: birthdate, Biography: rb.Biography, City: rb.City}, rb.Password)
+	id, err := storage.AddUser(r.Context(), &storage.User{ID: "", FirstName: rb.FirstName, SecondName: rb.SecondName, Birthdate: birthdate, Biography: rb.Biography, City: rb.City}, rb.Password)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -106,11 +96,9 @@ func UserRegisterPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func UserSearchGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	parsedQuery, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 	var firstName, secondName string
@@ -122,13 +110,13 @@ func UserSearchGet(w http.ResponseWriter, r *http.Request) {
 			secondName = values[0]
 		}
 	}
-	users, err := storage.SearchUsers(context.Background(), firstName, secondName)
+	users, err := storage.SearchUsers(r.Context(), firstName, secondName)
 	if err != nil {
 		log.Println(err)
 		if err == common.ErrUserNotFound {
-			common.GenerateError(w, http.StatusNotFound, requestID, "10m")
+			common.RespondError(w, r, http.StatusNotFound)
 		} else {
-			common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+			common.RespondServerError(w, r, err)
 		}
 		return
 	}
@@ -3,7 +3,8 @@ package backend
 import (
 	"fmt"
 	"highload-arch/pkg/backend/endpoints"
-	"highload-arch/pkg/common"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/middleware"
 	"net/http"
 	"strings"
 
@@ -18,6 +19,7 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Auth        bool
 }
 
 type Routes []Route
@@ -26,9 +28,11 @@ func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	routes := append(routesV1, routesV2...)
 	for _, route := range routes {
-		var handler http.Handler
-		handler = route.HandlerFunc
-		common.Logger(handler, route.Name)
+		var auth middleware.Authenticator
+		if route.Auth {
+			auth = endpoints.Authenticate
+		}
+		handler := middleware.Wrap(route.HandlerFunc, route.Name, auth)
 
 		router.
 			Methods(route.Method).
@@ -37,7 +41,8 @@ func NewRouter() *mux.Router {
 			Handler(handler)
 	}
 
-	router.HandleFunc("/post/feed/posted", endpoints.PostFeedGetWebsocket)
+	router.Handle("/post/feed/posted", middleware.Wrap(http.HandlerFunc(endpoints.PostFeedGetWebsocket), "PostFeedGetWebsocket", endpoints.Authenticate))
+	router.Handle(metrics.METRICS_PATH, metrics.Handler())
 	return router
 }
 
@@ -51,6 +56,7 @@ var routesV1 = Routes{
 		"GET",
 		PREFIX_V1,
 		Index,
+		false,
 	},
 
 	Route{
@@ -58,6 +64,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V1 + "/login",
 		endpoints.LoginPost,
+		false,
 	},
 
 	Route{
@@ -65,6 +72,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/checkAuth",
 		endpoints.CheckAuthGet,
+		true,
 	},
 
 	Route{
@@ -72,6 +80,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/user/get/{id}",
 		endpoints.UserGetIdGet,
+		true,
 	},
 
 	Route{
@@ -79,6 +88,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V1 + "/user/register",
 		endpoints.UserRegisterPost,
+		false,
 	},
 
 	Route{
@@ -86,6 +96,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/user/search",
 		endpoints.UserSearchGet,
+		false,
 	},
 
 	Route{
@@ -93,6 +104,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V1 + "/friend/add/{user_id}",
 		endpoints.FriendAddPut,
+		true,
 	},
 
 	Route{
@@ -100,6 +112,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V1 + "/friend/delete/{user_id}",
 		endpoints.FriendDeletePut,
+		true,
 	},
 
 	Route{
@@ -107,6 +120,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V1 + "/post/create",
 		endpoints.PostCreatePost,
+		true,
 	},
 
 	Route{
@@ -114,6 +128,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V1 + "/post/delete/{id}",
 		endpoints.PostDeletePut,
+		true,
 	},
 
 	Route{
@@ -121,6 +136,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/post/get/{id}",
 		endpoints.PostGetGet,
+		true,
 	},
 
 	Route{
@@ -128,6 +144,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V1 + "/post/update",
 		endpoints.PostUpdatePut,
+		true,
 	},
 
 	Route{
@@ -135,6 +152,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/post/feed",
 		endpoints.PostFeedGet,
+		true,
 	},
 
 	Route{
@@ -142,6 +160,7 @@ var routesV1 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V1 + "/dialog/{user_id}/send",
 		endpoints.DialogUserIdSendMessage,
+		true,
 	},
 
 	Route{
@@ -149,6 +168,111 @@ var routesV1 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V1 + "/dialog/{user_id}/list",
 		endpoints.DialogUserIdListGet,
+		true,
+	},
+
+	Route{
+		"DialogUserIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V1 + "/dialog/{user_id}/read",
+		endpoints.DialogUserIdReadPost,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessagePut",
+		strings.ToUpper("Put"),
+		PREFIX_V1 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessagePut,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessageDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V1 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessageDelete,
+		true,
+	},
+
+	Route{
+		"DialogsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V1 + "/dialogs",
+		endpoints.DialogsGet,
+		true,
+	},
+
+	Route{
+		"DialogsSearchGet",
+		strings.ToUpper("Get"),
+		PREFIX_V1 + "/dialogs/search",
+		endpoints.DialogsSearchGet,
+		true,
+	},
+
+	Route{
+		"GroupCreatePost",
+		strings.ToUpper("Post"),
+		PREFIX_V1 + "/group/create",
+		endpoints.GroupCreatePost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdGet",
+		strings.ToUpper("Get"),
+		PREFIX_V1 + "/group/{group_id}",
+		endpoints.GroupGroupIdGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersPost",
+		strings.ToUpper("Post"),
+		PREFIX_V1 + "/group/{group_id}/members",
+		endpoints.GroupGroupIdMembersPost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersUserIdDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V1 + "/group/{group_id}/members/{user_id}",
+		endpoints.GroupGroupIdMembersUserIdDelete,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdSendMessage",
+		strings.ToUpper("Post"),
+		PREFIX_V1 + "/group/{group_id}/send",
+		endpoints.GroupGroupIdSendMessage,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdListGet",
+		strings.ToUpper("Get"),
+		PREFIX_V1 + "/group/{group_id}/list",
+		endpoints.GroupGroupIdListGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V1 + "/group/{group_id}/read",
+		endpoints.GroupGroupIdReadPost,
+		true,
+	},
+
+	Route{
+		"GroupsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V1 + "/groups",
+		endpoints.GroupsGet,
+		true,
 	},
 }
 
@@ -158,6 +282,7 @@ var routesV2 = Routes{
 		"GET",
 		PREFIX_V2,
 		Index,
+		false,
 	},
 
 	Route{
@@ -165,6 +290,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V2 + "/login",
 		endpoints.LoginPost,
+		false,
 	},
 
 	Route{
@@ -172,6 +298,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/user/get/{id}",
 		endpoints.UserGetIdGet,
+		true,
 	},
 
 	Route{
@@ -179,6 +306,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V2 + "/user/register",
 		endpoints.UserRegisterPost,
+		false,
 	},
 
 	Route{
@@ -186,6 +314,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/user/search",
 		endpoints.UserSearchGet,
+		false,
 	},
 
 	Route{
@@ -193,6 +322,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V2 + "/friend/add/{user_id}",
 		endpoints.FriendAddPut,
+		true,
 	},
 
 	Route{
@@ -200,6 +330,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V2 + "/friend/delete/{user_id}",
 		endpoints.FriendDeletePut,
+		true,
 	},
 
 	Route{
@@ -207,6 +338,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V2 + "/post/create",
 		endpoints.PostCreatePost,
+		true,
 	},
 
 	Route{
@@ -214,6 +346,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V2 + "/post/delete/{id}",
 		endpoints.PostDeletePut,
+		true,
 	},
 
 	Route{
@@ -221,6 +354,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/post/get/{id}",
 		endpoints.PostGetGet,
+		true,
 	},
 
 	Route{
@@ -228,6 +362,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Put"),
 		PREFIX_V2 + "/post/update",
 		endpoints.PostUpdatePut,
+		true,
 	},
 
 	Route{
@@ -235,6 +370,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/post/feed",
 		endpoints.PostFeedGet,
+		true,
 	},
 
 	Route{
@@ -242,6 +378,7 @@ var routesV2 = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V2 + "/dialog/{user_id}/send",
 		endpoints.DialogUserIdSendMessage,
+		true,
 	},
 
 	Route{
@@ -249,6 +386,111 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/dialog/{user_id}/list",
 		endpoints.DialogUserIdListGet,
+		true,
+	},
+
+	Route{
+		"DialogUserIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/dialog/{user_id}/read",
+		endpoints.DialogUserIdReadPost,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessagePut",
+		strings.ToUpper("Put"),
+		PREFIX_V2 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessagePut,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessageDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V2 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessageDelete,
+		true,
+	},
+
+	Route{
+		"DialogsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs",
+		endpoints.DialogsGet,
+		true,
+	},
+
+	Route{
+		"DialogsSearchGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs/search",
+		endpoints.DialogsSearchGet,
+		true,
+	},
+
+	Route{
+		"GroupCreatePost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/create",
+		endpoints.GroupCreatePost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/group/{group_id}",
+		endpoints.GroupGroupIdGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/members",
+		endpoints.GroupGroupIdMembersPost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersUserIdDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V2 + "/group/{group_id}/members/{user_id}",
+		endpoints.GroupGroupIdMembersUserIdDelete,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdSendMessage",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/send",
+		endpoints.GroupGroupIdSendMessage,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdListGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/group/{group_id}/list",
+		endpoints.GroupGroupIdListGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/read",
+		endpoints.GroupGroupIdReadPost,
+		true,
+	},
+
+	Route{
+		"GroupsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/groups",
+		endpoints.GroupsGet,
+		true,
 	},
 
 	Route{
@@ -256,5 +498,30 @@ var routesV2 = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/checkAuth",
 		endpoints.CheckAuthGet,
+		true,
+	},
+
+	Route{
+		"SessionsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/sessions",
+		endpoints.SessionsGet,
+		true,
+	},
+
+	Route{
+		"SessionsRevokeOthersPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/sessions/revoke_others",
+		endpoints.SessionsRevokeOthersPost,
+		true,
+	},
+
+	Route{
+		"LogoutPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/logout",
+		endpoints.LogoutPost,
+		true,
 	},
 }
@@ -3,56 +3,87 @@ package common
 import (
 	"encoding/json"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/tracing"
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
 )
 
+const REQUEST_ID_HEADER = "X-Request-ID"
+
 type Auth struct {
 	UserID string `json:"user_id"`
 }
 
 func GetRequestID(r *http.Request) (string, error) {
-	requestID := r.Header.Get("X-Request-ID")
-	return requestID, nil
+	if requestID := RequestIDFromContext(r.Context()); requestID != "" {
+		return requestID, nil
+	}
+	return r.Header.Get(REQUEST_ID_HEADER), nil
 }
 
-func CheckAuth(r *http.Request) string {
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	if len(splitToken) <= 1 {
-		log.Println("Unauthorized")
-		return ""
+/*
+ * Get the user and the session of the request. Access tokens are verified
+ * locally and their session is checked against the revoked ones, legacy
+ * tokens are checked by the backend and carry no session.
+ */
+func Authenticate(r *http.Request) (string, string, error) {
+	reqToken := BearerToken(r)
+	if reqToken == "" {
+		return "", "", ErrRequestNotAuthorized
 	}
-	reqToken = splitToken[1]
+	if IsAccessToken(reqToken) {
+		claims, err := VerifyAccessToken(reqToken)
+		if err != nil {
+			return "", "", ErrRequestNotAuthorized
+		}
+		if claims.SessionID != "" {
+			if err := checkSession(r, reqToken, claims.SessionID); err != nil {
+				if err != ErrTokenRevoked && err != ErrRequestNotAuthorized {
+					log.Println("Session check failed: ", err)
+				}
+				return "", "", ErrRequestNotAuthorized
+			}
+		}
+		return claims.Subject, claims.SessionID, nil
+	}
+
+	userID, err := backendCheckAuth(r, reqToken)
+	if err != nil {
+		return "", "", err
+	}
+	return userID, "", nil
+}
 
+/* Ask the backend whom the token belongs to, it also checks the session in the users database */
+func backendCheckAuth(r *http.Request, token string) (string, error) {
 	url := url.URL{}
-	url.Host = config.GetString("server.host")
+	url.Host = config.Get().Server.Host
 	url.Scheme = "http"
 	url.Path = "/api/v2/checkAuth"
 
-	proxyReq, err := http.NewRequest("GET", url.String(), nil)
+	proxyReq, err := http.NewRequestWithContext(r.Context(), "GET", url.String(), nil)
 	if err != nil {
-		log.Println(err)
-		return ""
+		return "", err
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+reqToken)
-	client := &http.Client{}
+	proxyReq.Header.Set("Authorization", "Bearer "+token)
+	proxyReq.Header.Set(REQUEST_ID_HEADER, RequestIDFromContext(r.Context()))
+	client := tracing.NewClient()
 	resp, err := client.Do(proxyReq)
 	if err != nil {
-		return ""
+		return "", err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return ""
+		return "", ErrRequestNotAuthorized
 	}
 
 	decoder := json.NewDecoder(resp.Body)
 	var auth Auth
 	err = decoder.Decode(&auth)
 	if err != nil {
-		return ""
+		return "", err
 	}
-	return auth.UserID
+	return auth.UserID, nil
 }
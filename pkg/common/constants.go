@@ -3,9 +3,26 @@ package common
 const INCREMENT_MESSAGE_COUNT_ACTION = "increment"
 const DECREMENT_MESSAGE_COUNT_ACTION = "decrement"
 
+/* A group message is counted for every member, the group id is empty for the dialogs */
 type MessageCountRequest struct {
 	MessageID   string `pg:"id"`
 	AuthorID    string `pg:"author_id"`
 	RecepientID string `pg:"recepient_id"`
 	Action      string `pg:"action"`
+	GroupID     string `pg:"group_id"`
+}
+
+/* Header carrying the token of the unread counts export */
+const EXPORT_TOKEN_HEADER = "X-Export-Token"
+
+/* Unread and pending messages of a dialog, exported by the dialogs service */
+type UnreadCountExport struct {
+	AuthorID    string `json:"author_id"`
+	RecepientID string `json:"recepient_id"`
+	Unread      int    `json:"unread"`
+	Pending     int    `json:"pending"`
+}
+
+type UnreadCountsExport struct {
+	Counts []*UnreadCountExport `json:"counts"`
 }
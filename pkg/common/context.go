@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey string
+
+const (
+	userIDContextKey    contextKey = "user_id"
+	sessionIDContextKey contextKey = "session_id"
+	requestIDContextKey contextKey = "request_id"
+)
+
+/* Store the id of the user the request is made on behalf of */
+func ContextWithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDContextKey).(string)
+	return userID
+}
+
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDContextKey, sessionID)
+}
+
+func SessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDContextKey).(string)
+	return sessionID
+}
+
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+/*
+ * Keep the values of the context but not its deadline and cancellation, for
+ * the work which has to finish once the change is committed, e.g. the cache
+ * updates and the notifications, even if the client has gone away.
+ */
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var ErrCursorInvalid = errors.Errorf("Cursor is invalid")
+
+/* Position in a list ordered by (created_at, id) in descending order, the ids are UUIDs */
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func EncodeCursor(createdAt time.Time, id string) string {
+	raw := strconv.FormatInt(createdAt.UnixMicro(), 10) + "_" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+/* Decode an opaque cursor, an empty cursor means the beginning of the list */
+func DecodeCursor(cursor string) (*Cursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	parts := strings.SplitN(string(raw), "_", 2)
+	if len(parts) != 2 {
+		return nil, ErrCursorInvalid
+	}
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return nil, ErrCursorInvalid
+	}
+	micro, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	// Timestamps are stored without time zone, so the cursor is kept in UTC
+	return &Cursor{CreatedAt: time.UnixMicro(micro).UTC(), ID: parts[1]}, nil
+}
+
+/* Check whether the item is older than the cursor position, so it belongs to the next page */
+func (c *Cursor) Before(createdAt time.Time, id string) bool {
+	if c == nil {
+		return true
+	}
+	if createdAt.Equal(c.CreatedAt) {
+		return id < c.ID
+	}
+	return createdAt.Before(c.CreatedAt)
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -29,6 +30,21 @@ func GenerateError(w http.ResponseWriter, errorStatus int, requestID string, ret
 	json.NewEncoder(w).Encode(resp)
 }
 
+/* Respond with an error for the request, its id is taken from the request context */
+func RespondError(w http.ResponseWriter, r *http.Request, errorStatus int) {
+	requestID, _ := GetRequestID(r)
+	GenerateError(w, errorStatus, requestID, "10m")
+}
+
+/* Respond to a request failed on the server side, running out of its deadline is reported as 504 */
+func RespondServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) || r.Context().Err() == context.DeadlineExceeded {
+		RespondError(w, r, http.StatusGatewayTimeout)
+		return
+	}
+	RespondError(w, r, http.StatusInternalServerError)
+}
+
 func GenerateErrorEcho(c echo.Context, errorStatus int, requestID string, retryAfterTimeout string) error {
 	if retryAfterTimeout != "" {
 		c.Request().Header.Set("Retry-After", retryAfterTimeout)
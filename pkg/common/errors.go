@@ -8,6 +8,16 @@ var ErrUserNotFound = errors.Errorf("User not found")
 var ErrTokenNotFound = errors.Errorf("Token not found")
 var ErrTokenExpired = errors.Errorf("Token has expired")
 var ErrTokenInvalid = errors.Errorf("Token is invalid")
+var ErrTokenRevoked = errors.Errorf("Token has been revoked")
 var ErrPasswordInvalid = errors.Errorf("Password is invalid")
 var ErrPostNotFound = errors.Errorf("Post not found")
+var ErrNotSupported = errors.Errorf("Not supported by the storage")
+var ErrMessageNotFound = errors.Errorf("Message not found")
+var ErrNotMessageAuthor = errors.Errorf("Only the author may change the message")
+var ErrEditWindowExpired = errors.Errorf("Message can no longer be edited")
+var ErrGroupNotFound = errors.Errorf("Group not found")
+var ErrNotGroupAdmin = errors.Errorf("Only a group admin may change the members")
+var ErrLastGroupAdmin = errors.Errorf("Group must keep an admin")
+var ErrGroupTooLarge = errors.Errorf("Group has too many members")
 var ErrNoMessagesFound = errors.Errorf("No messsages found")
+var ErrMessageNotConfirmed = errors.Errorf("Message was not confirmed by the broker")
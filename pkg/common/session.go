@@ -0,0 +1,61 @@
+package common
+
+import (
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/tracing"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+ * Every login starts a session, the tokens issued for it carry its id.
+ * Session state is cached in Redis under session:<session_id>, so revocation
+ * is checked on every request without a database query. The services
+ * without the users database ask the backend once the state is not cached,
+ * the backend caches it then.
+ */
+
+const (
+	SESSION_STATE_ACTIVE  = "active"
+	SESSION_STATE_REVOKED = "revoked"
+	// Active state is re-checked in the database once the entry expires
+	SESSION_ACTIVE_CACHE_TTL  = time.Minute
+	SESSION_REVOKED_CACHE_TTL = 24 * time.Hour
+)
+
+func SessionKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+var sessionCache *redis.Client
+
+/* Connect to the cache of the session states shared with the backend */
+func ConnectToSessionCache() {
+	opt, err := redis.ParseURL(config.Get().Cache.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionCache = redis.NewClient(opt)
+	tracing.InstrumentRedis(sessionCache)
+}
+
+/* Reject the access token of a revoked session */
+func checkSession(r *http.Request, token, sessionID string) error {
+	if sessionCache != nil {
+		state, err := sessionCache.Get(r.Context(), SessionKey(sessionID)).Result()
+		if err != nil && err != redis.Nil {
+			log.Println("Session cache lookup failed: ", err)
+		}
+		switch state {
+		case SESSION_STATE_ACTIVE:
+			return nil
+		case SESSION_STATE_REVOKED:
+			return ErrTokenRevoked
+		}
+	}
+	_, err := backendCheckAuth(r, token)
+	return err
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"highload-arch/pkg/config"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Access tokens are JWTs signed by the auth service with RS256. The public
+ * keys are published as a JWKS, every service keeps a copy of the key set
+ * and verifies access tokens locally.
+ */
+
+const (
+	ACCESS_TOKEN_ALG = "RS256"
+	KEY_SET_PATH     = "/.well-known/jwks.json"
+	// Unknown key ids trigger a key set fetch at most once per the period
+	KEY_SET_MIN_FETCH_PERIOD = 10 * time.Second
+	KEY_SET_FETCH_TIMEOUT    = 2 * time.Second
+)
+
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid"`
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func NewJSONWebKey(kid string, key *rsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: ACCESS_TOKEN_ALG,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func (k *JSONWebKey) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.Errorf("Unsupported key type %s", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+type keySet struct {
+	sync.RWMutex
+	keys map[string]*rsa.PublicKey
+	// Serializes fetches, so a burst of unknown key ids makes a single request
+	fetchLock sync.Mutex
+	fetchedAt time.Time
+}
+
+var accessKeys = &keySet{keys: map[string]*rsa.PublicKey{}}
+
+func keySetURL() string {
+	url := url.URL{}
+	url.Host = config.Get().Auth.Host
+	url.Scheme = "http"
+	url.Path = KEY_SET_PATH
+	return url.String()
+}
+
+func (s *keySet) fetch() error {
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+	return s.fetchLocked()
+}
+
+func (s *keySet) fetchLocked() error {
+	s.fetchedAt = time.Now()
+	client := &http.Client{Timeout: KEY_SET_FETCH_TIMEOUT}
+	resp, err := client.Get(keySetURL())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Key set fetch failed with status %d", resp.StatusCode)
+	}
+
+	var set JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("Skipping key %s: %s", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+	return nil
+}
+
+func (s *keySet) lookup(kid string) *rsa.PublicKey {
+	s.RLock()
+	defer s.RUnlock()
+	return s.keys[kid]
+}
+
+func (s *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key := s.lookup(kid); key != nil {
+		return key, nil
+	}
+	// The token may be signed with a key rotated in after the last fetch
+	s.fetchLock.Lock()
+	if time.Since(s.fetchedAt) >= KEY_SET_MIN_FETCH_PERIOD {
+		if err := s.fetchLocked(); err != nil {
+			log.Println("Key set fetch failed: ", err)
+		}
+	}
+	s.fetchLock.Unlock()
+	if key := s.lookup(kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrTokenInvalid
+}
+
+/* Fetch the key set of the auth service and keep it up to date */
+func LoadKeySet() {
+	if err := accessKeys.fetch(); err != nil {
+		log.Println("Key set fetch failed: ", err)
+	}
+	go func() {
+		ticker := time.NewTicker(config.Get().Auth.KeySetRefreshPeriod)
+		for range ticker.C {
+			if err := accessKeys.fetch(); err != nil {
+				log.Println("Key set fetch failed: ", err)
+			}
+		}
+	}()
+}
+
+func BearerToken(r *http.Request) string {
+	splitToken := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+	if len(splitToken) <= 1 {
+		return ""
+	}
+	return splitToken[1]
+}
+
+/* Access tokens are JWTs, legacy login tokens are opaque hex strings */
+func IsAccessToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func VerifyAccessToken(token string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, accessKeys.keyFunc,
+		jwt.WithValidMethods([]string{ACCESS_TOKEN_ALG}),
+		jwt.WithIssuer(config.Get().Auth.Issuer),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrTokenInvalid
+	}
+	if claims.Subject == "" || claims.SessionID == "" {
+		return nil, ErrTokenInvalid
+	}
+	return claims, nil
+}
@@ -0,0 +1,369 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	REPLICA_BALANCING_ROUND_ROBIN = "round_robin"
+	REPLICA_BALANCING_LEAST_CONN  = "least_conn"
+)
+
+const (
+	TRACING_EXPORTER_NONE   = "none"
+	TRACING_EXPORTER_OTLP   = "otlp"
+	TRACING_EXPORTER_STDOUT = "stdout"
+	TRACING_EXPORTER_FILE   = "file"
+)
+
+type ServerConfig struct {
+	Host             string                   `mapstructure:"host"`
+	Port             string                   `mapstructure:"port"`
+	WebsocketEnabled bool                     `mapstructure:"websocket_enabled"`
+	RequestTimeout   time.Duration            `mapstructure:"request_timeout"`
+	RouteTimeouts    map[string]time.Duration `mapstructure:"route_timeouts"`
+}
+
+/* Deadline of the route's requests, zero means no deadline */
+func (c *ServerConfig) RouteTimeout(route string) time.Duration {
+	// The route names are lowercased on loading
+	if timeout, ok := c.RouteTimeouts[strings.ToLower(route)]; ok {
+		return timeout
+	}
+	return c.RequestTimeout
+}
+
+type DBConfig struct {
+	Master               string        `mapstructure:"master"`
+	Replica              []string      `mapstructure:"replica"`
+	UseReplica           bool          `mapstructure:"use_replica"`
+	ReplicaMaxLag        time.Duration `mapstructure:"replica_max_lag"`
+	ReplicaCheckPeriod   time.Duration `mapstructure:"replica_check_period"`
+	ReplicaBalancing     string        `mapstructure:"replica_balancing"`
+	ReadYourWritesWindow time.Duration `mapstructure:"read_your_writes_window"`
+}
+
+type CitusConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Master  string `mapstructure:"master"`
+}
+
+type DialogsConfig struct {
+	DB                  string            `mapstructure:"db"`
+	Port                string            `mapstructure:"port"`
+	MetricsPort         string            `mapstructure:"metrics_port"`
+	Host                string            `mapstructure:"host"`
+	UseTarantool        bool              `mapstructure:"use_tarantool"`
+	MarkAsReadOnListing bool              `mapstructure:"mark_as_read_on_listing"`
+	SagaTimeout         time.Duration     `mapstructure:"saga_timeout"`
+	SagaMaxAttempts     int               `mapstructure:"saga_max_attempts"`
+	SagaCheckPeriod     time.Duration     `mapstructure:"saga_check_period"`
+	ExportToken         string            `mapstructure:"export_token"`
+	WsPingPeriod        time.Duration     `mapstructure:"ws_ping_period"`
+	WsPongTimeout       time.Duration     `mapstructure:"ws_pong_timeout"`
+	WsResumeLimit       int               `mapstructure:"ws_resume_limit"`
+	Shards              map[string]string `mapstructure:"shards"`
+	ShardVnodes         int               `mapstructure:"shard_vnodes"`
+	NewShard            string            `mapstructure:"new_shard"`
+	EditWindow          time.Duration     `mapstructure:"edit_window"`
+	GroupMaxMembers     int               `mapstructure:"group_max_members"`
+}
+
+type CacheConfig struct {
+	URL                    string        `mapstructure:"url"`
+	TTL                    time.Duration `mapstructure:"ttl"`
+	FeedLength             int           `mapstructure:"feed_length"`
+	CelebrityThreshold     int           `mapstructure:"celebrity_threshold"`
+	CelebrityRefreshPeriod time.Duration `mapstructure:"celebrity_refresh_period"`
+}
+
+type TarantoolConfig struct {
+	URL  string `mapstructure:"url"`
+	User string `mapstructure:"user"`
+	Pass string `mapstructure:"pass"`
+}
+
+type RabbitMQConfig struct {
+	URL             string        `mapstructure:"url"`
+	Prefetch        int           `mapstructure:"prefetch"`
+	MaxRetries      int           `mapstructure:"max_retries"`
+	RetryBackoff    time.Duration `mapstructure:"retry_backoff"`
+	RetryBackoffMax time.Duration `mapstructure:"retry_backoff_max"`
+}
+
+type OutboxConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"`
+	Retention    time.Duration `mapstructure:"retention"`
+}
+
+type CountersConfig struct {
+	DB                 string        `mapstructure:"db"`
+	Port               string        `mapstructure:"port"`
+	MetricsPort        string        `mapstructure:"metrics_port"`
+	Host               string        `mapstructure:"host"`
+	InboxRetention     time.Duration `mapstructure:"inbox_retention"`
+	SummaryTTL         time.Duration `mapstructure:"summary_ttl"`
+	ReconcilePeriod    time.Duration `mapstructure:"reconcile_period"`
+	ReconcileBatchSize int           `mapstructure:"reconcile_batch_size"`
+}
+
+type AuthConfig struct {
+	Host                string        `mapstructure:"host"`
+	Port                string        `mapstructure:"port"`
+	Issuer              string        `mapstructure:"issuer"`
+	TokenValidityPeriod time.Duration `mapstructure:"token_validity_period"`
+	AccessTokenTTL      time.Duration `mapstructure:"access_token_ttl"`
+	RefreshTokenTTL     time.Duration `mapstructure:"refresh_token_ttl"`
+	KeyRotationPeriod   time.Duration `mapstructure:"key_rotation_period"`
+	KeySetRefreshPeriod time.Duration `mapstructure:"key_set_refresh_period"`
+	AdminToken          string        `mapstructure:"admin_token"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	File        string  `mapstructure:"file"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type Config struct {
+	Server    ServerConfig    `mapstructure:"server"`
+	DB        DBConfig        `mapstructure:"db"`
+	Citus     CitusConfig     `mapstructure:"citus"`
+	Dialogs   DialogsConfig   `mapstructure:"dialogs"`
+	Cache     CacheConfig     `mapstructure:"cache"`
+	Tarantool TarantoolConfig `mapstructure:"tarantool"`
+	RabbitMQ  RabbitMQConfig  `mapstructure:"rabbitmq"`
+	Outbox    OutboxConfig    `mapstructure:"outbox"`
+	Counters  CountersConfig  `mapstructure:"counters"`
+	Auth      AuthConfig      `mapstructure:"auth"`
+	Tracing   TracingConfig   `mapstructure:"tracing"`
+}
+
+type setting struct {
+	key   string
+	value interface{}
+	usage string
+}
+
+/* Every known setting with its default, each one is also exposed as a CLI flag */
+var defaults = []setting{
+	{"server.host", "localhost:8083", "Address the services use to reach the backend"},
+	{"server.port", ":8083", "Backend listen address"},
+	{"server.websocket_enabled", true, "Serve the posts websocket"},
+	{"server.request_timeout", 5 * time.Second, "Default deadline of a request"},
+	{"server.route_timeouts", map[string]string{}, "Deadlines of the routes by route name, 0 disables the deadline"},
+
+	{"db.master", "", "Master database DSN"},
+	{"db.replica", []string{}, "Replica database DSNs"},
+	{"db.use_replica", false, "Route reads to the replicas"},
+	{"db.replica_max_lag", 1 * time.Second, "Replication lag above which a replica is skipped"},
+	{"db.replica_check_period", 1 * time.Second, "Replica health check period"},
+	{"db.replica_balancing", REPLICA_BALANCING_ROUND_ROBIN, "Replica balancing: round_robin or least_conn"},
+	{"db.read_your_writes_window", 5 * time.Second, "Period after a write when the user reads from the master"},
+
+	{"citus.enabled", false, "Use the Citus cluster instead of the master database"},
+	{"citus.master", "", "Citus coordinator DSN"},
+
+	{"dialogs.db", "", "Dialogs database DSN"},
+	{"dialogs.port", ":8087", "Dialogs service listen address"},
+	{"dialogs.metrics_port", ":9087", "Dialogs service metrics listen address, internal only"},
+	{"dialogs.host", "localhost:8087", "Address the backend uses to reach the dialogs service"},
+	{"dialogs.use_tarantool", false, "Store dialogs in Tarantool"},
+	{"dialogs.mark_as_read_on_listing", true, "Mark listed messages as read"},
+	{"dialogs.saga_timeout", 1 * time.Minute, "Period a message may wait for the counters reply before the request is re-issued"},
+	{"dialogs.saga_max_attempts", 3, "Re-issued counter requests before the message is compensated"},
+	{"dialogs.saga_check_period", 30 * time.Second, "Period of looking for the stuck messages"},
+	{"dialogs.export_token", "", "Token the counters service exports the unread counts with, empty to disable"},
+	{"dialogs.ws_ping_period", 30 * time.Second, "Period of the websocket heartbeats"},
+	{"dialogs.ws_pong_timeout", 1 * time.Minute, "Period the websocket is closed after if the client does not respond"},
+	{"dialogs.ws_resume_limit", 500, "Missed messages replayed to a reconnected websocket, the client reloads the dialogs beyond it"},
+	{"dialogs.shards", map[string]string{}, "Dialogs database DSNs by shard name, dialogs.db is the only shard if empty"},
+	{"dialogs.shard_vnodes", 64, "Points of every shard on the consistent hash ring"},
+	{"dialogs.new_shard", "", "Shard of dialogs.shards being filled by resharding, empty once cut over"},
+	{"dialogs.edit_window", 15 * time.Minute, "Period the author may edit a message for after sending it"},
+	{"dialogs.group_max_members", 100, "Members a group chat may have"},
+
+	{"cache.url", "", "Redis URL"},
+	{"cache.ttl", 24 * time.Hour, "Feed cache TTL"},
+	{"cache.feed_length", 1000, "Max number of posts kept in a materialized feed"},
+	{"cache.celebrity_threshold", 10000, "Followers count which makes an author a celebrity"},
+	{"cache.celebrity_refresh_period", 60 * time.Second, "Celebrities refresh period"},
+
+	{"tarantool.url", "", "Tarantool address"},
+	{"tarantool.user", "", "Tarantool user"},
+	{"tarantool.pass", "", "Tarantool password"},
+
+	{"rabbitmq.url", "", "RabbitMQ URL"},
+	{"rabbitmq.prefetch", 16, "Max number of unacknowledged messages per consumer"},
+	{"rabbitmq.max_retries", 5, "Attempts to handle a message before it is dead-lettered"},
+	{"rabbitmq.retry_backoff", 1 * time.Second, "Delay before the first retry, doubled on every next one"},
+	{"rabbitmq.retry_backoff_max", 1 * time.Minute, "Max delay between the retries"},
+
+	{"outbox.poll_interval", 200 * time.Millisecond, "Period of publishing the pending outbox events"},
+	{"outbox.batch_size", 100, "Max number of outbox events published at once"},
+	{"outbox.retention", 24 * time.Hour, "Period the sent outbox events are kept for"},
+
+	{"counters.db", "", "Counters database DSN"},
+	{"counters.port", ":8091", "Counters service listen address"},
+	{"counters.metrics_port", ":9091", "Counters service metrics listen address, internal only"},
+	{"counters.host", "localhost:8091", "Address the services use to reach the counters service"},
+	{"counters.summary_ttl", 1 * time.Minute, "Unread summary cache TTL"},
+	{"counters.reconcile_period", 1 * time.Hour, "Period of checking the counters against the dialogs, 0 disables the checks"},
+	{"counters.reconcile_batch_size", 1000, "Number of dialogs checked at once"},
+	{"counters.inbox_retention", 7 * 24 * time.Hour, "Period the processed message ids are kept for deduplication"},
+
+	{"auth.host", "localhost:8094", "Address the services use to reach the auth service"},
+	{"auth.port", ":8094", "Auth service listen address"},
+	{"auth.issuer", "highload-arch", "Issuer of the access tokens"},
+	{"auth.token_validity_period", 24 * time.Hour, "Legacy login token validity period"},
+	{"auth.access_token_ttl", 15 * time.Minute, "Access token lifetime"},
+	{"auth.refresh_token_ttl", 30 * 24 * time.Hour, "Refresh token lifetime"},
+	{"auth.key_rotation_period", 24 * time.Hour, "Signing key rotation period"},
+	{"auth.key_set_refresh_period", 5 * time.Minute, "Period of fetching the verification key set"},
+	{"auth.admin_token", "", "Token allowing to rotate the signing keys on demand, empty to disable"},
+
+	{"tracing.exporter", TRACING_EXPORTER_NONE, "Trace exporter: none, otlp, stdout or file"},
+	{"tracing.endpoint", "localhost:4318", "OTLP/HTTP collector address"},
+	{"tracing.file", "traces.json", "File the traces are written to by the file exporter"},
+	{"tracing.sample_ratio", 1.0, "Share of the traces started by the service which are sampled"},
+}
+
+func (c *Config) Validate() error {
+	positive := map[string]time.Duration{
+		"server.request_timeout":         c.Server.RequestTimeout,
+		"db.replica_max_lag":             c.DB.ReplicaMaxLag,
+		"db.replica_check_period":        c.DB.ReplicaCheckPeriod,
+		"db.read_your_writes_window":     c.DB.ReadYourWritesWindow,
+		"cache.ttl":                      c.Cache.TTL,
+		"cache.celebrity_refresh_period": c.Cache.CelebrityRefreshPeriod,
+		"rabbitmq.retry_backoff":         c.RabbitMQ.RetryBackoff,
+		"rabbitmq.retry_backoff_max":     c.RabbitMQ.RetryBackoffMax,
+		"dialogs.saga_timeout":           c.Dialogs.SagaTimeout,
+		"dialogs.saga_check_period":      c.Dialogs.SagaCheckPeriod,
+		"dialogs.ws_ping_period":         c.Dialogs.WsPingPeriod,
+		"dialogs.ws_pong_timeout":        c.Dialogs.WsPongTimeout,
+		"dialogs.edit_window":            c.Dialogs.EditWindow,
+		"outbox.poll_interval":           c.Outbox.PollInterval,
+		"outbox.retention":               c.Outbox.Retention,
+		"counters.inbox_retention":       c.Counters.InboxRetention,
+		"counters.summary_ttl":           c.Counters.SummaryTTL,
+		"auth.token_validity_period":     c.Auth.TokenValidityPeriod,
+		"auth.access_token_ttl":          c.Auth.AccessTokenTTL,
+		"auth.refresh_token_ttl":         c.Auth.RefreshTokenTTL,
+		"auth.key_rotation_period":       c.Auth.KeyRotationPeriod,
+		"auth.key_set_refresh_period":    c.Auth.KeySetRefreshPeriod,
+	}
+	for name, value := range positive {
+		if value <= 0 {
+			return errors.Errorf("%s must be positive, got %s", name, value)
+		}
+	}
+	for route, timeout := range c.Server.RouteTimeouts {
+		if timeout < 0 {
+			return errors.Errorf("server.route_timeouts.%s must not be negative, got %s", route, timeout)
+		}
+	}
+	if c.RabbitMQ.Prefetch <= 0 {
+		return errors.Errorf("rabbitmq.prefetch must be positive, got %d", c.RabbitMQ.Prefetch)
+	}
+	if c.RabbitMQ.MaxRetries < 0 {
+		return errors.Errorf("rabbitmq.max_retries must not be negative, got %d", c.RabbitMQ.MaxRetries)
+	}
+	if c.Dialogs.SagaMaxAttempts < 0 {
+		return errors.Errorf("dialogs.saga_max_attempts must not be negative, got %d", c.Dialogs.SagaMaxAttempts)
+	}
+	if c.Dialogs.WsPongTimeout <= c.Dialogs.WsPingPeriod {
+		return errors.Errorf("dialogs.ws_pong_timeout must be longer than dialogs.ws_ping_period, got %s", c.Dialogs.WsPongTimeout)
+	}
+	if c.Dialogs.WsResumeLimit <= 0 {
+		return errors.Errorf("dialogs.ws_resume_limit must be positive, got %d", c.Dialogs.WsResumeLimit)
+	}
+	if c.Dialogs.GroupMaxMembers < 2 {
+		return errors.Errorf("dialogs.group_max_members must be at least 2, got %d", c.Dialogs.GroupMaxMembers)
+	}
+	if c.Dialogs.ShardVnodes <= 0 {
+		return errors.Errorf("dialogs.shard_vnodes must be positive, got %d", c.Dialogs.ShardVnodes)
+	}
+	if _, ok := c.Dialogs.Shards[c.Dialogs.NewShard]; c.Dialogs.NewShard != "" && (!ok || len(c.Dialogs.Shards) < 2) {
+		return errors.Errorf("dialogs.new_shard must be one of several dialogs.shards, got %q", c.Dialogs.NewShard)
+	}
+	if c.Counters.ReconcilePeriod < 0 {
+		return errors.Errorf("counters.reconcile_period must not be negative, got %s", c.Counters.ReconcilePeriod)
+	}
+	if c.Counters.ReconcileBatchSize <= 0 {
+		return errors.Errorf("counters.reconcile_batch_size must be positive, got %d", c.Counters.ReconcileBatchSize)
+	}
+	if c.Outbox.BatchSize <= 0 {
+		return errors.Errorf("outbox.batch_size must be positive, got %d", c.Outbox.BatchSize)
+	}
+	if c.Cache.FeedLength <= 0 {
+		return errors.Errorf("cache.feed_length must be positive, got %d", c.Cache.FeedLength)
+	}
+	if c.Cache.CelebrityThreshold <= 0 {
+		return errors.Errorf("cache.celebrity_threshold must be positive, got %d", c.Cache.CelebrityThreshold)
+	}
+	if c.DB.ReplicaBalancing != REPLICA_BALANCING_ROUND_ROBIN && c.DB.ReplicaBalancing != REPLICA_BALANCING_LEAST_CONN {
+		return errors.Errorf("db.replica_balancing must be %s or %s, got %q",
+			REPLICA_BALANCING_ROUND_ROBIN, REPLICA_BALANCING_LEAST_CONN, c.DB.ReplicaBalancing)
+	}
+	if c.DB.UseReplica && len(c.DB.Replica) == 0 {
+		return errors.Errorf("db.use_replica is set, but db.replica is empty")
+	}
+	if c.Citus.Enabled && c.Citus.Master == "" {
+		return errors.Errorf("citus.enabled is set, but citus.master is empty")
+	}
+	switch c.Tracing.Exporter {
+	case TRACING_EXPORTER_NONE, TRACING_EXPORTER_OTLP, TRACING_EXPORTER_STDOUT, TRACING_EXPORTER_FILE:
+	default:
+		return errors.Errorf("tracing.exporter must be %s, %s, %s or %s, got %q", TRACING_EXPORTER_NONE,
+			TRACING_EXPORTER_OTLP, TRACING_EXPORTER_STDOUT, TRACING_EXPORTER_FILE, c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return errors.Errorf("tracing.sample_ratio must be within [0, 1], got %v", c.Tracing.SampleRatio)
+	}
+	if c.Dialogs.UseTarantool && c.Tarantool.URL == "" {
+		return errors.Errorf("dialogs.use_tarantool is set, but tarantool.url is empty")
+	}
+	return nil
+}
+
+/* Copy the settings which can be changed without restarting the process */
+func (c *Config) withSafeSettings(from *Config) *Config {
+	res := *c
+	res.Server.WebsocketEnabled = from.Server.WebsocketEnabled
+	res.Server.RequestTimeout = from.Server.RequestTimeout
+	res.Server.RouteTimeouts = from.Server.RouteTimeouts
+	res.DB.ReplicaMaxLag = from.DB.ReplicaMaxLag
+	res.DB.ReplicaBalancing = from.DB.ReplicaBalancing
+	res.DB.ReadYourWritesWindow = from.DB.ReadYourWritesWindow
+	res.Dialogs.MarkAsReadOnListing = from.Dialogs.MarkAsReadOnListing
+	res.Dialogs.SagaTimeout = from.Dialogs.SagaTimeout
+	res.Dialogs.SagaMaxAttempts = from.Dialogs.SagaMaxAttempts
+	res.Dialogs.SagaCheckPeriod = from.Dialogs.SagaCheckPeriod
+	res.Dialogs.WsPingPeriod = from.Dialogs.WsPingPeriod
+	res.Dialogs.WsPongTimeout = from.Dialogs.WsPongTimeout
+	res.Dialogs.WsResumeLimit = from.Dialogs.WsResumeLimit
+	res.Dialogs.EditWindow = from.Dialogs.EditWindow
+	res.Dialogs.GroupMaxMembers = from.Dialogs.GroupMaxMembers
+	res.Cache.TTL = from.Cache.TTL
+	res.Cache.FeedLength = from.Cache.FeedLength
+	res.Cache.CelebrityThreshold = from.Cache.CelebrityThreshold
+	res.Auth.TokenValidityPeriod = from.Auth.TokenValidityPeriod
+	res.Auth.AccessTokenTTL = from.Auth.AccessTokenTTL
+	res.Auth.RefreshTokenTTL = from.Auth.RefreshTokenTTL
+	res.RabbitMQ.MaxRetries = from.RabbitMQ.MaxRetries
+	res.RabbitMQ.RetryBackoff = from.RabbitMQ.RetryBackoff
+	res.RabbitMQ.RetryBackoffMax = from.RabbitMQ.RetryBackoffMax
+	res.Outbox.PollInterval = from.Outbox.PollInterval
+	res.Outbox.BatchSize = from.Outbox.BatchSize
+	res.Outbox.Retention = from.Outbox.Retention
+	res.Counters.InboxRetention = from.Counters.InboxRetention
+	res.Counters.SummaryTTL = from.Counters.SummaryTTL
+	res.Counters.ReconcileBatchSize = from.Counters.ReconcileBatchSize
+	return &res
+}
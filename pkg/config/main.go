@@ -1,31 +1,127 @@
 package config
 
 import (
-	"github.com/spf13/viper"
 	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 )
 
+/*
+ * Settings are resolved in the order: CLI flags, HIGHLOAD_* environment
+ * variables (e.g. HIGHLOAD_DB_USE_REPLICA), the YAML file, defaults.
+ * The file is watched, safe settings are applied on change without restart.
+ */
+
+const ENV_PREFIX = "HIGHLOAD"
+
+var (
+	v       = viper.New()
+	current atomic.Pointer[Config]
+	args    []string
+)
+
+/* Load the configuration, the file can be overridden with --config */
 func Load(filename string) {
-	cfg := viper.GetViper()
+	for _, s := range defaults {
+		v.SetDefault(s.key, s.value)
+	}
+
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
+	flags.StringVar(&filename, "config", filename, "Path to the YAML config file, empty to skip it")
+	for _, s := range defaults {
+		switch value := s.value.(type) {
+		case bool:
+			flags.Bool(s.key, value, s.usage)
+		case int:
+			flags.Int(s.key, value, s.usage)
+		case float64:
+			flags.Float64(s.key, value, s.usage)
+		case time.Duration:
+			flags.Duration(s.key, value, s.usage)
+		case []string:
+			flags.StringSlice(s.key, value, s.usage)
+		case map[string]string:
+			flags.StringToString(s.key, value, s.usage)
+		default:
+			flags.String(s.key, value.(string), s.usage)
+		}
+		if err := v.BindPFlag(s.key, flags.Lookup(s.key)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	flags.Parse(os.Args[1:])
+	args = flags.Args()
+
+	v.SetEnvPrefix(ENV_PREFIX)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
 
-	cfg.SetConfigType("yaml")
-	cfg.SetConfigFile(filename)
+	if filename != "" {
+		v.SetConfigType("yaml")
+		v.SetConfigFile(filename)
+		if err := v.ReadInConfig(); err != nil {
+			log.Fatalf("Can't read config file: %s", err)
+		}
+	}
 
-	err := cfg.ReadInConfig()
+	cfg, err := decode()
 	if err != nil {
-		log.Fatalf("Can't read config file: %s", err)
+		log.Fatalf("Invalid config: %s", err)
+	}
+	current.Store(cfg)
+
+	if filename != "" {
+		v.OnConfigChange(func(e fsnotify.Event) {
+			reload()
+		})
+		v.WatchConfig()
 	}
-	return
 }
 
-func Get(name string) interface{} {
-	return viper.Get(name)
+/* Current configuration, must not be modified by the caller */
+func Get() *Config {
+	return current.Load()
 }
 
-func GetString(name string) string {
-	return viper.GetString(name)
+/* Positional arguments left after the flags */
+func Args() []string {
+	return args
 }
 
-func GetInt(name string) int {
-	return viper.GetInt(name)
+func decode() (*Config, error) {
+	cfg := &Config{}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	// Viper lowercases the keys read from the file, but not the ones from the flags
+	timeouts := make(map[string]time.Duration, len(cfg.Server.RouteTimeouts))
+	for route, timeout := range cfg.Server.RouteTimeouts {
+		timeouts[strings.ToLower(route)] = timeout
+	}
+	cfg.Server.RouteTimeouts = timeouts
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func reload() {
+	next, err := decode()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current config: %s", err)
+		return
+	}
+	cfg := current.Load().withSafeSettings(next)
+	if !reflect.DeepEqual(cfg, next) {
+		log.Println("Config changed, some of the changes are applied only after restart")
+	}
+	current.Store(cfg)
+	log.Println("Config reloaded")
 }
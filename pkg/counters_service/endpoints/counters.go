@@ -1,12 +1,12 @@
 package endpoints
 
 import (
-	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/counters_service/storage"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -15,30 +15,65 @@ import (
 // token - user token
 // from user_id to token's user
 func CountersGetUnreadMessages(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
 	vars := mux.Vars(r)
 	to, ok := vars["user_id"]
 	if !ok {
 		log.Println("user_id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	userID := common.CheckAuth(r)
-	if userID == "" {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+	userID := common.UserIDFromContext(r.Context())
+
+	count, err := storage.GetMessageCount(r.Context(), userID, to)
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(count)
+
+}
+
+type UnreadDialogBody struct {
+	UserID        string    `json:"user_id"`
+	Count         int       `json:"count"`
+	LastMessageAt time.Time `json:"last_message_at"`
+}
 
-	count, err := storage.GetMessageCount(context.Background(), userID, to)
+type UnreadGroupBody struct {
+	GroupID       string    `json:"group_id"`
+	Count         int       `json:"count"`
+	LastMessageAt time.Time `json:"last_message_at"`
+}
+
+type UnreadSummaryResp struct {
+	Total   int                 `json:"total"`
+	Dialogs []*UnreadDialogBody `json:"dialogs"`
+	Groups  []*UnreadGroupBody  `json:"groups"`
+}
+
+// GET /counters/unread
+// token - user token
+// unread messages received by token's user, in total, by sender and by group
+func CountersGetUnread(w http.ResponseWriter, r *http.Request) {
+	userID := common.UserIDFromContext(r.Context())
+
+	summary, err := storage.GetUnreadSummary(r.Context(), userID)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(count)
 
+	resp := &UnreadSummaryResp{Total: summary.Total, Dialogs: []*UnreadDialogBody{}, Groups: []*UnreadGroupBody{}}
+	for _, dialog := range summary.Dialogs {
+		resp.Dialogs = append(resp.Dialogs, &UnreadDialogBody{UserID: dialog.AuthorID, Count: dialog.Count, LastMessageAt: dialog.LastMessageAt})
+	}
+	for _, group := range summary.Groups {
+		resp.Groups = append(resp.Groups, &UnreadGroupBody{GroupID: group.GroupID, Count: group.Count, LastMessageAt: group.LastMessageAt})
+	}
+	json.NewEncoder(w).Encode(resp)
 }
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
 	"highload-arch/pkg/counters_service/routes"
 	"highload-arch/pkg/counters_service/storage"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
 	"log"
 	"os"
 
@@ -25,19 +28,39 @@ func main() {
 	/*f := setLoggerFile("./logs/counters-service.log")
 	defer f.Close()*/
 	config.Load("local-config.yaml")
+	defer tracing.Init("counters")()
 
 	log.Printf("Connecting to Postgres")
 	storage.CreateConnectionPool()
 
+	log.Printf("Connecting to Cache")
+	storage.ConnectToCache()
+
+	if args := config.Args(); len(args) > 0 && args[0] == "reconcile" {
+		if err := storage.Reconcile(context.Background()); err != nil {
+			log.Fatalf("Counters reconciliation failed: %s", err)
+		}
+		return
+	}
+
 	log.Printf("Connecting to RabbitMQ")
 	storage.ConnectToRabbitMQ()
 	defer storage.CloseRabbitMQ()
 
+	go storage.RunInboxPurge(context.Background())
+	go storage.RunReconciliation(context.Background())
+
 	log.Printf("Running Saga Handler")
 	go storage.SagaHandleUpdateMessageCount(context.Background(), storage.UpdateMessageCount, storage.ReplyToDialogService)
 
+	log.Printf("Loading access token keys")
+	common.LoadKeySet()
+	common.ConnectToSessionCache()
+
+	go metrics.Serve(config.Get().Counters.MetricsPort)
+
 	log.Printf("Server started")
 	router := routes.NewRouter()
 
-	log.Fatal(http.ListenAndServe(config.GetString("counters.port"), router))
+	log.Fatal(http.ListenAndServe(config.Get().Counters.Port, router))
 }
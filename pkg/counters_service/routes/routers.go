@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/counters_service/endpoints"
+	"highload-arch/pkg/middleware"
 	"net/http"
 	"strings"
 
@@ -15,6 +16,7 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Auth        bool
 }
 
 const PREFIX_V2 = "/api/v2"
@@ -24,9 +26,11 @@ type Routes []Route
 func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
-		var handler http.Handler
-		handler = route.HandlerFunc
-		common.Logger(handler, route.Name)
+		var auth middleware.Authenticator
+		if route.Auth {
+			auth = common.Authenticate
+		}
+		handler := middleware.Wrap(route.HandlerFunc, route.Name, auth)
 
 		router.
 			Methods(route.Method).
@@ -48,6 +52,7 @@ var routes = Routes{
 		"GET",
 		PREFIX_V2,
 		Index,
+		false,
 	},
 
 	Route{
@@ -55,5 +60,14 @@ var routes = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/counters/{user_id}/unreadMessages",
 		endpoints.CountersGetUnreadMessages,
+		true,
+	},
+
+	Route{
+		"CountersGetUnread",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/counters/unread",
+		endpoints.CountersGetUnread,
+		true,
 	},
 }
@@ -3,34 +3,114 @@ package storage
 import (
 	"context"
 	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
 	"log"
+	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4"
 )
 
+const INBOX_PURGE_PERIOD = time.Hour
+
 type UnreadMessageCount struct {
 	Count       int    `pg:"count"`
 	AuthorID    string `pg:"author_id"`
 	RecepientID string `pg:"recepient_id"`
+	GroupID     string `pg:"group_id"`
 }
 
+/* The recipient's total is changed along with the count of the dialog */
 func (req *UnreadMessageCount) dbIncMessageCount(ctx context.Context, tx pgx.Tx) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
 	_, err := tx.Exec(ctx,
-		`INSERT INTO unread_messages (author_id, recepient_id) VALUES ($1, $2) ON CONFLICT (author_id, recepient_id) DO UPDATE SET count = EXCLUDED.count + 1`,
-		req.AuthorID, req.RecepientID)
+		`INSERT INTO unread_messages (author_id, recepient_id, last_message_at, updated_at) VALUES ($1, $2, $3, $3) ON CONFLICT (author_id, recepient_id) DO UPDATE SET count = unread_messages.count + 1, last_message_at = EXCLUDED.last_message_at, updated_at = EXCLUDED.last_message_at`,
+		req.AuthorID, req.RecepientID, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO unread_totals (recepient_id, count) VALUES ($1, 1) ON CONFLICT (recepient_id) DO UPDATE SET count = unread_totals.count + 1`,
+		req.RecepientID)
 
 	return err
 }
 
+/* The count never goes below zero, e.g. when the decrement overtakes the increment */
 func (req *UnreadMessageCount) dbDecMessageCount(ctx context.Context, tx pgx.Tx) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	tag, err := tx.Exec(ctx,
+		`UPDATE unread_messages SET count = count - 1, updated_at = $3 WHERE author_id = $1 AND recepient_id = $2 AND count > 0`,
+		req.AuthorID, req.RecepientID, now)
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE unread_totals SET count = GREATEST(count - 1, 0) WHERE recepient_id = $1`,
+		req.RecepientID)
+
+	return err
+}
+
+func (req *UnreadMessageCount) dbIncGroupMessageCount(ctx context.Context, tx pgx.Tx) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
 	_, err := tx.Exec(ctx,
-		`INSERT INTO unread_messages (author_id, recepient_id) VALUES ($1, $2) ON CONFLICT (author_id, recepient_id) DO UPDATE SET count = EXCLUDED.count - 1`,
-		req.AuthorID, req.RecepientID)
+		`INSERT INTO group_unread_messages (group_id, recepient_id, last_message_at, updated_at) VALUES ($1, $2, $3, $3) ON CONFLICT (group_id, recepient_id) DO UPDATE SET count = group_unread_messages.count + 1, last_message_at = EXCLUDED.last_message_at, updated_at = EXCLUDED.last_message_at`,
+		req.GroupID, req.RecepientID, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO unread_totals (recepient_id, count) VALUES ($1, 1) ON CONFLICT (recepient_id) DO UPDATE SET count = unread_totals.count + 1`,
+		req.RecepientID)
 
 	return err
 }
 
+func (req *UnreadMessageCount) dbDecGroupMessageCount(ctx context.Context, tx pgx.Tx) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	tag, err := tx.Exec(ctx,
+		`UPDATE group_unread_messages SET count = count - 1, updated_at = $3 WHERE group_id = $1 AND recepient_id = $2 AND count > 0`,
+		req.GroupID, req.RecepientID, now)
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE unread_totals SET count = GREATEST(count - 1, 0) WHERE recepient_id = $1`,
+		req.RecepientID)
+
+	return err
+}
+
+/* A group message is processed once for every member */
+func processedKey(msg *common.MessageCountRequest) string {
+	if msg.GroupID != "" {
+		return msg.MessageID + ":" + msg.RecepientID
+	}
+	return msg.MessageID
+}
+
+/* Record the message as processed, false if it already was */
+func dbMarkProcessed(ctx context.Context, tx pgx.Tx, msg *common.MessageCountRequest) (bool, error) {
+	// Timestamps are stored without time zone and with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO processed_messages (message_id, action, processed_at) VALUES ($1, $2, $3) ON CONFLICT (message_id, action) DO NOTHING`,
+		processedKey(msg), msg.Action, now)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func dbPurgeProcessed(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM processed_messages WHERE processed_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 func dbGetMessageCount(ctx context.Context, userID, to string) ([]UnreadMessageCount, error) {
 	res := []UnreadMessageCount{}
 	rows, err := db.Query(ctx,
@@ -58,27 +138,57 @@ func GetMessageCount(ctx context.Context, userID, to string) (*UnreadMessageCoun
 	return &count[0], nil
 }
 
+/* Apply the counter change once per message and action, redelivered messages are skipped */
 func UpdateMessageCount(ctx context.Context, msg *common.MessageCountRequest) error {
-	req := UnreadMessageCount{AuthorID: msg.AuthorID, RecepientID: msg.RecepientID}
-	var err error
-	if msg.Action == common.INCREMENT_MESSAGE_COUNT_ACTION {
-		_, err = HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-			err := req.dbIncMessageCount(ctx, tx)
-			if err != nil {
-				return nil, err
-			}
-			return nil, nil
-		})
+	req := UnreadMessageCount{AuthorID: msg.AuthorID, RecepientID: msg.RecepientID, GroupID: msg.GroupID}
+	var update func(ctx context.Context, tx pgx.Tx) error
+	if msg.Action == common.INCREMENT_MESSAGE_COUNT_ACTION && msg.GroupID != "" {
+		update = req.dbIncGroupMessageCount
+	} else if msg.Action == common.DECREMENT_MESSAGE_COUNT_ACTION && msg.GroupID != "" {
+		update = req.dbDecGroupMessageCount
+	} else if msg.Action == common.INCREMENT_MESSAGE_COUNT_ACTION {
+		update = req.dbIncMessageCount
 	} else if msg.Action == common.DECREMENT_MESSAGE_COUNT_ACTION {
-		_, err = HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-			err := req.dbDecMessageCount(ctx, tx)
+		update = req.dbDecMessageCount
+	} else {
+		log.Printf("Unknown action: %s", msg.Action)
+		return nil
+	}
+	_, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		// Messages without an id, e.g. the ones stored in Tarantool, can't be deduplicated
+		if msg.MessageID != "" {
+			first, err := dbMarkProcessed(ctx, tx, msg)
 			if err != nil {
 				return nil, err
 			}
-			return nil, nil
-		})
-	} else {
-		log.Printf("Unknown action: %s", msg.Action)
+			if !first {
+				log.Printf("Message %s already processed with action %s, skipping", msg.MessageID, msg.Action)
+				return nil, nil
+			}
+		}
+		return nil, update(ctx, tx)
+	})
+	if err != nil {
+		return err
+	}
+	cacheRemoveSummary(ctx, msg.RecepientID)
+	return nil
+}
+
+/* Forget the processed messages older than the retention period, until the context is done */
+func RunInboxPurge(ctx context.Context) {
+	for {
+		before := time.Now().UTC().Add(-config.Get().Counters.InboxRetention)
+		count, err := dbPurgeProcessed(ctx, before)
+		if err != nil {
+			log.Printf("Processed messages purge failed: %s", err)
+		} else if count > 0 {
+			log.Printf("Purged %d processed messages", count)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(INBOX_PURGE_PERIOD):
+		}
 	}
-	return err
 }
@@ -3,31 +3,44 @@ package storage
 import (
 	"context"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/queue"
+	"highload-arch/pkg/tracing"
 	"log"
 
 	"github.com/jackc/pgx/v4/pgxpool"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
 )
 
 var db *pgxpool.Pool
-var rbmq *amqp.Connection
+var cache *redis.Client
+var publisher *queue.Publisher
 
 func ConnectToRabbitMQ() {
-	url := config.GetString("rabbitmq.url")
 	var err error
-	rbmq, err = amqp.Dial(url)
+	publisher, err = queue.NewPublisher(queue.UNREAD_MESSAGES_COUNTED_BINDING)
 	if err != nil {
 		panic(err)
 	}
 }
 
 func CloseRabbitMQ() {
-	rbmq.Close()
+	publisher.Close()
 }
 func CreateConnectionPool() {
 	var err error
-	db, err = pgxpool.Connect(context.Background(), config.GetString("counters.db"))
+	db, err = tracing.ConnectPool(context.Background(), config.Get().Counters.DB)
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.RegisterPool("counters", db)
+}
+
+func ConnectToCache() {
+	opt, err := redis.ParseURL(config.Get().Cache.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache = redis.NewClient(opt)
+	tracing.InstrumentRedis(cache)
 }
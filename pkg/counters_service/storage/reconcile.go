@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+/*
+ * The counters are checked against the unread messages exported by the
+ * dialogs service page by page, both ordered by the (author, recipient)
+ * pair. A counter is repaired only if no message of the dialog is pending
+ * and the counter was not changed since the page was requested, so the
+ * sagas in flight are never undone. The counters of a page are locked and
+ * repaired in one transaction along with the totals of their recipients.
+ * The group counters are not exported by the dialogs service, they are only
+ * kept in the recounted totals.
+ */
+
+const EXPORT_PATH = "/api/v2/dialogs/unread/export"
+
+type pairKey struct {
+	AuthorID    string
+	RecepientID string
+}
+
+type counterRow struct {
+	AuthorID    string    `pg:"author_id"`
+	RecepientID string    `pg:"recepient_id"`
+	Count       int       `pg:"count"`
+	UpdatedAt   time.Time `pg:"updated_at"`
+}
+
+type reconcileStats struct {
+	dialogs  int
+	messages int
+}
+
+func fetchUnreadCounts(ctx context.Context, after *pairKey, limit int) ([]*common.UnreadCountExport, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if after != nil {
+		query.Set("after_author", after.AuthorID)
+		query.Set("after_recepient", after.RecepientID)
+	}
+	u := url.URL{Scheme: "http", Host: config.Get().Dialogs.Host, Path: EXPORT_PATH, RawQuery: query.Encode()}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(common.EXPORT_TOKEN_HEADER, config.Get().Dialogs.ExportToken)
+	resp, err := tracing.NewClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unread counts export failed with status %d", resp.StatusCode)
+	}
+
+	var export common.UnreadCountsExport
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		return nil, err
+	}
+	return export.Counts, nil
+}
+
+/* Lock the counters of the pairs within (after, last], nil bounds are open */
+func dbLockCounters(ctx context.Context, tx pgx.Tx, after, last *pairKey) ([]counterRow, error) {
+	res := []counterRow{}
+	query := `SELECT author_id, recepient_id, count, updated_at FROM unread_messages WHERE TRUE`
+	args := []interface{}{}
+	if after != nil {
+		query += ` AND (author_id, recepient_id) > ($1, $2)`
+		args = append(args, after.AuthorID, after.RecepientID)
+	}
+	if last != nil {
+		query += ` AND (author_id, recepient_id) <= ($` + strconv.Itoa(len(args)+1) + `, $` + strconv.Itoa(len(args)+2) + `)`
+		args = append(args, last.AuthorID, last.RecepientID)
+	}
+	query += ` ORDER BY author_id, recepient_id FOR UPDATE`
+	err := pgxscan.Select(ctx, tx, &res, query, args...)
+	return res, err
+}
+
+func dbSetMessageCount(ctx context.Context, tx pgx.Tx, key pairKey, count int) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`INSERT INTO unread_messages (author_id, recepient_id, count, last_message_at, updated_at) VALUES ($1, $2, $3, $4, $4) ON CONFLICT (author_id, recepient_id) DO UPDATE SET count = EXCLUDED.count, updated_at = EXCLUDED.updated_at`,
+		key.AuthorID, key.RecepientID, count, now)
+	return err
+}
+
+func dbRecountTotal(ctx context.Context, tx pgx.Tx, recepientID string) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO unread_totals (recepient_id, count)
+		SELECT $1, (SELECT COALESCE(SUM(count), 0) FROM unread_messages WHERE recepient_id = $1) + (SELECT COALESCE(SUM(count), 0) FROM group_unread_messages WHERE recepient_id = $1)
+		ON CONFLICT (recepient_id) DO UPDATE SET count = EXCLUDED.count`,
+		recepientID)
+	return err
+}
+
+/* Reconcile the pairs past after, returns the last pair of the page or nil once all are checked */
+func reconcilePage(ctx context.Context, after *pairKey, stats *reconcileStats) (*pairKey, error) {
+	limit := config.Get().Counters.ReconcileBatchSize
+	// Counters changed since the export was requested may be ahead of it
+	start := time.Now().UTC()
+	counts, err := fetchUnreadCounts(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	var last *pairKey
+	if len(counts) == limit {
+		last = &pairKey{AuthorID: counts[len(counts)-1].AuthorID, RecepientID: counts[len(counts)-1].RecepientID}
+	}
+	expected := make(map[pairKey]*common.UnreadCountExport, len(counts))
+	for _, count := range counts {
+		expected[pairKey{AuthorID: count.AuthorID, RecepientID: count.RecepientID}] = count
+	}
+
+	page := reconcileStats{}
+	recipients := map[string]bool{}
+	_, err = HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		rows, err := dbLockCounters(ctx, tx, after, last)
+		if err != nil {
+			return nil, err
+		}
+		actual := make(map[pairKey]counterRow, len(rows))
+		for _, row := range rows {
+			key := pairKey{AuthorID: row.AuthorID, RecepientID: row.RecepientID}
+			actual[key] = row
+			if _, ok := expected[key]; !ok {
+				// No messages left in the dialog
+				expected[key] = &common.UnreadCountExport{AuthorID: row.AuthorID, RecepientID: row.RecepientID}
+			}
+		}
+		for key, exp := range expected {
+			row, ok := actual[key]
+			if row.Count == exp.Unread {
+				continue
+			}
+			if exp.Pending > 0 || (ok && !row.UpdatedAt.Before(start)) {
+				continue
+			}
+			log.Printf("Unread counter %s->%s is %d, expected %d, repairing", key.AuthorID, key.RecepientID, row.Count, exp.Unread)
+			if err := dbSetMessageCount(ctx, tx, key, exp.Unread); err != nil {
+				return nil, err
+			}
+			page.dialogs++
+			if diff := row.Count - exp.Unread; diff > 0 {
+				page.messages += diff
+			} else {
+				page.messages -= diff
+			}
+			recipients[key.RecepientID] = true
+		}
+		for recepientID := range recipients {
+			if err := dbRecountTotal(ctx, tx, recepientID); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.CountersRepaired(page.dialogs)
+	for recepientID := range recipients {
+		cacheRemoveSummary(ctx, recepientID)
+	}
+	stats.dialogs += page.dialogs
+	stats.messages += page.messages
+	return last, nil
+}
+
+/* Check every counter against the dialogs database and repair the drifted ones */
+func Reconcile(ctx context.Context) error {
+	log.Println("Reconciling unread counters")
+	stats := reconcileStats{}
+	var after *pairKey
+	for {
+		last, err := reconcilePage(ctx, after, &stats)
+		if err != nil {
+			return err
+		}
+		if last == nil {
+			break
+		}
+		after = last
+	}
+	metrics.CountersReconciled(stats.dialogs, stats.messages)
+	log.Printf("Unread counters reconciled, %d dialogs repaired, %d messages off", stats.dialogs, stats.messages)
+	return nil
+}
+
+/* Reconcile the counters periodically until the context is done */
+func RunReconciliation(ctx context.Context) {
+	if config.Get().Counters.ReconcilePeriod == 0 || config.Get().Dialogs.ExportToken == "" {
+		log.Println("Counters reconciliation disabled")
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.Get().Counters.ReconcilePeriod):
+		}
+		if err := Reconcile(ctx); err != nil {
+			log.Printf("Counters reconciliation failed: %s", err)
+		}
+	}
+}
@@ -4,114 +4,38 @@ import (
 	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
-	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/queue"
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func ConnectClientToRabbitMQ() (*amqp.Connection, error) {
-	url := config.GetString("rabbitmq.url")
-	var err error
-	rbmqClient, err := amqp.Dial(url)
-	if err != nil {
-		return nil, err
-	}
-	return rbmqClient, nil
-}
-
-func CloseClientRabbitMQ(rbmqClient *amqp.Connection) {
-	rbmqClient.Close()
-}
-
 type RBMQUpdateDBCallback func(ctx context.Context, req *common.MessageCountRequest) error
 type RBMQResponseCallback func(ctx context.Context, req *common.MessageCountRequest) error
 
 func SagaHandleUpdateMessageCount(ctx context.Context, update_counter_db RBMQUpdateDBCallback, response_to_dialogs RBMQResponseCallback) error {
-	rbmqClient, err := ConnectClientToRabbitMQ()
-	if err != nil {
-		log.Println("Could not connect to rabbitmq on client side")
-		return err
-	}
-
-	defer CloseClientRabbitMQ(rbmqClient)
-
-	ch, err := rbmqClient.Channel()
-	if err != nil {
-		log.Println("Could not create rabbitmq channel on client side")
-		return err
-	}
-
-	defer ch.Close()
-
-	err = ch.ExchangeDeclare(
-		"unreadMessages", // name
-		"topic",          // type
-		false,            // durable
-		false,            // auto-deleted
-		false,            // internal
-		false,            // no-wait
-		nil,              // arguments
-	)
-
-	if err != nil {
-		log.Println("Cannot create exchange on client side")
-		return err
-	}
-
-	q, err := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		log.Println("Could not declare queue on client side")
-		return err
-	}
-
-	routingKey := "*.*"
-	err = ch.QueueBind(
-		q.Name,           // queue name
-		routingKey,       // routing key
-		"unreadMessages", // exchange
-		false,
-		nil)
-
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto ack
-		false,  // exclusive
-		false,  // no local
-		false,  // no wait
-		nil,    // args
-	)
-
-	var forever chan struct{}
-
-	go func() {
-		for d := range msgs {
-			log.Printf("Counter service(msg recv): [x] %s", d.Body)
-			var req common.MessageCountRequest
-			err = json.Unmarshal(d.Body, &req)
-			if err != nil {
-				log.Println("Cannot unmarshal update message count request to bytes array")
-			}
-			err := update_counter_db(ctx, &req)
-			if err != nil {
-				log.Printf("Erorr while updating counters: %s", err)
-			} else {
-				log.Printf("Sending reply to dialogs service")
-				response_to_dialogs(ctx, &req)
-			}
+	// The message is acked once the counter is updated and the reply is confirmed.
+	// A redelivered message skips the update, but is replied again in case the reply was lost
+	return queue.Consume(ctx, queue.UNREAD_MESSAGES_BINDING, func(ctx context.Context, d *amqp.Delivery) error {
+		log.Printf("Counter service(msg recv): [x] %s", d.Body)
+		var req common.MessageCountRequest
+		err := json.Unmarshal(d.Body, &req)
+		if err != nil {
+			log.Println("Cannot unmarshal update message count request to bytes array")
+			return queue.Permanent(err)
 		}
-	}()
-
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
-	return nil
-
+		done := metrics.SagaStep("counters_update")
+		err = update_counter_db(ctx, &req)
+		done(err)
+		if err != nil {
+			log.Printf("Erorr while updating counters: %s", err)
+			return err
+		}
+		log.Printf("Sending reply to dialogs service")
+		done = metrics.SagaStep("counters_reply")
+		err = response_to_dialogs(ctx, &req)
+		done(err)
+		return err
+	})
 }
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+ * The unread summary is polled by the clients, so it is cached in Redis
+ * and dropped from the cache whenever a counter of the recipient changes.
+ * A summary read concurrently with a change may stay stale until its TTL.
+ */
+
+const SUMMARY_MAX_DIALOGS = 100
+
+type UnreadDialog struct {
+	AuthorID      string    `pg:"author_id" json:"author_id"`
+	Count         int       `pg:"count" json:"count"`
+	LastMessageAt time.Time `pg:"last_message_at" json:"last_message_at"`
+}
+
+type UnreadGroup struct {
+	GroupID       string    `pg:"group_id" json:"group_id"`
+	Count         int       `pg:"count" json:"count"`
+	LastMessageAt time.Time `pg:"last_message_at" json:"last_message_at"`
+}
+
+type UnreadSummary struct {
+	Total   int            `json:"total"`
+	Dialogs []UnreadDialog `json:"dialogs"`
+	Groups  []UnreadGroup  `json:"groups"`
+}
+
+func summaryKey(userID string) string {
+	return "unread_summary:" + userID
+}
+
+func dbGetUnreadTotal(ctx context.Context, userID string) (int, error) {
+	var total int
+	err := db.QueryRow(ctx, `SELECT COALESCE(SUM(count), 0) FROM unread_totals WHERE recepient_id = $1`, userID).Scan(&total)
+	return total, err
+}
+
+/* Dialogs with unread messages received by the user, the most recent first */
+func dbGetUnreadDialogs(ctx context.Context, userID string, limit int) ([]UnreadDialog, error) {
+	res := []UnreadDialog{}
+	err := pgxscan.Select(ctx, db, &res,
+		`SELECT author_id, count, last_message_at FROM unread_messages WHERE recepient_id = $1 AND count > 0 ORDER BY last_message_at DESC LIMIT $2`,
+		userID, limit)
+	return res, err
+}
+
+/* Groups with unread messages of the user, the most recent first */
+func dbGetUnreadGroups(ctx context.Context, userID string, limit int) ([]UnreadGroup, error) {
+	res := []UnreadGroup{}
+	err := pgxscan.Select(ctx, db, &res,
+		`SELECT group_id, count, last_message_at FROM group_unread_messages WHERE recepient_id = $1 AND count > 0 ORDER BY last_message_at DESC LIMIT $2`,
+		userID, limit)
+	return res, err
+}
+
+func dbGetUnreadSummary(ctx context.Context, userID string) (*UnreadSummary, error) {
+	total, err := dbGetUnreadTotal(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	dialogs, err := dbGetUnreadDialogs(ctx, userID, SUMMARY_MAX_DIALOGS)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := dbGetUnreadGroups(ctx, userID, SUMMARY_MAX_DIALOGS)
+	if err != nil {
+		return nil, err
+	}
+	return &UnreadSummary{Total: total, Dialogs: dialogs, Groups: groups}, nil
+}
+
+func cacheGetSummary(ctx context.Context, userID string) (*UnreadSummary, error) {
+	data, err := cache.Get(ctx, summaryKey(userID)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var summary UnreadSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+func cacheSetSummary(ctx context.Context, userID string, summary *UnreadSummary) {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		log.Println("Cannot marshal unread summary: ", err)
+		return
+	}
+	if err := cache.Set(ctx, summaryKey(userID), data, config.Get().Counters.SummaryTTL).Err(); err != nil {
+		log.Println("Unread summary cache update failed: ", err)
+	}
+}
+
+func cacheRemoveSummary(ctx context.Context, userID string) {
+	if err := cache.Del(ctx, summaryKey(userID)).Err(); err != nil {
+		log.Println("Unread summary cache removal failed: ", err)
+	}
+}
+
+/* Total unread count of the user along with the unread dialogs and groups */
+func GetUnreadSummary(ctx context.Context, userID string) (*UnreadSummary, error) {
+	summary, err := cacheGetSummary(ctx, userID)
+	if err == nil {
+		metrics.CacheHit("unread_summary")
+		return summary, nil
+	}
+	if err != redis.Nil {
+		log.Println("Unread summary cache read failed: ", err)
+	}
+	metrics.CacheMiss("unread_summary")
+
+	summary, err = dbGetUnreadSummary(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	cacheSetSummary(ctx, userID, summary)
+	return summary, nil
+}
@@ -13,16 +13,12 @@ func HandleInTransaction(ctx context.Context, callback Callback) (interface{}, e
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			tx.Commit(ctx)
-		}
-	}()
-	var val interface{}
-	val, err = callback(ctx, tx)
+	val, err := callback(ctx, tx)
 	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
 
@@ -1,14 +1,19 @@
 package endpoints
 
 import (
-	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/dialogs_service/storage"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
 type Auth struct {
@@ -20,11 +25,78 @@ type DialogSendBody struct {
 }
 
 type DialogListBody struct {
-	From string `json:"from"`
-	To   string `json:"to"`
-	Text string `json:"text"`
+	ID        string     `json:"id"`
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Text      string     `json:"text"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+type DialogListResp struct {
+	Messages   []*DialogListBody `json:"messages"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+/* Either the ids of the messages to read, or the id of the last message read */
+type DialogReadBody struct {
+	MessageIDs []string `json:"message_ids"`
+	UpTo       string   `json:"up_to"`
+}
+
+type DialogReceiptBody struct {
+	ID     string    `json:"id"`
+	ReadAt time.Time `json:"read_at"`
+}
+
+type DialogReadResp struct {
+	Receipts []*DialogReceiptBody `json:"receipts"`
+}
+
+type ConversationMessageBody struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ConversationBody struct {
+	DialogID    string                   `json:"dialog_id"`
+	PeerID      string                   `json:"peer_id"`
+	LastMessage *ConversationMessageBody `json:"last_message"`
+	UnreadCount int                      `json:"unread_count"`
+}
+
+type ConversationListResp struct {
+	Conversations []*ConversationBody `json:"conversations"`
+	NextCursor    string              `json:"next_cursor,omitempty"`
+}
+
+type SearchMessageBody struct {
+	ID        string    `json:"id"`
+	DialogID  string    `json:"dialog_id"`
+	PeerID    string    `json:"peer_id"`
+	From      string    `json:"from"`
+	Snippet   string    `json:"snippet"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SearchResp struct {
+	Messages   []*SearchMessageBody `json:"messages"`
+	NextCursor string               `json:"next_cursor,omitempty"`
 }
 
+const (
+	DIALOG_DEFAULT_LIMIT = 50
+	DIALOG_MAX_LIMIT     = 200
+
+	SEARCH_QUERY_MAX_LENGTH = 200
+
+	/* Length of the text column of the messages */
+	MESSAGE_TEXT_MAX_LENGTH = 1000
+)
+
 /*
 	func CheckAuth(r *http.Request) string {
 		reqToken := r.Header.Get("Authorization")
@@ -36,7 +108,7 @@ type DialogListBody struct {
 		reqToken = splitToken[1]
 
 		url := url.URL{}
-		url.Host = config.GetString("server.host")
+		url.Host = config.Get().Server.Host
 		url.Scheme = "http"
 		url.Path = "/api/v2/checkAuth"
 
@@ -66,13 +138,11 @@ type DialogListBody struct {
 	}
 */
 func DialogUserIdSendMessage(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	decoder := json.NewDecoder(r.Body)
 	var dialog DialogSendBody
 	err := decoder.Decode(&dialog)
-	if err != nil {
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+	if err != nil || utf8.RuneCountInString(dialog.Text) > MESSAGE_TEXT_MAX_LENGTH {
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
@@ -80,20 +150,16 @@ func DialogUserIdSendMessage(w http.ResponseWriter, r *http.Request) {
 	to, ok := vars["user_id"]
 	if !ok {
 		log.Println("user_id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
 
-	userID := common.CheckAuth(r)
-	if userID == "" {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
-		return
-	}
+	userID := common.UserIDFromContext(r.Context())
 
-	err = storage.SendMessage(context.Background(), userID, to, dialog.Text)
+	err = storage.SendMessage(r.Context(), userID, to, dialog.Text)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -101,33 +167,294 @@ func DialogUserIdSendMessage(w http.ResponseWriter, r *http.Request) {
 }
 
 func DialogUserIdListGet(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := common.GetRequestID(r)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	vars := mux.Vars(r)
 	to, ok := vars["user_id"]
 
 	if !ok {
 		log.Println("user_id is missing in parameters")
-		common.GenerateError(w, http.StatusBadRequest, requestID, "10m")
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
-	userID := common.CheckAuth(r)
-	if userID == "" {
-		common.GenerateError(w, http.StatusUnauthorized, requestID, "10m")
+	query := r.URL.Query()
+	limit := DIALOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIALOG_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, err := common.DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		log.Println(err)
+		common.RespondError(w, r, http.StatusBadRequest)
 		return
 	}
+	userID := common.UserIDFromContext(r.Context())
 
-	dialog, err := storage.DialogList(context.Background(), userID, to)
+	dialog, err := storage.DialogList(r.Context(), userID, to, cursor, limit)
 	if err != nil {
 		log.Println(err)
-		common.GenerateError(w, http.StatusInternalServerError, requestID, "10m")
+		common.RespondServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 
-	var resp []*DialogListBody
+	resp := &DialogListResp{Messages: []*DialogListBody{}}
 	for _, message := range dialog {
-		resp = append(resp, &DialogListBody{From: message.AuthorID, To: message.RecepientID, Text: message.Text})
+		resp.Messages = append(resp.Messages, &DialogListBody{ID: message.ID, From: message.AuthorID, To: message.RecepientID, Text: message.Text, CreatedAt: message.CreatedAt, ReadAt: message.ReadAt, EditedAt: message.EditedAt})
+	}
+	if len(dialog) == limit {
+		last := dialog[len(dialog)-1]
+		resp.NextCursor = common.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func validReadBody(body *DialogReadBody) bool {
+	if (len(body.MessageIDs) == 0) == (body.UpTo == "") || len(body.MessageIDs) > DIALOG_MAX_LIMIT {
+		return false
+	}
+	for _, id := range body.MessageIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return false
+		}
+	}
+	if body.UpTo != "" {
+		if _, err := uuid.Parse(body.UpTo); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+/* Mark the messages received from user_id as read, only the recipient can read a message */
+func DialogUserIdReadPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body DialogReadBody
+	err := decoder.Decode(&body)
+	if err != nil || !validReadBody(&body) {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	from, ok := vars["user_id"]
+	if !ok {
+		log.Println("user_id is missing in parameters")
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	receipts, err := storage.MarkRead(r.Context(), userID, from, &storage.ReadRequest{MessageIDs: body.MessageIDs, UpTo: body.UpTo})
+	if errors.Is(err, common.ErrNotSupported) {
+		common.RespondError(w, r, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &DialogReadResp{Receipts: []*DialogReceiptBody{}}
+	for _, receipt := range receipts {
+		resp.Receipts = append(resp.Receipts, &DialogReceiptBody{ID: receipt.ID, ReadAt: receipt.ReadAt})
 	}
 	json.NewEncoder(w).Encode(resp)
 }
+
+/* Conversations of the user with the last message, the most recently active first */
+func DialogsGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DIALOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIALOG_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, err := common.DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		log.Println(err)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	userID := common.UserIDFromContext(r.Context())
+
+	conversations, err := storage.ConversationList(r.Context(), userID, cursor, limit)
+	if errors.Is(err, common.ErrNotSupported) {
+		common.RespondError(w, r, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &ConversationListResp{Conversations: []*ConversationBody{}}
+	for _, c := range conversations {
+		resp.Conversations = append(resp.Conversations, &ConversationBody{
+			DialogID:    c.DialogID,
+			PeerID:      c.PeerID,
+			LastMessage: &ConversationMessageBody{ID: c.LastMessageID, From: c.LastAuthorID, Text: c.LastMessage, CreatedAt: c.LastMessageAt},
+			UnreadCount: c.UnreadCount,
+		})
+	}
+	if len(conversations) == limit {
+		last := conversations[len(conversations)-1]
+		resp.NextCursor = common.EncodeCursor(last.LastMessageAt, last.PeerID)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+/* Messages of the user's dialogs matching the q parameter with the matches highlighted, the newest first */
+func DialogsSearchGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" || utf8.RuneCountInString(q) > SEARCH_QUERY_MAX_LENGTH {
+		log.Println("Invalid search query: ", q)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	limit := DIALOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIALOG_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, err := common.DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		log.Println(err)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	userID := common.UserIDFromContext(r.Context())
+
+	found, err := storage.SearchMessages(r.Context(), userID, q, cursor, limit)
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &SearchResp{Messages: []*SearchMessageBody{}}
+	for i := range found {
+		m := &found[i]
+		resp.Messages = append(resp.Messages, &SearchMessageBody{
+			ID:        m.ID,
+			DialogID:  m.DialogID,
+			PeerID:    m.PeerID(userID),
+			From:      m.AuthorID,
+			Snippet:   m.Snippet,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	if len(found) == limit {
+		last := found[len(found)-1]
+		resp.NextCursor = common.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+/* The user_id and id parameters of a message request, false if either is missing or invalid */
+func messageVars(r *http.Request) (string, string, bool) {
+	vars := mux.Vars(r)
+	to, ok := vars["user_id"]
+	if !ok {
+		log.Println("user_id is missing in parameters")
+		return "", "", false
+	}
+	id, ok := vars["id"]
+	if _, err := uuid.Parse(id); !ok || err != nil {
+		log.Println("Invalid message id: ", id)
+		return "", "", false
+	}
+	return to, id, true
+}
+
+func respondMessageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, common.ErrMessageNotFound):
+		common.RespondError(w, r, http.StatusNotFound)
+	case errors.Is(err, common.ErrNotMessageAuthor):
+		common.RespondError(w, r, http.StatusForbidden)
+	case errors.Is(err, common.ErrEditWindowExpired):
+		common.RespondError(w, r, http.StatusConflict)
+	case errors.Is(err, common.ErrNotSupported):
+		common.RespondError(w, r, http.StatusNotImplemented)
+	default:
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+	}
+}
+
+/* Edit the message the user sent to user_id, the previous text is kept in the history */
+func DialogUserIdMessagePut(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body DialogSendBody
+	err := decoder.Decode(&body)
+	if err != nil || body.Text == "" || utf8.RuneCountInString(body.Text) > MESSAGE_TEXT_MAX_LENGTH {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	to, id, ok := messageVars(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	message, err := storage.EditMessage(r.Context(), userID, to, id, body.Text)
+	if err != nil {
+		respondMessageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(&DialogListBody{ID: message.ID, From: message.AuthorID, To: message.RecepientID, Text: message.Text, CreatedAt: message.CreatedAt, ReadAt: message.ReadAt, EditedAt: message.EditedAt})
+}
+
+/* Delete the message of the dialog with user_id, scope=me hides it from the user, scope=everyone removes it */
+func DialogUserIdMessageDelete(w http.ResponseWriter, r *http.Request) {
+	to, id, ok := messageVars(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = storage.DELETE_SCOPE_ME
+	}
+	if scope != storage.DELETE_SCOPE_ME && scope != storage.DELETE_SCOPE_EVERYONE {
+		log.Println("Invalid scope: ", scope)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	err := storage.DeleteMessage(r.Context(), userID, to, id, scope == storage.DELETE_SCOPE_EVERYONE)
+	if err != nil {
+		respondMessageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,70 @@
+package endpoints
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/dialogs_service/storage"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	EXPORT_DEFAULT_LIMIT = 1000
+	EXPORT_MAX_LIMIT     = 10000
+)
+
+// GET /dialogs/unread/export?after_author=&after_recepient=&limit=
+// X-Export-Token - token shared with the counters service
+// unread counts of the dialogs ordered by (author, recepient), past the given pair
+func DialogsUnreadExportGet(w http.ResponseWriter, r *http.Request) {
+	exportToken := config.Get().Dialogs.ExportToken
+	if exportToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(common.EXPORT_TOKEN_HEADER)), []byte(exportToken)) != 1 {
+		common.RespondError(w, r, http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := EXPORT_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > EXPORT_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	afterAuthor, afterRecepient := query.Get("after_author"), query.Get("after_recepient")
+	if afterAuthor != "" || afterRecepient != "" {
+		_, errAuthor := uuid.Parse(afterAuthor)
+		_, errRecepient := uuid.Parse(afterRecepient)
+		if errAuthor != nil || errRecepient != nil {
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+
+	counts, err := storage.ExportUnreadCounts(r.Context(), afterAuthor, afterRecepient, limit)
+	if errors.Is(err, common.ErrNotSupported) {
+		common.RespondError(w, r, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &common.UnreadCountsExport{Counts: []*common.UnreadCountExport{}}
+	for _, count := range counts {
+		resp.Counts = append(resp.Counts, &common.UnreadCountExport{AuthorID: count.AuthorID, RecepientID: count.RecepientID, Unread: count.Unread, Pending: count.Pending})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
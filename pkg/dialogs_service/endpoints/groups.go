@@ -0,0 +1,330 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/dialogs_service/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const GROUP_TITLE_MAX_LENGTH = 200
+
+type GroupCreateBody struct {
+	Title   string   `json:"title"`
+	Members []string `json:"members"`
+}
+
+type GroupMemberBody struct {
+	UserID   string     `json:"user_id"`
+	Role     string     `json:"role"`
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+}
+
+type GroupBody struct {
+	ID        string             `json:"id"`
+	Title     string             `json:"title"`
+	CreatedBy string             `json:"created_by"`
+	CreatedAt time.Time          `json:"created_at"`
+	Members   []*GroupMemberBody `json:"members"`
+}
+
+type GroupMessageBody struct {
+	ID        string     `json:"id"`
+	From      string     `json:"from"`
+	Text      string     `json:"text"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+type GroupMessageListResp struct {
+	Messages   []*GroupMessageBody `json:"messages"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+type UserGroupBody struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Role        string `json:"role"`
+	UnreadCount int    `json:"unread_count"`
+}
+
+type UserGroupListResp struct {
+	Groups     []*UserGroupBody `json:"groups"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+func validUUIDs(ids []string) bool {
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+/* The group_id parameter, false if it is missing or invalid */
+func groupVar(r *http.Request) (string, bool) {
+	groupID, ok := mux.Vars(r)["group_id"]
+	if _, err := uuid.Parse(groupID); !ok || err != nil {
+		log.Println("Invalid group id: ", groupID)
+		return "", false
+	}
+	return groupID, true
+}
+
+func respondGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, common.ErrGroupNotFound):
+		common.RespondError(w, r, http.StatusNotFound)
+	case errors.Is(err, common.ErrNotGroupAdmin):
+		common.RespondError(w, r, http.StatusForbidden)
+	case errors.Is(err, common.ErrLastGroupAdmin), errors.Is(err, common.ErrGroupTooLarge):
+		common.RespondError(w, r, http.StatusConflict)
+	case errors.Is(err, common.ErrNotSupported):
+		common.RespondError(w, r, http.StatusNotImplemented)
+	default:
+		log.Println(err)
+		common.RespondServerError(w, r, err)
+	}
+}
+
+func newGroupBody(g *storage.Group, members []storage.GroupMember) *GroupBody {
+	body := &GroupBody{ID: g.ID, Title: g.Title, CreatedBy: g.CreatedBy, CreatedAt: g.CreatedAt, Members: []*GroupMemberBody{}}
+	for i := range members {
+		body.Members = append(body.Members, &GroupMemberBody{UserID: members[i].UserID, Role: members[i].Role, JoinedAt: &members[i].JoinedAt})
+	}
+	return body
+}
+
+/* Create a group with the user as its admin */
+func GroupCreatePost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body GroupCreateBody
+	err := decoder.Decode(&body)
+	if err != nil || body.Title == "" || utf8.RuneCountInString(body.Title) > GROUP_TITLE_MAX_LENGTH || !validUUIDs(body.Members) {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	group, members, err := storage.CreateGroup(r.Context(), userID, body.Title, body.Members)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newGroupBody(group, members))
+}
+
+func GroupGroupIdGet(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupVar(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	group, members, err := storage.GetGroup(r.Context(), userID, groupID)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newGroupBody(group, members))
+}
+
+/* Add the member or change the member's role, for an admin only */
+func GroupGroupIdMembersPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body GroupMemberBody
+	err := decoder.Decode(&body)
+	if body.Role == "" {
+		body.Role = storage.GROUP_ROLE_MEMBER
+	}
+	if err != nil || !validUUIDs([]string{body.UserID}) || (body.Role != storage.GROUP_ROLE_MEMBER && body.Role != storage.GROUP_ROLE_ADMIN) {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	groupID, ok := groupVar(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	err = storage.SetGroupMember(r.Context(), userID, groupID, body.UserID, body.Role)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+/* Remove the member, an admin removes anyone and a member leaves the group */
+func GroupGroupIdMembersUserIdDelete(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupVar(r)
+	memberID := mux.Vars(r)["user_id"]
+	if !ok || !validUUIDs([]string{memberID}) {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	err := storage.RemoveGroupMember(r.Context(), userID, groupID, memberID)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func GroupGroupIdSendMessage(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body DialogSendBody
+	err := decoder.Decode(&body)
+	if err != nil || utf8.RuneCountInString(body.Text) > MESSAGE_TEXT_MAX_LENGTH {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	groupID, ok := groupVar(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	err = storage.SendGroupMessage(r.Context(), userID, groupID, body.Text)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func GroupGroupIdListGet(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupVar(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit := DIALOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIALOG_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, err := common.DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		log.Println(err)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	userID := common.UserIDFromContext(r.Context())
+
+	messages, err := storage.GroupMessageList(r.Context(), userID, groupID, cursor, limit)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &GroupMessageListResp{Messages: []*GroupMessageBody{}}
+	for _, m := range messages {
+		resp.Messages = append(resp.Messages, &GroupMessageBody{ID: m.ID, From: m.AuthorID, Text: m.Text, CreatedAt: m.CreatedAt, ReadAt: m.ReadAt})
+	}
+	if len(messages) == limit {
+		last := messages[len(messages)-1]
+		resp.NextCursor = common.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+/* Mark the messages of the group as read by the user, see DialogUserIdReadPost */
+func GroupGroupIdReadPost(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body DialogReadBody
+	err := decoder.Decode(&body)
+	if err != nil || !validReadBody(&body) {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	groupID, ok := groupVar(r)
+	if !ok {
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := common.UserIDFromContext(r.Context())
+
+	receipts, err := storage.MarkGroupRead(r.Context(), userID, groupID, &storage.ReadRequest{MessageIDs: body.MessageIDs, UpTo: body.UpTo})
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &DialogReadResp{Receipts: []*DialogReceiptBody{}}
+	for _, receipt := range receipts {
+		resp.Receipts = append(resp.Receipts, &DialogReceiptBody{ID: receipt.ID, ReadAt: receipt.ReadAt})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+/* Groups of the user with the unread counts, ordered by the group id */
+func GroupsGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DIALOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIALOG_MAX_LIMIT {
+			log.Println("Invalid limit: ", query.Get("limit"))
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	after := query.Get("cursor")
+	if after != "" && !validUUIDs([]string{after}) {
+		log.Println("Invalid cursor: ", after)
+		common.RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+	userID := common.UserIDFromContext(r.Context())
+
+	groups, err := storage.UserGroupList(r.Context(), userID, after, limit)
+	if err != nil {
+		respondGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	resp := &UserGroupListResp{Groups: []*UserGroupBody{}}
+	for _, g := range groups {
+		resp.Groups = append(resp.Groups, &UserGroupBody{ID: g.ID, Title: g.Title, Role: g.Role, UnreadCount: g.UnreadCount})
+	}
+	if len(groups) == limit {
+		resp.NextCursor = groups[len(groups)-1].ID
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,163 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/dialogs_service/storage"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+/*
+ * The websocket pushes the dialog events of the user: new messages, edits,
+ * deletions, read receipts and typing notifications. The server pings the client every
+ * ws_ping_period and drops the connection if no pong comes in time. A client
+ * reconnecting with ?last_seen=<message id> gets the messages it missed
+ * first, or a resync event if it has to reload the dialogs instead.
+ */
+
+const (
+	WS_WRITE_TIMEOUT   = 10 * time.Second
+	WS_TYPING_INTERVAL = time.Second
+	WS_MAX_MESSAGE     = 4096
+)
+
+/* Events sent by the client, only typing is supported */
+type ClientEventBody struct {
+	Type string `json:"type"`
+	To   string `json:"to"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+func writeEvent(ws *websocket.Conn, event interface{}) error {
+	ws.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	return ws.WriteJSON(event)
+}
+
+/* Read the client events until the connection fails, which cancels the connection context */
+func readClientEvents(ctx context.Context, cancel context.CancelFunc, ws *websocket.Conn, userID string) {
+	defer cancel()
+	pongTimeout := config.Get().Dialogs.WsPongTimeout
+	ws.SetReadLimit(WS_MAX_MESSAGE)
+	ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	typing := map[string]time.Time{}
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var event ClientEventBody
+		if err := json.Unmarshal(data, &event); err != nil || event.Type != storage.DIALOG_EVENT_TYPING {
+			continue
+		}
+		if _, err := uuid.Parse(event.To); err != nil {
+			continue
+		}
+		// Typing is reported while the user types, once in a while is enough
+		if time.Since(typing[event.To]) < WS_TYPING_INTERVAL {
+			continue
+		}
+		typing[event.To] = time.Now()
+		publishCtx, cancelPublish := context.WithTimeout(ctx, config.Get().Server.RequestTimeout)
+		if err := storage.PublishTyping(publishCtx, userID, event.To); err != nil {
+			log.Printf("Cannot publish typing event: %s", err)
+		}
+		cancelPublish()
+	}
+}
+
+/* Send the messages missed since the last seen one, returns their ids */
+func resumeEvents(ctx context.Context, ws *websocket.Conn, userID, lastSeen string) (map[string]bool, error) {
+	sent := map[string]bool{}
+	events, complete, err := storage.MissedDialogEvents(ctx, userID, lastSeen, config.Get().Dialogs.WsResumeLimit)
+	if err != nil && !errors.Is(err, common.ErrMessageNotFound) && !errors.Is(err, common.ErrNotSupported) {
+		return nil, err
+	}
+	for _, event := range events {
+		if err := writeEvent(ws, event); err != nil {
+			return nil, err
+		}
+		sent[event.ID] = true
+	}
+	if err != nil || !complete {
+		return sent, writeEvent(ws, &storage.DialogEvent{Type: storage.DIALOG_EVENT_RESYNC})
+	}
+	return sent, nil
+}
+
+func DialogsWebsocket(w http.ResponseWriter, r *http.Request) {
+	lastSeen := r.URL.Query().Get("last_seen")
+	if lastSeen != "" {
+		if _, err := uuid.Parse(lastSeen); err != nil {
+			common.RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	userID := common.UserIDFromContext(r.Context())
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// Subscribe before resuming, so no message falls in between
+	events, err := storage.SubscribeDialogEvents(ctx, userID)
+	if err != nil {
+		log.Printf("Cannot subscribe to dialog events: %s", err)
+		return
+	}
+	go readClientEvents(ctx, cancel, ws, userID)
+
+	resumed := map[string]bool{}
+	if lastSeen != "" {
+		resumed, err = resumeEvents(ctx, ws, userID, lastSeen)
+		if err != nil {
+			log.Printf("Cannot resume dialog events: %s", err)
+			return
+		}
+	}
+
+	ping := time.NewTicker(config.Get().Dialogs.WsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			// The client reconnects and resumes if the subscription is lost
+			if !ok {
+				return
+			}
+			if event.Type == storage.DIALOG_EVENT_MESSAGE && resumed[event.ID] {
+				continue
+			}
+			if err := writeEvent(ws, event); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
 	"highload-arch/pkg/dialogs_service/routes"
 	"highload-arch/pkg/dialogs_service/storage"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
 	"log"
 	"os"
 
@@ -25,9 +28,21 @@ func main() {
 	/*f := setLoggerFile("./logs/dialog-service.log")
 	defer f.Close()*/
 	config.Load("local-config.yaml")
+	defer tracing.Init("dialogs")()
 	log.Printf("Connecting to Postgres")
 	storage.CreateConnectionPool()
 
+	if args := config.Args(); len(args) > 0 && args[0] == "reshard" {
+		reshard := storage.Reshard
+		if len(args) > 1 && args[1] == "cleanup" {
+			reshard = storage.CleanupShards
+		}
+		if err := reshard(context.Background()); err != nil {
+			log.Fatalf("Resharding failed: %s", err)
+		}
+		return
+	}
+
 	log.Printf("Connecting to TT")
 	storage.ConnectToTarantool()
 	defer storage.CloseTarantoolConnection()
@@ -36,11 +51,20 @@ func main() {
 	storage.ConnectToRabbitMQ()
 	defer storage.CloseRabbitMQ()
 
+	go storage.RunOutboxRelay(context.Background())
+	go storage.RunSagaWatchdog(context.Background())
+
 	log.Printf("Running Saga Handler")
 	go storage.SagaHandleMessageCountUpdated(context.Background(), storage.MessagedUpdated)
 
+	log.Printf("Loading access token keys")
+	common.LoadKeySet()
+	common.ConnectToSessionCache()
+
+	go metrics.Serve(config.Get().Dialogs.MetricsPort)
+
 	log.Printf("Server started")
 	router := routes.NewRouter()
 
-	log.Fatal(http.ListenAndServe(config.GetString("dialogs.port"), router))
+	log.Fatal(http.ListenAndServe(config.Get().Dialogs.Port, router))
 }
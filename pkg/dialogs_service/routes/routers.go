@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/dialogs_service/endpoints"
+	"highload-arch/pkg/middleware"
 	"net/http"
 	"strings"
 
@@ -15,6 +16,7 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Auth        bool
 }
 
 const PREFIX_V2 = "/api/v2"
@@ -24,9 +26,11 @@ type Routes []Route
 func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
-		var handler http.Handler
-		handler = route.HandlerFunc
-		common.Logger(handler, route.Name)
+		var auth middleware.Authenticator
+		if route.Auth {
+			auth = common.Authenticate
+		}
+		handler := middleware.Wrap(route.HandlerFunc, route.Name, auth)
 
 		router.
 			Methods(route.Method).
@@ -48,6 +52,7 @@ var routes = Routes{
 		"GET",
 		PREFIX_V2,
 		Index,
+		false,
 	},
 
 	Route{
@@ -55,6 +60,7 @@ var routes = Routes{
 		strings.ToUpper("Post"),
 		PREFIX_V2 + "/dialog/{user_id}/send",
 		endpoints.DialogUserIdSendMessage,
+		true,
 	},
 
 	Route{
@@ -62,5 +68,126 @@ var routes = Routes{
 		strings.ToUpper("Get"),
 		PREFIX_V2 + "/dialog/{user_id}/list",
 		endpoints.DialogUserIdListGet,
+		true,
+	},
+
+	Route{
+		"DialogUserIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/dialog/{user_id}/read",
+		endpoints.DialogUserIdReadPost,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessagePut",
+		strings.ToUpper("Put"),
+		PREFIX_V2 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessagePut,
+		true,
+	},
+
+	Route{
+		"DialogUserIdMessageDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V2 + "/dialog/{user_id}/message/{id}",
+		endpoints.DialogUserIdMessageDelete,
+		true,
+	},
+
+	Route{
+		"DialogsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs",
+		endpoints.DialogsGet,
+		true,
+	},
+
+	Route{
+		"DialogsSearchGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs/search",
+		endpoints.DialogsSearchGet,
+		true,
+	},
+
+	Route{
+		"DialogsWebsocket",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs/ws",
+		endpoints.DialogsWebsocket,
+		true,
+	},
+
+	Route{
+		"DialogsUnreadExportGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/dialogs/unread/export",
+		endpoints.DialogsUnreadExportGet,
+		false,
+	},
+
+	Route{
+		"GroupCreatePost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/create",
+		endpoints.GroupCreatePost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/group/{group_id}",
+		endpoints.GroupGroupIdGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/members",
+		endpoints.GroupGroupIdMembersPost,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdMembersUserIdDelete",
+		strings.ToUpper("Delete"),
+		PREFIX_V2 + "/group/{group_id}/members/{user_id}",
+		endpoints.GroupGroupIdMembersUserIdDelete,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdSendMessage",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/send",
+		endpoints.GroupGroupIdSendMessage,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdListGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/group/{group_id}/list",
+		endpoints.GroupGroupIdListGet,
+		true,
+	},
+
+	Route{
+		"GroupGroupIdReadPost",
+		strings.ToUpper("Post"),
+		PREFIX_V2 + "/group/{group_id}/read",
+		endpoints.GroupGroupIdReadPost,
+		true,
+	},
+
+	Route{
+		"GroupsGet",
+		strings.ToUpper("Get"),
+		PREFIX_V2 + "/groups",
+		endpoints.GroupsGet,
+		true,
 	},
 }
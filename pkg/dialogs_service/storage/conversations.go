@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * Every participant of a dialog has a conversation row with the last message
+ * and the number of the messages received and not read yet. The rows are
+ * updated in the transaction of the message, so the inbox never lags behind
+ * the dialog. The rows are kept on the shard of the dialog, so the
+ * conversations of a user are gathered from all the shards.
+ */
+
+const CONVERSATION_PREVIEW_LENGTH = 100
+
+type Conversation struct {
+	DialogID      string    `pg:"dialog_id"`
+	PeerID        string    `pg:"peer_id"`
+	LastMessageID string    `pg:"last_message_id"`
+	LastAuthorID  string    `pg:"last_author_id"`
+	LastMessage   string    `pg:"last_message_text"`
+	LastMessageAt time.Time `pg:"last_message_at"`
+	UnreadCount   int       `pg:"unread_count"`
+}
+
+func messagePreview(text string) string {
+	runes := []rune(text)
+	if len(runes) <= CONVERSATION_PREVIEW_LENGTH {
+		return text
+	}
+	return string(runes[:CONVERSATION_PREVIEW_LENGTH])
+}
+
+/* Set the last message of the user's conversation unless a later one is there already */
+func (req *SendRequest) dbUpdateConversation(ctx context.Context, tx pgx.Tx, id, userID, peerID string, unread int) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO conversations (user_id, peer_id, dialog_id, last_message_id, last_author_id, last_message_text, last_message_at, unread_count) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, peer_id) DO UPDATE SET
+			last_message_id = CASE WHEN (EXCLUDED.last_message_at, EXCLUDED.last_message_id) > (conversations.last_message_at, conversations.last_message_id) THEN EXCLUDED.last_message_id ELSE conversations.last_message_id END,
+			last_author_id = CASE WHEN (EXCLUDED.last_message_at, EXCLUDED.last_message_id) > (conversations.last_message_at, conversations.last_message_id) THEN EXCLUDED.last_author_id ELSE conversations.last_author_id END,
+			last_message_text = CASE WHEN (EXCLUDED.last_message_at, EXCLUDED.last_message_id) > (conversations.last_message_at, conversations.last_message_id) THEN EXCLUDED.last_message_text ELSE conversations.last_message_text END,
+			last_message_at = GREATEST(EXCLUDED.last_message_at, conversations.last_message_at),
+			unread_count = conversations.unread_count + EXCLUDED.unread_count`,
+		userID, peerID, GetDialogId(userID, peerID), id, req.AuthorID, messagePreview(req.Text), req.CreatedAt, unread)
+	return err
+}
+
+/* Update the conversations of both participants with the new message */
+func (req *SendRequest) dbAddConversationMessage(ctx context.Context, tx pgx.Tx, id string) error {
+	if err := req.dbUpdateConversation(ctx, tx, id, req.RecepientID, req.AuthorID, 1); err != nil {
+		return err
+	}
+	if req.AuthorID == req.RecepientID {
+		return nil
+	}
+	return req.dbUpdateConversation(ctx, tx, id, req.AuthorID, req.RecepientID, 0)
+}
+
+/* Change the unread count of the user's conversation by delta, it never goes below zero */
+func dbAddConversationUnread(ctx context.Context, tx pgx.Tx, userID, peerID string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx,
+		`UPDATE conversations SET unread_count = GREATEST(unread_count + $1, 0) WHERE user_id = $2 AND peer_id = $3`,
+		delta, userID, peerID)
+	return err
+}
+
+func dbConversationList(ctx context.Context, shard *Shard, userID string, cursor *common.Cursor, limit int) ([]Conversation, error) {
+	res := []Conversation{}
+	query := `SELECT dialog_id, peer_id, last_message_id, last_author_id, last_message_text, last_message_at, unread_count FROM conversations WHERE user_id = $1`
+	args := []interface{}{userID}
+	if cursor != nil {
+		query += ` AND (last_message_at, peer_id) < ($2, $3)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY last_message_at DESC, peer_id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* Conversations of the user older than the cursor by the last activity, the most recent first */
+func ConversationListDB(ctx context.Context, userID string, cursor *common.Cursor, limit int) ([]Conversation, error) {
+	g := &shardGather[Conversation, *common.Cursor]{
+		page: func(shard *Shard, cursor *common.Cursor, limit int) ([]Conversation, error) {
+			return dbConversationList(ctx, shard, userID, cursor, limit)
+		},
+		next: func(c *Conversation) *common.Cursor {
+			return &common.Cursor{CreatedAt: c.LastMessageAt, ID: c.PeerID}
+		},
+		owner: func(c *Conversation) string { return c.DialogID },
+		less: func(a, b *Conversation) bool {
+			if a.LastMessageAt.Equal(b.LastMessageAt) {
+				return a.PeerID > b.PeerID
+			}
+			return a.LastMessageAt.After(b.LastMessageAt)
+		},
+	}
+	return g.read(cursor, limit)
+}
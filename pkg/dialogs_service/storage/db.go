@@ -4,46 +4,33 @@ import (
 	"context"
 	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/outbox"
+	"highload-arch/pkg/queue"
 	"log"
+	"sync"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
-
-	"github.com/jackc/pgx/v4/pgxpool"
 	tarantool "github.com/tarantool/go-tarantool/v2"
 )
 
 var tt *tarantool.Connection
 
-const MARK_AS_READ_ON_LISTING = true
-const DB_USE_TARANTOOL = false
-
-var db *pgxpool.Pool
-var rbmq *amqp.Connection
+var publisher *queue.Publisher
 
 func ConnectToRabbitMQ() {
-	url := config.GetString("rabbitmq.url")
 	var err error
-	rbmq, err = amqp.Dial(url)
+	publisher, err = queue.NewPublisher(queue.UNREAD_MESSAGES_BINDING)
 	if err != nil {
 		panic(err)
 	}
 }
 
 func CloseRabbitMQ() {
-	rbmq.Close()
-}
-
-func CreateConnectionPool() {
-	var err error
-	db, err = pgxpool.Connect(context.Background(), config.GetString("dialogs.db"))
-	if err != nil {
-		log.Fatal(err)
-	}
+	publisher.Close()
 }
 
 func ConnectToTarantool() {
-	if !DB_USE_TARANTOOL {
+	if !config.Get().Dialogs.UseTarantool {
 		log.Println("Tarantool disabled")
 		return
 	}
@@ -51,9 +38,9 @@ func ConnectToTarantool() {
 		500*time.Millisecond)
 	defer cancel()
 	dialer := tarantool.NetDialer{
-		Address:  config.GetString("tarantool.url"),
-		User:     config.GetString("tarantool.user"),
-		Password: config.GetString("tarantool.pass"),
+		Address:  config.Get().Tarantool.URL,
+		User:     config.Get().Tarantool.User,
+		Password: config.Get().Tarantool.Pass,
 	}
 	opts := tarantool.Opts{
 		Timeout: time.Second,
@@ -72,60 +59,191 @@ func CloseTarantoolConnection() {
 }
 
 func SendMessage(ctx context.Context, userID, to, text string) error {
-	var err error
-	var msg_id string
-	if DB_USE_TARANTOOL {
-		err = SendMessageTT(ctx, userID, to, text)
-	} else {
-		msg_id, err = SendMessageDB(ctx, userID, to, text)
-	}
+	_, err := dialogStore().SendMessage(ctx, userID, to, text)
+	return err
+}
+
+func DialogList(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	store := dialogStore()
+	dialogs, err := store.DialogList(ctx, userID, to, cursor, limit)
 	if err != nil {
-		return err
+		log.Printf("Cannot list dialogs: %s", err)
+		return nil, err
 	}
-	// We surely added message  to the database
-	msgReq := &common.MessageCountRequest{AuthorID: userID, RecepientID: to, MessageID: msg_id, Action: common.INCREMENT_MESSAGE_COUNT_ACTION}
-	err = SagaUpdateMessageCount(ctx, msgReq)
+	if !config.Get().Dialogs.MarkAsReadOnListing {
+		return dialogs, nil
+	}
+	// Only the listed messages received by the user are read
+	req := &ReadRequest{}
+	for _, d := range dialogs {
+		if d.RecepientID == userID && d.State == DIALOG_UNREAD_STATE {
+			req.MessageIDs = append(req.MessageIDs, d.ID)
+		}
+	}
+	if len(req.MessageIDs) == 0 {
+		return dialogs, nil
+	}
+	receipts, err := store.MarkRead(ctx, userID, to, req)
 	if err != nil {
-		log.Printf("Unable to inc unread messages")
+		log.Printf("Cannot mark as read: %s", err)
+		return nil, err
+	}
+	readAt := make(map[string]time.Time, len(receipts))
+	for _, receipt := range receipts {
+		readAt[receipt.ID] = receipt.ReadAt
+	}
+	for i := range dialogs {
+		if at, ok := readAt[dialogs[i].ID]; ok && dialogs[i].State == DIALOG_UNREAD_STATE {
+			dialogs[i].State = DIALOG_PENDING_READ_STATE
+			dialogs[i].ReadAt = &at
+		}
+	}
+	return dialogs, nil
+}
+
+func MarkRead(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error) {
+	return dialogStore().MarkRead(ctx, userID, from, req)
+}
+
+func EditMessage(ctx context.Context, userID, to, id, text string) (*SendRequest, error) {
+	return dialogStore().EditMessage(ctx, userID, to, id, text)
+}
+
+func DeleteMessage(ctx context.Context, userID, to, id string, everyone bool) error {
+	return dialogStore().DeleteMessage(ctx, userID, to, id, everyone)
+}
+
+func SearchMessages(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	return dialogStore().SearchMessages(ctx, userID, query, cursor, limit)
+}
+
+func MessagedUpdated(ctx context.Context, req *common.MessageCountRequest) error {
+	if req.GroupID != "" {
+		return GroupMessageUpdatedDB(ctx, req)
+	}
+	return dialogStore().MessageUpdated(ctx, req)
+}
+
+func ConversationList(ctx context.Context, userID string, cursor *common.Cursor, limit int) ([]Conversation, error) {
+	if config.Get().Dialogs.UseTarantool {
+		return nil, common.ErrNotSupported
+	}
+	return ConversationListDB(ctx, userID, cursor, limit)
+}
+
+/* Groups are kept in Postgres only */
+func groupsSupported() error {
+	if config.Get().Dialogs.UseTarantool {
+		return common.ErrNotSupported
 	}
-	// If we were unable to increment count, we just miss it
 	return nil
 }
 
-func DialogList(ctx context.Context, userID, to string) ([]SendRequest, error) {
-	var err error
-	var dialogs []SendRequest
-	if DB_USE_TARANTOOL {
-		dialogs, err = DialogListTT(ctx, userID, to)
-	}
-	if MARK_AS_READ_ON_LISTING {
-		unread_dialogs, err := DialogListUnreadDB(ctx, userID, to)
-		if err != nil {
-			log.Printf("Cannot list unread dialogs: %s", err)
-			return nil, err
-		}
-		err = DialogMarkAsRead(ctx, unread_dialogs)
-		if err != nil {
-			log.Printf("Cannot mark as read: %s", err)
-			return nil, err
+func CreateGroup(ctx context.Context, userID, title string, members []string) (*Group, []GroupMember, error) {
+	if err := groupsSupported(); err != nil {
+		return nil, nil, err
+	}
+	return CreateGroupDB(ctx, userID, title, members)
+}
+
+func GetGroup(ctx context.Context, userID, groupID string) (*Group, []GroupMember, error) {
+	if err := groupsSupported(); err != nil {
+		return nil, nil, err
+	}
+	return GetGroupDB(ctx, userID, groupID)
+}
+
+func SetGroupMember(ctx context.Context, userID, groupID, memberID, role string) error {
+	if err := groupsSupported(); err != nil {
+		return err
+	}
+	return SetGroupMemberDB(ctx, userID, groupID, memberID, role)
+}
+
+func RemoveGroupMember(ctx context.Context, userID, groupID, memberID string) error {
+	if err := groupsSupported(); err != nil {
+		return err
+	}
+	return RemoveGroupMemberDB(ctx, userID, groupID, memberID)
+}
+
+func UserGroupList(ctx context.Context, userID, after string, limit int) ([]UserGroup, error) {
+	if err := groupsSupported(); err != nil {
+		return nil, err
+	}
+	return UserGroupListDB(ctx, userID, after, limit)
+}
+
+func SendGroupMessage(ctx context.Context, userID, groupID, text string) error {
+	if err := groupsSupported(); err != nil {
+		return err
+	}
+	_, err := SendGroupMessageDB(ctx, userID, groupID, text)
+	return err
+}
+
+func GroupMessageList(ctx context.Context, userID, groupID string, cursor *common.Cursor, limit int) ([]GroupMessage, error) {
+	if err := groupsSupported(); err != nil {
+		return nil, err
+	}
+	messages, err := GroupMessageListDB(ctx, userID, groupID, cursor, limit)
+	if err != nil {
+		log.Printf("Cannot list group messages: %s", err)
+		return nil, err
+	}
+	if !config.Get().Dialogs.MarkAsReadOnListing {
+		return messages, nil
+	}
+	req := &ReadRequest{}
+	for _, m := range messages {
+		if m.State == DIALOG_UNREAD_STATE {
+			req.MessageIDs = append(req.MessageIDs, m.ID)
 		}
 	}
-	dialogs, err = DialogListDB(ctx, userID, to)
+	if len(req.MessageIDs) == 0 {
+		return messages, nil
+	}
+	receipts, err := MarkGroupReadDB(ctx, userID, groupID, req)
 	if err != nil {
-		log.Printf("Cannot list dialogs: %s", err)
+		log.Printf("Cannot mark as read: %s", err)
 		return nil, err
 	}
-	return dialogs, nil
+	readAt := make(map[string]time.Time, len(receipts))
+	for _, receipt := range receipts {
+		readAt[receipt.ID] = receipt.ReadAt
+	}
+	for i := range messages {
+		if at, ok := readAt[messages[i].ID]; ok && messages[i].State == DIALOG_UNREAD_STATE {
+			messages[i].State = DIALOG_PENDING_READ_STATE
+			messages[i].ReadAt = &at
+		}
+	}
+	return messages, nil
 }
 
-func DialogMarkAsRead(ctx context.Context, dialogs []SendRequest) error {
-	var err error
-	for _, d := range dialogs {
-		msgReq := &common.MessageCountRequest{AuthorID: d.AuthorID, RecepientID: d.RecepientID, MessageID: d.ID, Action: common.DECREMENT_MESSAGE_COUNT_ACTION}
-		err = SagaUpdateMessageCount(ctx, msgReq) // decrement mesg count
-		if err != nil {
-			return err
-		}
+func MarkGroupRead(ctx context.Context, userID, groupID string, req *ReadRequest) ([]ReadReceipt, error) {
+	if err := groupsSupported(); err != nil {
+		return nil, err
 	}
-	return nil
+	return MarkGroupReadDB(ctx, userID, groupID, req)
+}
+
+/* Publish the events of the outboxes of the shards, e.g. the counter updates, until the context is done */
+func RunOutboxRelay(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *Shard) {
+			defer wg.Done()
+			outbox.Relay(ctx, shard.DB, publisher)
+		}(shard)
+	}
+	wg.Wait()
+}
+
+func ExportUnreadCounts(ctx context.Context, afterAuthor, afterRecepient string, limit int) ([]UnreadCount, error) {
+	if config.Get().Dialogs.UseTarantool {
+		return nil, common.ErrNotSupported
+	}
+	return ExportUnreadCountsDB(ctx, afterAuthor, afterRecepient, limit)
 }
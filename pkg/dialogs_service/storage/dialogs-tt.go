@@ -2,62 +2,229 @@ package storage
 
 import (
 	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
 	"log"
-	"reflect"
+	"sort"
 	"time"
 
 	tarantool "github.com/tarantool/go-tarantool/v2"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-func SendMessageTT(ctx context.Context, userID, to, text string) error {
-	dialogID := GetDialogId(userID, to)
-	_, err := tt.Do(tarantool.NewCallRequest("send_message").
-		Args([]interface{}{userID, to, dialogID, text}),
-	).Get()
+/*
+ * Tarantool keeps the messages in the dialogs space of tarantool/app.lua with
+ * the same states as Postgres. It has no outbox, so the counter requests and
+ * the dialog events are published once the call returns: a message may miss
+ * its event if the publish fails, and its saga is compensated at once if the
+ * counter request fails. Messages cannot be edited or deleted there, and
+ * the search scans the messages of the user for the words of the query.
+ */
 
+/* Tuple of the dialogs space, the timestamps are in microseconds */
+type ttMessage struct {
+	_msgpack    struct{} `msgpack:",as_array"`
+	ID          string
+	AuthorID    string
+	RecepientID string
+	DialogID    string
+	CreatedAt   uint64
+	Text        string
+	State       string
+	ReadAt      uint64
+}
+
+/* Result of mark_read: the messages read by the call and the receipts */
+type ttReadResult struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Read     []ttMessage
+	Receipts []ttMessage
+}
+
+func (m *ttMessage) toSendRequest() SendRequest {
+	req := SendRequest{
+		ID:          m.ID,
+		AuthorID:    m.AuthorID,
+		RecepientID: m.RecepientID,
+		DialogID:    m.DialogID,
+		CreatedAt:   time.UnixMicro(int64(m.CreatedAt)).UTC(),
+		Text:        m.Text,
+		State:       m.State,
+	}
+	if m.ReadAt > 0 {
+		readAt := time.UnixMicro(int64(m.ReadAt)).UTC()
+		req.ReadAt = &readAt
+	}
+	return req
+}
+
+/* Call the function of tarantool/app.lua and decode its results into result */
+func ttCall(ctx context.Context, function string, args []interface{}, result interface{}) error {
+	ctx, span := tracing.StartClient(ctx, "tarantool "+function, semconv.DBSystemKey.String("tarantool"))
+	err := tt.Do(tarantool.NewCallRequest(function).
+		Args(args).
+		Context(ctx),
+	).GetTyped(result)
+	tracing.End(span, err)
 	if err != nil {
-		log.Println("TT: Error while send_message()")
-		return err
+		log.Printf("TT: Error while %s(): %s", function, err)
+	}
+	return err
+}
+
+/*
+ * Publish the counter request past the request deadline, the message is
+ * stored already. There is no watchdog to re-issue a request that failed,
+ * so the saga is compensated at once: the message is moved back to UNREAD,
+ * as the Postgres watchdog does once the attempts are exhausted.
+ */
+func ttPublishCountRequest(ctx context.Context, req *common.MessageCountRequest) {
+	ctx, cancel := context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+	defer cancel()
+	done := metrics.SagaStep("dialogs_count_request")
+	err := SagaUpdateMessageCount(ctx, req)
+	done(err)
+	if err == nil {
+		return
+	}
+	log.Printf("Unable to update unread messages of %s: %s, compensating", req.MessageID, err)
+	from, _, ok := sagaTransition(req.Action)
+	if !ok {
+		return
+	}
+	metrics.SagaCompensated()
+	var res []bool
+	if err := ttCall(ctx, "compensate", []interface{}{req.MessageID, from}, &res); err != nil {
+		log.Printf("Unable to compensate the saga of %s: %s", req.MessageID, err)
 	}
-	return nil
 }
 
-func DialogListTT(ctx context.Context, userID, to string) ([]SendRequest, error) {
-	dialogID := GetDialogId(userID, to)
+func ttPublishEvent(ctx context.Context, e *DialogEvent) {
+	ctx, cancel := context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+	defer cancel()
+	if err := publishDialogEvent(ctx, e); err != nil {
+		log.Printf("Unable to publish the %s event: %s", e.Type, err)
+	}
+}
 
-	resp, err := tt.Do(tarantool.NewCallRequest("get_dialog").
-		Args([]interface{}{dialogID}),
-	).Get()
+func SendMessageTT(ctx context.Context, userID, to, text string) (string, error) {
+	var res []ttMessage
+	err := ttCall(ctx, "send_message", []interface{}{userID, to, GetDialogId(userID, to), text}, &res)
 	if err != nil {
-		log.Println("TT: Error while get_dialog()")
-		return nil, err
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", common.ErrMessageNotFound
 	}
-	var dialog []SendRequest
-	baseData := resp.Data[0]
-	var baseOut []interface{}
+	req := res[0].toSendRequest()
+
+	ttPublishCountRequest(ctx, &common.MessageCountRequest{AuthorID: userID, RecepientID: to, MessageID: req.ID, Action: common.INCREMENT_MESSAGE_COUNT_ACTION})
+	ttPublishEvent(ctx, messageEvent(&req, req.ID))
+	return req.ID, nil
+}
 
-	rv := reflect.ValueOf(baseData)
-	if rv.Kind() == reflect.Slice {
-		for i := 0; i < rv.Len(); i++ {
-			baseOut = append(baseOut, rv.Index(i).Interface())
+/* Messages of the dialog older than the cursor, newest first, limit <= 0 means no limit */
+func ttGetDialogWithState(ctx context.Context, userID, to string, states []string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	var cursorCreatedAt uint64
+	cursorID := ""
+	if cursor != nil {
+		cursorCreatedAt, cursorID = uint64(cursor.CreatedAt.UnixMicro()), cursor.ID
+	}
+	var res [][]ttMessage
+	err := ttCall(ctx, "get_dialog", []interface{}{GetDialogId(userID, to), states, cursorCreatedAt, cursorID, limit}, &res)
+	if err != nil {
+		return nil, err
+	}
+	dialog := []SendRequest{}
+	if len(res) > 0 {
+		for i := range res[0] {
+			dialog = append(dialog, res[0][i].toSendRequest())
 		}
 	}
+	return dialog, nil
+}
+
+func DialogListTT(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	return ttGetDialogWithState(ctx, userID, to, []string{DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE}, cursor, limit)
+}
+
+/* Mark the messages sent by from to the user as read, see MarkReadDB */
+func MarkReadTT(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	ids := req.MessageIDs
+	if ids == nil {
+		ids = []string{}
+	}
+	var res ttReadResult
+	err := ttCall(ctx, "mark_read", []interface{}{userID, GetDialogId(userID, from), ids, req.UpTo, uint64(now.UnixMicro())}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	readIDs := []string{}
+	for _, m := range res.Read {
+		ttPublishCountRequest(ctx, &common.MessageCountRequest{AuthorID: m.AuthorID, RecepientID: m.RecepientID, MessageID: m.ID, Action: common.DECREMENT_MESSAGE_COUNT_ACTION})
+		readIDs = append(readIDs, m.ID)
+	}
+	if len(readIDs) > 0 {
+		ttPublishEvent(ctx, readEvent(userID, from, readIDs, now))
+	}
 
-	for _, data := range baseOut {
-		var out []interface{}
-		rv := reflect.ValueOf(data)
-		if rv.Kind() == reflect.Slice {
-			for i := 0; i < rv.Len(); i++ {
-				out = append(out, rv.Index(i).Interface())
-			}
+	sort.Slice(res.Receipts, func(i, j int) bool {
+		if res.Receipts[i].CreatedAt == res.Receipts[j].CreatedAt {
+			return res.Receipts[i].ID < res.Receipts[j].ID
+		}
+		return res.Receipts[i].CreatedAt < res.Receipts[j].CreatedAt
+	})
+	receipts := []ReadReceipt{}
+	for i := range res.Receipts {
+		if m := res.Receipts[i].toSendRequest(); m.ReadAt != nil {
+			receipts = append(receipts, ReadReceipt{ID: m.ID, ReadAt: *m.ReadAt})
 		}
-		dialog = append(dialog,
-			SendRequest{AuthorID: out[1].(string),
-				RecepientID: out[2].(string),
-				DialogID:    out[3].(string),
-				CreatedAt:   time.Unix(int64(out[4].(uint32)), 0),
-				Text:        out[5].(string)})
 	}
+	return receipts, nil
+}
 
-	return dialog, nil
+func MessageUpdatedTT(ctx context.Context, req *common.MessageCountRequest) error {
+	from, to, ok := sagaTransition(req.Action)
+	if !ok {
+		log.Printf("Unknown action: %s", req.Action)
+		return nil
+	}
+	// A late or repeated reply finds the message in another state
+	var res []bool
+	return ttCall(ctx, "update_state", []interface{}{req.MessageID, from, to}, &res)
+}
+
+/* Messages of the user containing every word of the query, see SearchMessagesDB */
+func SearchMessagesTT(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	var cursorCreatedAt uint64
+	cursorID := ""
+	if cursor != nil {
+		cursorCreatedAt, cursorID = uint64(cursor.CreatedAt.UnixMicro()), cursor.ID
+	}
+	words := searchWords(query)
+	states := []string{DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE}
+	var res [][]ttMessage
+	err := ttCall(ctx, "search_messages", []interface{}{userID, states, words, cursorCreatedAt, cursorID, limit}, &res)
+	if err != nil {
+		return nil, err
+	}
+	found := []SearchResult{}
+	if len(res) > 0 {
+		for i := range res[0] {
+			m := res[0][i].toSendRequest()
+			found = append(found, SearchResult{
+				ID:          m.ID,
+				AuthorID:    m.AuthorID,
+				RecepientID: m.RecepientID,
+				DialogID:    m.DialogID,
+				CreatedAt:   m.CreatedAt,
+				Snippet:     highlight(m.Text, words),
+			})
+		}
+	}
+	return sortSearchResults(found, limit), nil
 }
@@ -2,12 +2,13 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"highload-arch/pkg/common"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
 )
 
 const DIALOG_PENDING_UNREAD_STATE = "PENDING_UNREAD"
@@ -16,13 +17,32 @@ const DIALOG_PENDING_READ_STATE = "PENDING_READ"
 const DIALOG_READ_STATE = "READ"
 
 type SendRequest struct {
-	ID          string    `pg:"id"`
-	AuthorID    string    `pg:"author_id"`
-	RecepientID string    `pg:"recepient_id"`
-	DialogID    string    `pg:"dialog_id"`
-	CreatedAt   time.Time `pg:"created_at"`
-	Text        string    `pg:"text"`
-	State       string    `pg:"state"`
+	ID          string     `pg:"id"`
+	AuthorID    string     `pg:"author_id"`
+	RecepientID string     `pg:"recepient_id"`
+	DialogID    string     `pg:"dialog_id"`
+	CreatedAt   time.Time  `pg:"created_at"`
+	Text        string     `pg:"text"`
+	State       string     `pg:"state"`
+	ReadAt      *time.Time `pg:"read_at"`
+	EditedAt    *time.Time `pg:"edited_at"`
+}
+
+/* Messages to mark as read: the listed ones, or every one up to and including UpTo */
+type ReadRequest struct {
+	MessageIDs []string
+	UpTo       string
+}
+
+type ReadReceipt struct {
+	ID     string    `pg:"id"`
+	ReadAt time.Time `pg:"read_at"`
+}
+
+type readMessage struct {
+	ID          string `pg:"id"`
+	AuthorID    string `pg:"author_id"`
+	RecepientID string `pg:"recepient_id"`
 }
 
 func GetDialogId(author_id, recepient_id string) string {
@@ -35,22 +55,34 @@ func GetDialogId(author_id, recepient_id string) string {
 	return dialogID
 }
 
-func (req *SendRequest) dbAddDialogMessage(ctx context.Context) (string, error) {
+func (req *SendRequest) dbAddDialogMessage(ctx context.Context, tx pgx.Tx) (string, error) {
 	dialogID := GetDialogId(req.AuthorID, req.RecepientID)
 	var id string
-	err := db.QueryRow(ctx,
-		`INSERT INTO dialogs (author_id, recepient_id, dialog_id, text, created_at, state) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+	err := tx.QueryRow(ctx,
+		`INSERT INTO dialogs (author_id, recepient_id, dialog_id, text, created_at, state, state_updated_at) VALUES ($1, $2, $3, $4, $5, $6, $5) RETURNING id`,
 		req.AuthorID, req.RecepientID, dialogID, req.Text, req.CreatedAt, req.State).Scan(&id)
 
 	return id, err
 }
 
-func dbGetDialogWithState(ctx context.Context, userID, to string, states []string) ([]SendRequest, error) {
+/* Load messages of the dialog older than the cursor, newest first, limit <= 0 means no limit */
+func dbGetDialogWithState(ctx context.Context, userID, to string, states []string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
 	res := []SendRequest{}
 	dialogID := GetDialogId(userID, to)
 
-	rows, err := db.Query(ctx,
-		`SELECT id, author_id, recepient_id, created_at, text FROM dialogs WHERE dialog_id = $1 AND state in ($2)`, dialogID, strings.Join(states, ", "))
+	query := `SELECT id, author_id, recepient_id, dialog_id, created_at, text, state, read_at, edited_at FROM dialogs WHERE dialog_id = $1 AND state = ANY($2) AND ` + visibleTo("$3")
+	args := []interface{}{dialogID, states, userID}
+	if cursor != nil {
+		query += ` AND (created_at, id) < ($4, $5)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(` LIMIT $%d`, len(args)+1)
+		args = append(args, limit)
+	}
+
+	rows, err := shardFor(dialogID).DB.Query(ctx, query, args...)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -63,54 +95,216 @@ func dbGetDialogWithState(ctx context.Context, userID, to string, states []strin
 	return res, err
 }
 
-func dbUpdateMessageState(ctx context.Context, id, from_state, to_state string) error {
-	rows, err := db.Query(ctx,
-		`UPDATE dialogs SET state = $1 WHERE id = $2 and state = $3`, to_state, id, from_state)
-	defer rows.Close()
-	return err
+/* Move the message to the state, false if it was not in the expected one */
+func dbUpdateMessageState(ctx context.Context, tx pgx.Tx, id, from_state, to_state string) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	tag, err := tx.Exec(ctx,
+		`UPDATE dialogs SET state = $1, state_updated_at = $2, saga_attempts = 0 WHERE id = $3 and state = $4`, to_state, now, id, from_state)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
 }
 
-func MessagedUpdated(ctx context.Context, req *common.MessageCountRequest) error {
-	var err error
-	if req.Action == common.INCREMENT_MESSAGE_COUNT_ACTION {
-		err = dbUpdateMessageState(ctx, req.MessageID, DIALOG_PENDING_UNREAD_STATE, DIALOG_UNREAD_STATE)
-	} else if req.Action == common.DECREMENT_MESSAGE_COUNT_ACTION {
-		err = dbUpdateMessageState(ctx, req.MessageID, DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE)
+/* Move the unread messages received by the user to PENDING_READ until the counter is decremented */
+func dbMarkRead(ctx context.Context, tx pgx.Tx, userID, from string, req *ReadRequest, now time.Time) ([]readMessage, error) {
+	res := []readMessage{}
+	query := `UPDATE dialogs SET state = $1, read_at = $2, state_updated_at = $2, saga_attempts = 0 WHERE dialog_id = $3 AND recepient_id = $4 AND state = $5`
+	args := []interface{}{DIALOG_PENDING_READ_STATE, now, GetDialogId(userID, from), userID, DIALOG_UNREAD_STATE}
+	if req.UpTo != "" {
+		query += ` AND (created_at, id) <= (SELECT created_at, id FROM dialogs WHERE dialog_id = $3 AND id = $6)`
+		args = append(args, req.UpTo)
 	} else {
+		query += ` AND id = ANY($6)`
+		args = append(args, req.MessageIDs)
+	}
+	query += ` RETURNING id, author_id, recepient_id`
+	err := pgxscan.Select(ctx, tx, &res, query, args...)
+	return res, err
+}
+
+func dbReadReceipts(ctx context.Context, tx pgx.Tx, userID, from string, ids []string) ([]ReadReceipt, error) {
+	res := []ReadReceipt{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`SELECT id, read_at FROM dialogs WHERE dialog_id = $1 AND recepient_id = $2 AND id = ANY($3) AND read_at IS NOT NULL ORDER BY created_at, id`,
+		GetDialogId(userID, from), userID, ids)
+	return res, err
+}
+
+/*
+ * Mark the messages sent by from to the user as read, the counters are
+ * decremented by the saga. Returns the receipts of the messages read by
+ * the request, and of the listed ones read before.
+ */
+func MarkReadDB(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	dialogID := GetDialogId(userID, from)
+	readIDs := []string{}
+	receipts, err := HandleInTransaction(ctx, shardFor(dialogID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		messages, err := dbMarkRead(ctx, tx, userID, from, req, now)
+		if err != nil {
+			return nil, err
+		}
+		receipts := []ReadReceipt{}
+		for _, m := range messages {
+			err := dbLogSagaTransition(ctx, tx, m.ID, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, SAGA_REASON_READ, 0)
+			if err != nil {
+				return nil, err
+			}
+			msgReq := &common.MessageCountRequest{AuthorID: m.AuthorID, RecepientID: m.RecepientID, MessageID: m.ID, Action: common.DECREMENT_MESSAGE_COUNT_ACTION}
+			if err := outboxUpdateMessageCount(ctx, tx, msgReq); err != nil {
+				return nil, err
+			}
+			receipts = append(receipts, ReadReceipt{ID: m.ID, ReadAt: now})
+			readIDs = append(readIDs, m.ID)
+		}
+		if err := dbAddConversationUnread(ctx, tx, userID, from, -len(messages)); err != nil {
+			return nil, err
+		}
+		if len(readIDs) > 0 {
+			if err := outboxDialogEvent(ctx, tx, readEvent(userID, from, readIDs, now)); err != nil {
+				return nil, err
+			}
+		}
+		if req.UpTo != "" {
+			return receipts, nil
+		}
+		return dbReadReceipts(ctx, tx, userID, from, req.MessageIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	mirrorMessages(ctx, dialogID, readIDs)
+	return receipts.([]ReadReceipt), nil
+}
+
+/* States the message moves between once the counter is updated by the action */
+func sagaTransition(action string) (string, string, bool) {
+	switch action {
+	case common.INCREMENT_MESSAGE_COUNT_ACTION:
+		return DIALOG_PENDING_UNREAD_STATE, DIALOG_UNREAD_STATE, true
+	case common.DECREMENT_MESSAGE_COUNT_ACTION:
+		return DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE, true
+	}
+	return "", "", false
+}
+
+func MessageUpdatedDB(ctx context.Context, req *common.MessageCountRequest) error {
+	from, to, ok := sagaTransition(req.Action)
+	if !ok {
 		log.Printf("Unknown action: %s", req.Action)
+		return nil
 	}
-	return err
+	dialogID := GetDialogId(req.AuthorID, req.RecepientID)
+	updated, err := HandleInTransaction(ctx, shardFor(dialogID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		updated, err := dbUpdateMessageState(ctx, tx, req.MessageID, from, to)
+		// A late or repeated reply finds the message in another state
+		if err != nil || !updated {
+			return false, err
+		}
+		if err := dbLogSagaTransition(ctx, tx, req.MessageID, from, to, SAGA_REASON_COUNTED, 0); err != nil {
+			return false, err
+		}
+		// The message deleted while its counter was incremented is not unread anymore
+		if to == DIALOG_UNREAD_STATE {
+			return true, dbReleaseDeletedUnread(ctx, tx, req)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if updated.(bool) {
+		mirrorMessages(ctx, dialogID, []string{req.MessageID})
+	}
+	return nil
 }
 
 func SendMessageDB(ctx context.Context, userID, to, text string) (string, error) {
-	req := &SendRequest{AuthorID: userID, Text: text, CreatedAt: time.Now(), RecepientID: to, State: DIALOG_PENDING_UNREAD_STATE}
-	msg_id, err := req.dbAddDialogMessage(ctx)
+	// Timestamps are stored without time zone and with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	req := &SendRequest{AuthorID: userID, Text: text, CreatedAt: now, RecepientID: to, State: DIALOG_PENDING_UNREAD_STATE}
+	// The counter update is published by the outbox relay once the message is committed
+	dialogID := GetDialogId(userID, to)
+	msg_id, err := HandleInTransaction(ctx, shardFor(dialogID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		msg_id, err := req.dbAddDialogMessage(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		err = dbLogSagaTransition(ctx, tx, msg_id, "", req.State, SAGA_REASON_CREATED, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.dbAddConversationMessage(ctx, tx, msg_id); err != nil {
+			return nil, err
+		}
+		if err := outboxDialogEvent(ctx, tx, messageEvent(req, msg_id)); err != nil {
+			return nil, err
+		}
+		msgReq := &common.MessageCountRequest{AuthorID: userID, RecepientID: to, MessageID: msg_id, Action: common.INCREMENT_MESSAGE_COUNT_ACTION}
+		return msg_id, outboxUpdateMessageCount(ctx, tx, msgReq)
+	})
 	if err != nil {
 		return "", err
 	}
-	return msg_id, err
+	mirrorMessages(ctx, dialogID, []string{msg_id.(string)})
+	return msg_id.(string), nil
 }
 
-func DialogListDB(ctx context.Context, userID, to string) ([]SendRequest, error) {
-	dialog, err := dbGetDialogWithState(ctx, userID, to, []string{DIALOG_UNREAD_STATE, DIALOG_READ_STATE})
+func DialogListDB(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	dialog, err := dbGetDialogWithState(ctx, userID, to, []string{DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE}, cursor, limit)
 	if err != nil {
 		return nil, err
 	}
 	return dialog, nil
 }
 
-func DialogListUnreadDB(ctx context.Context, userID, to string) ([]SendRequest, error) {
-	dialog, err := dbGetDialogWithState(ctx, userID, to, []string{DIALOG_UNREAD_STATE})
+func DialogListReadDB(ctx context.Context, userID, to string) ([]SendRequest, error) {
+	dialog, err := dbGetDialogWithState(ctx, userID, to, []string{DIALOG_READ_STATE}, nil, 0)
 	if err != nil {
 		return nil, err
 	}
 	return dialog, nil
 }
 
-func DialogListReadDB(ctx context.Context, userID, to string) ([]SendRequest, error) {
-	dialog, err := dbGetDialogWithState(ctx, userID, to, []string{DIALOG_READ_STATE})
-	if err != nil {
-		return nil, err
+/* Unread and pending messages sent by the author to the recipient */
+type UnreadCount struct {
+	AuthorID    string `pg:"author_id"`
+	RecepientID string `pg:"recepient_id"`
+	Unread      int    `pg:"unread"`
+	Pending     int    `pg:"pending"`
+}
+
+/* Unread counts of the shard's dialogs past the cursor pair, ordered by the pair */
+func dbExportUnreadCounts(ctx context.Context, shard *Shard, afterAuthor, afterRecepient string, limit int) ([]UnreadCount, error) {
+	res := []UnreadCount{}
+	query := `SELECT author_id, recepient_id, COUNT(*) FILTER (WHERE state = $1) AS unread, COUNT(*) FILTER (WHERE state IN ($2, $3)) AS pending FROM dialogs`
+	args := []interface{}{DIALOG_UNREAD_STATE, DIALOG_PENDING_UNREAD_STATE, DIALOG_PENDING_READ_STATE}
+	if afterAuthor != "" {
+		query += ` WHERE (author_id, recepient_id) > ($4, $5)`
+		args = append(args, afterAuthor, afterRecepient)
 	}
-	return dialog, nil
+	query += fmt.Sprintf(` GROUP BY author_id, recepient_id ORDER BY author_id, recepient_id LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* Unread counts of the dialogs past the cursor pair, ordered by the pair */
+func ExportUnreadCountsDB(ctx context.Context, afterAuthor, afterRecepient string, limit int) ([]UnreadCount, error) {
+	// The cursor is the last count read
+	g := &shardGather[UnreadCount, UnreadCount]{
+		page: func(shard *Shard, after UnreadCount, limit int) ([]UnreadCount, error) {
+			return dbExportUnreadCounts(ctx, shard, after.AuthorID, after.RecepientID, limit)
+		},
+		next:  func(count *UnreadCount) UnreadCount { return *count },
+		owner: func(count *UnreadCount) string { return GetDialogId(count.AuthorID, count.RecepientID) },
+		less: func(a, b *UnreadCount) bool {
+			if a.AuthorID == b.AuthorID {
+				return a.RecepientID < b.RecepientID
+			}
+			return a.AuthorID < b.AuthorID
+		},
+	}
+	return g.read(UnreadCount{AuthorID: afterAuthor, RecepientID: afterRecepient}, limit)
 }
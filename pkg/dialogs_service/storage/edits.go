@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * The author may edit a message within dialogs.edit_window after sending it,
+ * the replaced texts are kept in message_edits. A message is deleted either
+ * for the user only, it is hidden from their side of the dialog, or by the
+ * author for everyone, its text and edit history are erased then. The rows
+ * stay for the saga: a deleted message the recipient has not read leaves the
+ * unread counter as if it was read, a message still waiting for its counter
+ * increment does so once the counters service replies.
+ */
+
+const (
+	DELETE_SCOPE_ME       = "me"
+	DELETE_SCOPE_EVERYONE = "everyone"
+)
+
+/* Condition on the message columns that it is not deleted for the user, a query parameter or a column */
+func visibleTo(user string) string {
+	return fmt.Sprintf(`deleted_at IS NULL AND NOT (author_id = %[1]s AND deleted_by_author) AND NOT (recepient_id = %[1]s AND deleted_by_recepient)`, user)
+}
+
+func (m *messageRow) deletedFor(userID string) bool {
+	return m.DeletedAt != nil || (m.AuthorID == userID && m.DeletedByAuthor) || (m.RecepientID == userID && m.DeletedByRecepient)
+}
+
+/* Lock the message of the dialog the user has not deleted */
+func dbLockMessage(ctx context.Context, tx pgx.Tx, userID, dialogID, id string) (*messageRow, error) {
+	var m messageRow
+	err := pgxscan.Get(ctx, tx, &m,
+		`SELECT id, author_id, recepient_id, dialog_id, created_at, text, state, state_updated_at, saga_attempts, read_at, edited_at, deleted_at, deleted_by_author, deleted_by_recepient
+		FROM dialogs WHERE dialog_id = $1 AND id = $2 FOR UPDATE`,
+		dialogID, id)
+	if pgxscan.NotFound(err) || (err == nil && m.deletedFor(userID)) {
+		return nil, common.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func dbEditMessage(ctx context.Context, tx pgx.Tx, m *messageRow, text string, now time.Time) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO message_edits (message_id, text, edited_at) VALUES ($1, $2, $3)`, m.ID, m.Text, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE dialogs SET text = $1, edited_at = $2 WHERE dialog_id = $3 AND id = $4`, text, now, m.DialogID, m.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE conversations SET last_message_text = $1 WHERE dialog_id = $2 AND last_message_id = $3`,
+		messagePreview(text), m.DialogID, m.ID)
+	return err
+}
+
+func dbDeleteMessageForEveryone(ctx context.Context, tx pgx.Tx, m *messageRow, now time.Time) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE dialogs SET text = '', deleted_at = $1 WHERE dialog_id = $2 AND id = $3`, now, m.DialogID, m.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM message_edits WHERE message_id = $1`, m.ID)
+	return err
+}
+
+func dbDeleteMessageForUser(ctx context.Context, tx pgx.Tx, m *messageRow, userID string) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE dialogs SET deleted_by_author = deleted_by_author OR $1, deleted_by_recepient = deleted_by_recepient OR $2 WHERE dialog_id = $3 AND id = $4`,
+		m.AuthorID == userID, m.RecepientID == userID, m.DialogID, m.ID)
+	return err
+}
+
+/*
+ * Point the user's conversation at the last message left to them if it
+ * showed the deleted one, the conversation is removed if none is left.
+ */
+func dbRefreshConversation(ctx context.Context, tx pgx.Tx, userID, peerID string, m *messageRow) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE conversations c SET last_message_id = d.id, last_author_id = d.author_id, last_message_text = LEFT(d.text, $5), last_message_at = d.created_at
+		FROM (SELECT id, author_id, text, created_at FROM dialogs WHERE dialog_id = $3 AND `+visibleTo("$1")+` ORDER BY created_at DESC, id DESC LIMIT 1) d
+		WHERE c.user_id = $1 AND c.peer_id = $2 AND c.last_message_id = $4`,
+		userID, peerID, m.DialogID, m.ID, CONVERSATION_PREVIEW_LENGTH)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`DELETE FROM conversations WHERE user_id = $1 AND peer_id = $2 AND last_message_id = $3`, userID, peerID, m.ID)
+	return err
+}
+
+/* Decrement the counter of the unread message the recipient does not see anymore */
+func dbDeleteUnread(ctx context.Context, tx pgx.Tx, id, authorID, recepientID string) error {
+	updated, err := dbUpdateMessageState(ctx, tx, id, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE)
+	if err != nil || !updated {
+		return err
+	}
+	if err := dbLogSagaTransition(ctx, tx, id, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, SAGA_REASON_DELETED, 0); err != nil {
+		return err
+	}
+	if err := dbAddConversationUnread(ctx, tx, recepientID, authorID, -1); err != nil {
+		return err
+	}
+	msgReq := &common.MessageCountRequest{AuthorID: authorID, RecepientID: recepientID, MessageID: id, Action: common.DECREMENT_MESSAGE_COUNT_ACTION}
+	return outboxUpdateMessageCount(ctx, tx, msgReq)
+}
+
+/* Decrement the counter of the message just counted as unread if the recipient deleted it meanwhile */
+func dbReleaseDeletedUnread(ctx context.Context, tx pgx.Tx, req *common.MessageCountRequest) error {
+	var deleted bool
+	err := tx.QueryRow(ctx,
+		`SELECT deleted_at IS NOT NULL OR deleted_by_recepient FROM dialogs WHERE dialog_id = $1 AND id = $2`,
+		GetDialogId(req.AuthorID, req.RecepientID), req.MessageID).Scan(&deleted)
+	if err != nil || !deleted {
+		return err
+	}
+	return dbDeleteUnread(ctx, tx, req.MessageID, req.AuthorID, req.RecepientID)
+}
+
+func editedEvent(m *messageRow, text string, editedAt time.Time) *DialogEvent {
+	return &DialogEvent{
+		Type:     DIALOG_EVENT_EDITED,
+		ID:       m.ID,
+		DialogID: m.DialogID,
+		From:     m.AuthorID,
+		To:       m.RecepientID,
+		Text:     text,
+		EditedAt: &editedAt,
+	}
+}
+
+/* Both participants learn of the deletion for everyone, only the user's devices of the one for them */
+func deletedEvent(m *messageRow, userID, peerID string, everyone bool) *DialogEvent {
+	e := &DialogEvent{Type: DIALOG_EVENT_DELETED, ID: m.ID, DialogID: m.DialogID, From: userID, To: peerID}
+	if !everyone {
+		e.To = userID
+	}
+	return e
+}
+
+/* Replace the text of the message the user sent to the peer, returns the edited message */
+func EditMessageDB(ctx context.Context, userID, to, id, text string) (*SendRequest, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	dialogID := GetDialogId(userID, to)
+	res, err := HandleInTransaction(ctx, shardFor(dialogID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		m, err := dbLockMessage(ctx, tx, userID, dialogID, id)
+		if err != nil {
+			return nil, err
+		}
+		if m.AuthorID != userID {
+			return nil, common.ErrNotMessageAuthor
+		}
+		if now.Sub(m.CreatedAt) > config.Get().Dialogs.EditWindow {
+			return nil, common.ErrEditWindowExpired
+		}
+		if err := dbEditMessage(ctx, tx, m, text, now); err != nil {
+			return nil, err
+		}
+		if err := outboxDialogEvent(ctx, tx, editedEvent(m, text, now)); err != nil {
+			return nil, err
+		}
+		return &SendRequest{
+			ID:          m.ID,
+			AuthorID:    m.AuthorID,
+			RecepientID: m.RecepientID,
+			DialogID:    m.DialogID,
+			CreatedAt:   m.CreatedAt,
+			Text:        text,
+			State:       m.State,
+			ReadAt:      m.ReadAt,
+			EditedAt:    &now,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mirrorMessages(ctx, dialogID, []string{id})
+	return res.(*SendRequest), nil
+}
+
+/* Delete the message of the dialog with the peer for the user, or for everyone if the user sent it */
+func DeleteMessageDB(ctx context.Context, userID, to, id string, everyone bool) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	dialogID := GetDialogId(userID, to)
+	_, err := HandleInTransaction(ctx, shardFor(dialogID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		m, err := dbLockMessage(ctx, tx, userID, dialogID, id)
+		if err != nil {
+			return nil, err
+		}
+		if everyone {
+			if m.AuthorID != userID {
+				return nil, common.ErrNotMessageAuthor
+			}
+			err = dbDeleteMessageForEveryone(ctx, tx, m, now)
+		} else {
+			err = dbDeleteMessageForUser(ctx, tx, m, userID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A pending message is released by its counter reply, see dbReleaseDeletedUnread
+		if (everyone || m.RecepientID == userID) && m.State == DIALOG_UNREAD_STATE {
+			if err := dbDeleteUnread(ctx, tx, m.ID, m.AuthorID, m.RecepientID); err != nil {
+				return nil, err
+			}
+		}
+		if err := dbRefreshConversation(ctx, tx, userID, to, m); err != nil {
+			return nil, err
+		}
+		if everyone && to != userID {
+			if err := dbRefreshConversation(ctx, tx, to, userID, m); err != nil {
+				return nil, err
+			}
+		}
+		return nil, outboxDialogEvent(ctx, tx, deletedEvent(m, userID, to, everyone))
+	})
+	if err != nil {
+		return err
+	}
+	mirrorMessages(ctx, dialogID, []string{id})
+	return nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/outbox"
+	"highload-arch/pkg/queue"
+	"highload-arch/pkg/tracing"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Dialog events are pushed to the websockets of the users through a topic
+ * exchange keyed by the user id, so a user connected to any instance of the
+ * service gets them. Messages and read receipts go through the outbox along
+ * with the rows they describe, typing events are published right away.
+ * The events of a group go to all of its members.
+ */
+
+const DIALOG_EVENTS_EXCHANGE = "dialogEvents"
+
+const (
+	DIALOG_EVENT_MESSAGE = "message"
+	DIALOG_EVENT_READ    = "read"
+	DIALOG_EVENT_TYPING  = "typing"
+	DIALOG_EVENT_RESYNC  = "resync"
+	DIALOG_EVENT_EDITED  = "edited"
+	DIALOG_EVENT_DELETED = "deleted"
+	DIALOG_EVENT_GROUP   = "group"
+)
+
+type DialogEvent struct {
+	Type       string     `json:"type"`
+	ID         string     `json:"id,omitempty"`
+	DialogID   string     `json:"dialog_id,omitempty"`
+	GroupID    string     `json:"group_id,omitempty"`
+	From       string     `json:"from"`
+	To         string     `json:"to,omitempty"`
+	Text       string     `json:"text,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	MessageIDs []string   `json:"message_ids,omitempty"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+	EditedAt   *time.Time `json:"edited_at,omitempty"`
+	Members    []string   `json:"-"`
+}
+
+/* Both participants get the event, the sender may be connected from other devices */
+func (e *DialogEvent) recipients() []string {
+	if e.Members != nil {
+		return e.Members
+	}
+	if e.From == e.To {
+		return []string{e.To}
+	}
+	return []string{e.To, e.From}
+}
+
+func messageEvent(req *SendRequest, id string) *DialogEvent {
+	createdAt := req.CreatedAt
+	return &DialogEvent{
+		Type:      DIALOG_EVENT_MESSAGE,
+		ID:        id,
+		DialogID:  GetDialogId(req.AuthorID, req.RecepientID),
+		From:      req.AuthorID,
+		To:        req.RecepientID,
+		Text:      req.Text,
+		CreatedAt: &createdAt,
+		EditedAt:  req.EditedAt,
+	}
+}
+
+/* The reader notifies the author of the messages */
+func readEvent(userID, from string, ids []string, readAt time.Time) *DialogEvent {
+	return &DialogEvent{
+		Type:       DIALOG_EVENT_READ,
+		DialogID:   GetDialogId(userID, from),
+		From:       userID,
+		To:         from,
+		MessageIDs: ids,
+		ReadAt:     &readAt,
+	}
+}
+
+/* The members reload the group, its members changed */
+func groupEvent(groupID, userID string, members []string) *DialogEvent {
+	return &DialogEvent{Type: DIALOG_EVENT_GROUP, GroupID: groupID, From: userID, Members: members}
+}
+
+func groupMessageEvent(m *GroupMessage, members []string) *DialogEvent {
+	createdAt := m.CreatedAt
+	return &DialogEvent{
+		Type:      DIALOG_EVENT_MESSAGE,
+		ID:        m.ID,
+		GroupID:   m.GroupID,
+		From:      m.AuthorID,
+		Text:      m.Text,
+		CreatedAt: &createdAt,
+		Members:   members,
+	}
+}
+
+func outboxDialogEvent(ctx context.Context, tx pgx.Tx, e *DialogEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, userID := range e.recipients() {
+		if err := outbox.Add(ctx, tx, DIALOG_EVENTS_EXCHANGE, userID, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishDialogEvent(ctx context.Context, e *DialogEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, userID := range e.recipients() {
+		err := publisher.Publish(ctx, DIALOG_EVENTS_EXCHANGE, userID, amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Tell the peer the user is typing, only the peer is notified */
+func PublishTyping(ctx context.Context, userID, to string) error {
+	return publishDialogEvent(ctx, &DialogEvent{Type: DIALOG_EVENT_TYPING, DialogID: GetDialogId(userID, to), From: userID, To: to})
+}
+
+/* Events of the user until the context is done, the channel is closed if the subscription fails */
+func SubscribeDialogEvents(ctx context.Context, userID string) (<-chan *DialogEvent, error) {
+	msgs, err := queue.Subscribe(ctx, DIALOG_EVENTS_EXCHANGE, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan *DialogEvent)
+	go func() {
+		defer close(events)
+		for d := range msgs {
+			metrics.QueueConsumed(DIALOG_EVENTS_EXCHANGE)
+			_, span := tracing.StartConsume(ctx, DIALOG_EVENTS_EXCHANGE, d.Headers)
+			var e DialogEvent
+			err := json.Unmarshal(d.Body, &e)
+			tracing.End(span, err)
+			if err != nil {
+				log.Printf("Cannot unmarshal dialog event: %s", err)
+				continue
+			}
+			select {
+			case events <- &e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+/* Creation time of the message sent or received by the user */
+func dbLastSeenAt(ctx context.Context, userID, lastSeenID string) (time.Time, error) {
+	for _, shard := range owners {
+		var createdAt time.Time
+		var dialogID string
+		err := shard.DB.QueryRow(ctx,
+			`SELECT created_at, dialog_id FROM dialogs WHERE id = $1 AND (author_id = $2 OR recepient_id = $2)`,
+			lastSeenID, userID).Scan(&createdAt, &dialogID)
+		if err == pgx.ErrNoRows || (err == nil && !shard.owns(dialogID)) {
+			continue
+		}
+		return createdAt, err
+	}
+	return time.Time{}, common.ErrMessageNotFound
+}
+
+func dbMessagesSince(ctx context.Context, shard *Shard, userID string, after *common.Cursor, limit int) ([]SendRequest, error) {
+	res := []SendRequest{}
+	err := pgxscan.Select(ctx, shard.DB, &res,
+		`SELECT id, author_id, recepient_id, dialog_id, created_at, text, state, read_at, edited_at FROM dialogs WHERE (author_id = $1 OR recepient_id = $1) AND (created_at, id) > ($2, $3) AND `+visibleTo("$1")+` ORDER BY created_at, id LIMIT $4`,
+		userID, after.CreatedAt, after.ID, limit)
+	return res, err
+}
+
+/* Messages sent or received by the user after the last seen one, the oldest first */
+func messagesSince(ctx context.Context, userID, lastSeenID string, limit int) ([]SendRequest, error) {
+	createdAt, err := dbLastSeenAt(ctx, userID, lastSeenID)
+	if err != nil {
+		return nil, err
+	}
+	g := &shardGather[SendRequest, *common.Cursor]{
+		page: func(shard *Shard, after *common.Cursor, limit int) ([]SendRequest, error) {
+			return dbMessagesSince(ctx, shard, userID, after, limit)
+		},
+		next: func(m *SendRequest) *common.Cursor {
+			return &common.Cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+		},
+		owner: func(m *SendRequest) string { return m.DialogID },
+		less: func(a, b *SendRequest) bool {
+			if a.CreatedAt.Equal(b.CreatedAt) {
+				return a.ID < b.ID
+			}
+			return a.CreatedAt.Before(b.CreatedAt)
+		},
+	}
+	return g.read(&common.Cursor{CreatedAt: createdAt, ID: lastSeenID}, limit)
+}
+
+/*
+ * Message events missed since the last seen message, false if more than
+ * limit messages were missed. The client has to reload the dialogs then,
+ * as well as on ErrMessageNotFound for an unknown message.
+ */
+func MissedDialogEvents(ctx context.Context, userID, lastSeenID string, limit int) ([]*DialogEvent, bool, error) {
+	if config.Get().Dialogs.UseTarantool {
+		return nil, false, common.ErrNotSupported
+	}
+	// One more message tells whether the rest is missing
+	messages, err := messagesSince(ctx, userID, lastSeenID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	complete := len(messages) <= limit
+	if !complete {
+		messages = messages[:limit]
+	}
+	events := make([]*DialogEvent, 0, len(messages))
+	for i := range messages {
+		events = append(events, messageEvent(&messages[i], messages[i].ID))
+	}
+	return events, complete, nil
+}
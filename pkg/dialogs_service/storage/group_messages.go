@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+/* Message of a group with the state of the receipt of the user, empty for the user's own ones */
+type GroupMessage struct {
+	ID        string     `pg:"id"`
+	GroupID   string     `pg:"group_id"`
+	AuthorID  string     `pg:"author_id"`
+	CreatedAt time.Time  `pg:"created_at"`
+	Text      string     `pg:"text"`
+	State     string     `pg:"state"`
+	ReadAt    *time.Time `pg:"read_at"`
+}
+
+type groupReadMessage struct {
+	ID       string `pg:"id"`
+	AuthorID string `pg:"author_id"`
+}
+
+type pendingReceipt struct {
+	MessageID    string `pg:"message_id"`
+	GroupID      string `pg:"group_id"`
+	MemberID     string `pg:"member_id"`
+	AuthorID     string `pg:"author_id"`
+	State        string `pg:"state"`
+	SagaAttempts int    `pg:"saga_attempts"`
+}
+
+func groupCountRequest(id, groupID, authorID, memberID, action string) *common.MessageCountRequest {
+	return &common.MessageCountRequest{AuthorID: authorID, RecepientID: memberID, MessageID: id, Action: action, GroupID: groupID}
+}
+
+func dbLogGroupSagaTransition(ctx context.Context, tx pgx.Tx, id, memberID, from_state, to_state, reason string, attempt int) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	var from interface{}
+	if from_state != "" {
+		from = from_state
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO saga_log (message_id, member_id, from_state, to_state, reason, attempt, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, memberID, from, to_state, reason, attempt, now)
+	return err
+}
+
+func (m *GroupMessage) dbAddGroupMessage(ctx context.Context, tx pgx.Tx) (string, error) {
+	var id string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO group_messages (group_id, author_id, created_at, text) VALUES ($1, $2, $3, $4) RETURNING id`,
+		m.GroupID, m.AuthorID, m.CreatedAt, m.Text).Scan(&id)
+	return id, err
+}
+
+/* Add the receipts of the message for the members but the author, returns the members */
+func (m *GroupMessage) dbAddGroupReceipts(ctx context.Context, tx pgx.Tx) ([]string, error) {
+	res := []string{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`INSERT INTO group_receipts (message_id, group_id, member_id, state, state_updated_at) SELECT $1, group_id, user_id, $2, $3 FROM group_members WHERE group_id = $4 AND user_id <> $5 RETURNING member_id`,
+		m.ID, DIALOG_PENDING_UNREAD_STATE, m.CreatedAt, m.GroupID, m.AuthorID)
+	return res, err
+}
+
+/* Move the receipt to the state, false if it was not in the expected one */
+func dbUpdateReceiptState(ctx context.Context, tx pgx.Tx, id, memberID, from_state, to_state string) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	tag, err := tx.Exec(ctx,
+		`UPDATE group_receipts SET state = $1, state_updated_at = $2, saga_attempts = 0 WHERE message_id = $3 AND member_id = $4 AND state = $5`,
+		to_state, now, id, memberID, from_state)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+/* Load messages of the group older than the cursor, newest first, the ones still counted for the user are skipped */
+func dbGroupMessageList(ctx context.Context, shard *Shard, userID, groupID string, cursor *common.Cursor, limit int) ([]GroupMessage, error) {
+	res := []GroupMessage{}
+	query := `SELECT m.id, m.group_id, m.author_id, m.created_at, m.text, COALESCE(r.state, '') AS state, r.read_at
+		FROM group_messages m LEFT JOIN group_receipts r ON r.message_id = m.id AND r.member_id = $2
+		WHERE m.group_id = $1 AND (r.state IS NULL OR r.state <> $3)`
+	args := []interface{}{groupID, userID, DIALOG_PENDING_UNREAD_STATE}
+	if cursor != nil {
+		query += ` AND (m.created_at, m.id) < ($4, $5)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY m.created_at DESC, m.id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* Move the unread receipts of the member to PENDING_READ until the counter is decremented */
+func dbMarkGroupRead(ctx context.Context, tx pgx.Tx, userID, groupID string, req *ReadRequest, now time.Time) ([]groupReadMessage, error) {
+	res := []groupReadMessage{}
+	query := `UPDATE group_receipts r SET state = $1, read_at = $2, state_updated_at = $2, saga_attempts = 0 FROM group_messages m
+		WHERE m.id = r.message_id AND m.group_id = r.group_id AND r.group_id = $3 AND r.member_id = $4 AND r.state = $5`
+	args := []interface{}{DIALOG_PENDING_READ_STATE, now, groupID, userID, DIALOG_UNREAD_STATE}
+	if req.UpTo != "" {
+		query += ` AND (m.created_at, m.id) <= (SELECT created_at, id FROM group_messages WHERE group_id = $3 AND id = $6)`
+		args = append(args, req.UpTo)
+	} else {
+		query += ` AND r.message_id = ANY($6)`
+		args = append(args, req.MessageIDs)
+	}
+	query += ` RETURNING r.message_id AS id, m.author_id`
+	err := pgxscan.Select(ctx, tx, &res, query, args...)
+	return res, err
+}
+
+func dbGroupReadReceipts(ctx context.Context, tx pgx.Tx, userID, groupID string, ids []string) ([]ReadReceipt, error) {
+	res := []ReadReceipt{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`SELECT message_id AS id, read_at FROM group_receipts WHERE group_id = $1 AND member_id = $2 AND message_id = ANY($3) AND read_at IS NOT NULL ORDER BY read_at, message_id`,
+		groupID, userID, ids)
+	return res, err
+}
+
+func dbMemberUnreadReceipts(ctx context.Context, tx pgx.Tx, groupID, memberID string) ([]groupReadMessage, error) {
+	res := []groupReadMessage{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`SELECT r.message_id AS id, m.author_id FROM group_receipts r JOIN group_messages m ON m.id = r.message_id AND m.group_id = r.group_id
+		WHERE r.group_id = $1 AND r.member_id = $2 AND r.state = $3`,
+		groupID, memberID, DIALOG_UNREAD_STATE)
+	return res, err
+}
+
+/* Decrement the counter of the unread message of the member who left the group */
+func dbReleaseReceipt(ctx context.Context, tx pgx.Tx, id, groupID, authorID, memberID string) error {
+	updated, err := dbUpdateReceiptState(ctx, tx, id, memberID, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE)
+	if err != nil || !updated {
+		return err
+	}
+	if err := dbLogGroupSagaTransition(ctx, tx, id, memberID, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, SAGA_REASON_LEFT, 0); err != nil {
+		return err
+	}
+	return outboxUpdateMessageCount(ctx, tx, groupCountRequest(id, groupID, authorID, memberID, common.DECREMENT_MESSAGE_COUNT_ACTION))
+}
+
+func SendGroupMessageDB(ctx context.Context, userID, groupID, text string) (string, error) {
+	// Timestamps are stored without time zone and with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	m := &GroupMessage{GroupID: groupID, AuthorID: userID, CreatedAt: now, Text: text}
+	id, err := HandleInTransaction(ctx, shardFor(groupID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if err := dbLockGroup(ctx, tx, groupID, false); err != nil {
+			return nil, err
+		}
+		if _, err := dbGetGroupMember(ctx, tx, groupID, userID); err != nil {
+			return nil, err
+		}
+		var err error
+		m.ID, err = m.dbAddGroupMessage(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		members, err := m.dbAddGroupReceipts(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		for _, memberID := range members {
+			err := dbLogGroupSagaTransition(ctx, tx, m.ID, memberID, "", DIALOG_PENDING_UNREAD_STATE, SAGA_REASON_CREATED, 0)
+			if err != nil {
+				return nil, err
+			}
+			msgReq := groupCountRequest(m.ID, groupID, userID, memberID, common.INCREMENT_MESSAGE_COUNT_ACTION)
+			if err := outboxUpdateMessageCount(ctx, tx, msgReq); err != nil {
+				return nil, err
+			}
+		}
+		return m.ID, outboxDialogEvent(ctx, tx, groupMessageEvent(m, append(members, userID)))
+	})
+	if err != nil {
+		return "", err
+	}
+	mirrorGroup(ctx, groupID, []string{m.ID})
+	return id.(string), nil
+}
+
+/* Messages of the group older than the cursor, newest first, for a member only */
+func GroupMessageListDB(ctx context.Context, userID, groupID string, cursor *common.Cursor, limit int) ([]GroupMessage, error) {
+	shard := shardFor(groupID)
+	if _, err := dbGetGroupMember(ctx, shard.DB, groupID, userID); err != nil {
+		return nil, err
+	}
+	return dbGroupMessageList(ctx, shard, userID, groupID, cursor, limit)
+}
+
+/* Mark the messages of the group as read by the member, see MarkReadDB */
+func MarkGroupReadDB(ctx context.Context, userID, groupID string, req *ReadRequest) ([]ReadReceipt, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	readIDs := []string{}
+	receipts, err := HandleInTransaction(ctx, shardFor(groupID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if _, err := dbGetGroupMember(ctx, tx, groupID, userID); err != nil {
+			return nil, err
+		}
+		messages, err := dbMarkGroupRead(ctx, tx, userID, groupID, req, now)
+		if err != nil {
+			return nil, err
+		}
+		receipts := []ReadReceipt{}
+		for _, m := range messages {
+			err := dbLogGroupSagaTransition(ctx, tx, m.ID, userID, DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, SAGA_REASON_READ, 0)
+			if err != nil {
+				return nil, err
+			}
+			msgReq := groupCountRequest(m.ID, groupID, m.AuthorID, userID, common.DECREMENT_MESSAGE_COUNT_ACTION)
+			if err := outboxUpdateMessageCount(ctx, tx, msgReq); err != nil {
+				return nil, err
+			}
+			receipts = append(receipts, ReadReceipt{ID: m.ID, ReadAt: now})
+			readIDs = append(readIDs, m.ID)
+		}
+		if req.UpTo != "" {
+			return receipts, nil
+		}
+		return dbGroupReadReceipts(ctx, tx, userID, groupID, req.MessageIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	mirrorGroup(ctx, groupID, readIDs)
+	return receipts.([]ReadReceipt), nil
+}
+
+func GroupMessageUpdatedDB(ctx context.Context, req *common.MessageCountRequest) error {
+	from, to, ok := sagaTransition(req.Action)
+	if !ok {
+		log.Printf("Unknown action: %s", req.Action)
+		return nil
+	}
+	updated, err := HandleInTransaction(ctx, shardFor(req.GroupID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		updated, err := dbUpdateReceiptState(ctx, tx, req.MessageID, req.RecepientID, from, to)
+		// A late or repeated reply finds the receipt in another state
+		if err != nil || !updated {
+			return false, err
+		}
+		if err := dbLogGroupSagaTransition(ctx, tx, req.MessageID, req.RecepientID, from, to, SAGA_REASON_COUNTED, 0); err != nil {
+			return false, err
+		}
+		if to != DIALOG_UNREAD_STATE {
+			return true, nil
+		}
+		// The member who left while the counter was incremented does not read the message
+		_, err = dbGetGroupMember(ctx, tx, req.GroupID, req.RecepientID)
+		if err == common.ErrGroupNotFound {
+			return true, dbReleaseReceipt(ctx, tx, req.MessageID, req.GroupID, req.AuthorID, req.RecepientID)
+		}
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+	if updated.(bool) {
+		mirrorGroup(ctx, req.GroupID, []string{req.MessageID})
+	}
+	return nil
+}
+
+/* Lock the receipts pending since before the deadline, see dbLockPendingMessages */
+func dbLockPendingReceipts(ctx context.Context, tx pgx.Tx, before time.Time, limit int) ([]pendingReceipt, error) {
+	res := []pendingReceipt{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`SELECT r.message_id, r.group_id, r.member_id, m.author_id, r.state, r.saga_attempts FROM group_receipts r JOIN group_messages m ON m.id = r.message_id AND m.group_id = r.group_id
+		WHERE r.state IN ($1, $2) AND r.state_updated_at < $3 ORDER BY r.state_updated_at LIMIT $4 FOR UPDATE OF r SKIP LOCKED`,
+		DIALOG_PENDING_UNREAD_STATE, DIALOG_PENDING_READ_STATE, before, limit)
+	return res, err
+}
+
+func dbRetryPendingReceipt(ctx context.Context, tx pgx.Tx, r *pendingReceipt) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`UPDATE group_receipts SET saga_attempts = saga_attempts + 1, state_updated_at = $1 WHERE message_id = $2 AND member_id = $3`,
+		now, r.MessageID, r.MemberID)
+	return err
+}
+
+func dbCompensatePendingReceipt(ctx context.Context, tx pgx.Tx, r *pendingReceipt) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`UPDATE group_receipts SET state = $1, state_updated_at = $2, saga_attempts = 0, read_at = NULL WHERE message_id = $3 AND member_id = $4 AND state = $5`,
+		DIALOG_UNREAD_STATE, now, r.MessageID, r.MemberID, r.State)
+	return err
+}
+
+/* See superviseMessage */
+func superviseReceipt(ctx context.Context, tx pgx.Tx, r *pendingReceipt) error {
+	if r.SagaAttempts >= config.Get().Dialogs.SagaMaxAttempts {
+		log.Printf("Saga of group message %s for %s timed out in %s, compensating", r.MessageID, r.MemberID, r.State)
+		metrics.SagaCompensated()
+		if err := dbCompensatePendingReceipt(ctx, tx, r); err != nil {
+			return err
+		}
+		return dbLogGroupSagaTransition(ctx, tx, r.MessageID, r.MemberID, r.State, DIALOG_UNREAD_STATE, SAGA_REASON_COMPENSATED, r.SagaAttempts)
+	}
+
+	attempt := r.SagaAttempts + 1
+	log.Printf("Saga of group message %s for %s timed out in %s, re-issuing the counter request, attempt %d", r.MessageID, r.MemberID, r.State, attempt)
+	metrics.SagaRetried()
+	if err := dbRetryPendingReceipt(ctx, tx, r); err != nil {
+		return err
+	}
+	if err := dbLogGroupSagaTransition(ctx, tx, r.MessageID, r.MemberID, r.State, r.State, SAGA_REASON_RETRIED, attempt); err != nil {
+		return err
+	}
+	return outboxUpdateMessageCount(ctx, tx, groupCountRequest(r.MessageID, r.GroupID, r.AuthorID, r.MemberID, sagaAction(r.State)))
+}
+
+/* Handle a batch of the stuck receipts of the shard, returns their number */
+func superviseGroupSagas(ctx context.Context, shard *Shard) (int, error) {
+	before := time.Now().UTC().Add(-config.Get().Dialogs.SagaTimeout)
+	supervised := []pendingReceipt{}
+	_, err := HandleInTransaction(ctx, shard, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		receipts, err := dbLockPendingReceipts(ctx, tx, before, SAGA_WATCHDOG_BATCH_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		for i := range receipts {
+			if !shard.owns(receipts[i].GroupID) {
+				continue
+			}
+			if err := superviseReceipt(ctx, tx, &receipts[i]); err != nil {
+				return nil, err
+			}
+			supervised = append(supervised, receipts[i])
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range supervised {
+		mirrorGroup(ctx, r.GroupID, []string{r.MessageID})
+	}
+	return len(supervised), nil
+}
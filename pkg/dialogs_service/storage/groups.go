@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * A group chat lives on the shard of its id along with its members, messages
+ * and receipts. Every member but the author gets a receipt of a group message
+ * going through the same states and counter saga as a dialog message, the
+ * counters service keeps the unread counts of the members by group. The
+ * membership changes lock the group row and the messages share the lock, so
+ * a message is received by the members of the moment it is sent.
+ */
+
+const (
+	GROUP_ROLE_ADMIN  = "admin"
+	GROUP_ROLE_MEMBER = "member"
+)
+
+type Group struct {
+	ID        string    `pg:"id"`
+	Title     string    `pg:"title"`
+	CreatedBy string    `pg:"created_by"`
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+type GroupMember struct {
+	GroupID  string    `pg:"group_id"`
+	UserID   string    `pg:"user_id"`
+	Role     string    `pg:"role"`
+	JoinedAt time.Time `pg:"joined_at"`
+}
+
+/* Group of the user with the user's role and the number of the unread messages */
+type UserGroup struct {
+	ID          string `pg:"id"`
+	Title       string `pg:"title"`
+	Role        string `pg:"role"`
+	UnreadCount int    `pg:"unread_count"`
+}
+
+func dbInsertGroup(ctx context.Context, tx pgx.Tx, g *Group) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO groups (id, title, created_by, created_at) VALUES ($1, $2, $3, $4)`,
+		g.ID, g.Title, g.CreatedBy, g.CreatedAt)
+	return err
+}
+
+func dbGetGroup(ctx context.Context, q pgxscan.Querier, groupID string) (*Group, error) {
+	var g Group
+	err := pgxscan.Get(ctx, q, &g, `SELECT id, title, created_by, created_at FROM groups WHERE id = $1`, groupID)
+	if pgxscan.NotFound(err) {
+		return nil, common.ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+/* Lock the group, exclusively to change the members */
+func dbLockGroup(ctx context.Context, tx pgx.Tx, groupID string, exclusive bool) error {
+	lock := "SHARE"
+	if exclusive {
+		lock = "UPDATE"
+	}
+	var id string
+	err := tx.QueryRow(ctx, `SELECT id FROM groups WHERE id = $1 FOR `+lock, groupID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return common.ErrGroupNotFound
+	}
+	return err
+}
+
+/* The group is not found for the users who are not its members */
+func dbGetGroupMember(ctx context.Context, q pgxscan.Querier, groupID, userID string) (*GroupMember, error) {
+	var m GroupMember
+	err := pgxscan.Get(ctx, q, &m,
+		`SELECT group_id, user_id, role, joined_at FROM group_members WHERE group_id = $1 AND user_id = $2`,
+		groupID, userID)
+	if pgxscan.NotFound(err) {
+		return nil, common.ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func dbGroupMembers(ctx context.Context, q pgxscan.Querier, groupID string) ([]GroupMember, error) {
+	res := []GroupMember{}
+	err := pgxscan.Select(ctx, q, &res,
+		`SELECT group_id, user_id, role, joined_at FROM group_members WHERE group_id = $1 ORDER BY joined_at, user_id`,
+		groupID)
+	return res, err
+}
+
+func dbSetGroupMember(ctx context.Context, tx pgx.Tx, m *GroupMember) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO group_members (group_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4) ON CONFLICT (group_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		m.GroupID, m.UserID, m.Role, m.JoinedAt)
+	return err
+}
+
+func dbRemoveGroupMember(ctx context.Context, tx pgx.Tx, groupID, userID string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM group_members WHERE group_id = $1 AND user_id = $2`, groupID, userID)
+	return err
+}
+
+func memberIDs(members []GroupMember) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.UserID)
+	}
+	return ids
+}
+
+func adminCount(members []GroupMember) int {
+	count := 0
+	for _, m := range members {
+		if m.Role == GROUP_ROLE_ADMIN {
+			count++
+		}
+	}
+	return count
+}
+
+/* Create the group with the user as its admin and the members, returns the group and its members */
+func CreateGroupDB(ctx context.Context, userID, title string, members []string) (*Group, []GroupMember, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	// The id picks the shard, so it is generated before the insert
+	g := &Group{ID: uuid.NewString(), Title: title, CreatedBy: userID, CreatedAt: now}
+	added := []GroupMember{{GroupID: g.ID, UserID: userID, Role: GROUP_ROLE_ADMIN, JoinedAt: now}}
+	seen := map[string]bool{userID: true}
+	for _, id := range members {
+		if !seen[id] {
+			seen[id] = true
+			added = append(added, GroupMember{GroupID: g.ID, UserID: id, Role: GROUP_ROLE_MEMBER, JoinedAt: now})
+		}
+	}
+	if len(added) > config.Get().Dialogs.GroupMaxMembers {
+		return nil, nil, common.ErrGroupTooLarge
+	}
+	_, err := HandleInTransaction(ctx, shardFor(g.ID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if err := dbInsertGroup(ctx, tx, g); err != nil {
+			return nil, err
+		}
+		for i := range added {
+			if err := dbSetGroupMember(ctx, tx, &added[i]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, outboxDialogEvent(ctx, tx, groupEvent(g.ID, userID, memberIDs(added)))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	mirrorGroup(ctx, g.ID, nil)
+	return g, added, nil
+}
+
+/* The group and its members, for a member only */
+func GetGroupDB(ctx context.Context, userID, groupID string) (*Group, []GroupMember, error) {
+	shard := shardFor(groupID)
+	members, err := dbGroupMembers(ctx, shard.DB, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range members {
+		if m.UserID != userID {
+			continue
+		}
+		g, err := dbGetGroup(ctx, shard.DB, groupID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return g, members, nil
+	}
+	return nil, nil, common.ErrGroupNotFound
+}
+
+/* Add the member to the group or change the member's role, for an admin only */
+func SetGroupMemberDB(ctx context.Context, userID, groupID, memberID, role string) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := HandleInTransaction(ctx, shardFor(groupID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if err := dbLockGroup(ctx, tx, groupID, true); err != nil {
+			return nil, err
+		}
+		members, err := dbGroupMembers(ctx, tx, groupID)
+		if err != nil {
+			return nil, err
+		}
+		var actor, target *GroupMember
+		for i := range members {
+			if members[i].UserID == userID {
+				actor = &members[i]
+			}
+			if members[i].UserID == memberID {
+				target = &members[i]
+			}
+		}
+		if actor == nil {
+			return nil, common.ErrGroupNotFound
+		}
+		if actor.Role != GROUP_ROLE_ADMIN {
+			return nil, common.ErrNotGroupAdmin
+		}
+		if target == nil {
+			if len(members) >= config.Get().Dialogs.GroupMaxMembers {
+				return nil, common.ErrGroupTooLarge
+			}
+			members = append(members, GroupMember{GroupID: groupID, UserID: memberID, JoinedAt: now})
+			target = &members[len(members)-1]
+		} else if target.Role == GROUP_ROLE_ADMIN && role != GROUP_ROLE_ADMIN && adminCount(members) == 1 {
+			return nil, common.ErrLastGroupAdmin
+		}
+		target.Role = role
+		if err := dbSetGroupMember(ctx, tx, target); err != nil {
+			return nil, err
+		}
+		return nil, outboxDialogEvent(ctx, tx, groupEvent(groupID, userID, memberIDs(members)))
+	})
+	if err != nil {
+		return err
+	}
+	mirrorGroup(ctx, groupID, nil)
+	return nil
+}
+
+/*
+ * Remove the member from the group, an admin removes anyone and a member
+ * leaves. The messages the member has not read are decremented from the
+ * member's counter, the pending ones once the counters service replies.
+ */
+func RemoveGroupMemberDB(ctx context.Context, userID, groupID, memberID string) error {
+	released := []string{}
+	_, err := HandleInTransaction(ctx, shardFor(groupID), func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if err := dbLockGroup(ctx, tx, groupID, true); err != nil {
+			return nil, err
+		}
+		members, err := dbGroupMembers(ctx, tx, groupID)
+		if err != nil {
+			return nil, err
+		}
+		var actor, target *GroupMember
+		for i := range members {
+			if members[i].UserID == userID {
+				actor = &members[i]
+			}
+			if members[i].UserID == memberID {
+				target = &members[i]
+			}
+		}
+		if actor == nil || target == nil {
+			return nil, common.ErrGroupNotFound
+		}
+		if userID != memberID && actor.Role != GROUP_ROLE_ADMIN {
+			return nil, common.ErrNotGroupAdmin
+		}
+		// The last member may leave, the group is left without members then
+		if target.Role == GROUP_ROLE_ADMIN && adminCount(members) == 1 && len(members) > 1 {
+			return nil, common.ErrLastGroupAdmin
+		}
+		if err := dbRemoveGroupMember(ctx, tx, groupID, memberID); err != nil {
+			return nil, err
+		}
+		unread, err := dbMemberUnreadReceipts(ctx, tx, groupID, memberID)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range unread {
+			if err := dbReleaseReceipt(ctx, tx, r.ID, groupID, r.AuthorID, memberID); err != nil {
+				return nil, err
+			}
+			released = append(released, r.ID)
+		}
+		return nil, outboxDialogEvent(ctx, tx, groupEvent(groupID, userID, memberIDs(members)))
+	})
+	if err != nil {
+		return err
+	}
+	mirrorGroup(ctx, groupID, released)
+	return nil
+}
+
+/* Groups of the user on the shard past the group id, ordered by the id */
+func dbUserGroups(ctx context.Context, shard *Shard, userID, after string, limit int) ([]UserGroup, error) {
+	res := []UserGroup{}
+	query := `SELECT g.id, g.title, gm.role,
+		(SELECT COUNT(*) FROM group_receipts r WHERE r.group_id = g.id AND r.member_id = $1 AND r.state IN ($2, $3)) AS unread_count
+		FROM group_members gm JOIN groups g ON g.id = gm.group_id WHERE gm.user_id = $1`
+	args := []interface{}{userID, DIALOG_PENDING_UNREAD_STATE, DIALOG_UNREAD_STATE}
+	if after != "" {
+		query += ` AND gm.group_id > $4`
+		args = append(args, after)
+	}
+	query += fmt.Sprintf(` ORDER BY gm.group_id LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* Groups of the user past the group id, ordered by the id */
+func UserGroupListDB(ctx context.Context, userID, after string, limit int) ([]UserGroup, error) {
+	g := &shardGather[UserGroup, string]{
+		page: func(shard *Shard, after string, limit int) ([]UserGroup, error) {
+			return dbUserGroups(ctx, shard, userID, after, limit)
+		},
+		next:  func(group *UserGroup) string { return group.ID },
+		owner: func(group *UserGroup) string { return group.ID },
+		less:  func(a, b *UserGroup) bool { return a.ID < b.ID },
+	}
+	return g.read(after, limit)
+}
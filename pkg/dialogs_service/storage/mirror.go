@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * Messages are copied to the new shard with all their columns and edits. A
+ * copy never overwrites a later state, edit or deletion of the message, so
+ * the mirrored writes and the reshard passes may run in any order. The
+ * conversations of the dialog are rebuilt from its messages on the new shard
+ * rather than copied. A group is copied with its members and the receipts of
+ * its messages the same way.
+ */
+
+type messageRow struct {
+	ID                 string     `pg:"id"`
+	AuthorID           string     `pg:"author_id"`
+	RecepientID        string     `pg:"recepient_id"`
+	DialogID           string     `pg:"dialog_id"`
+	CreatedAt          time.Time  `pg:"created_at"`
+	Text               string     `pg:"text"`
+	State              string     `pg:"state"`
+	StateUpdatedAt     time.Time  `pg:"state_updated_at"`
+	SagaAttempts       int        `pg:"saga_attempts"`
+	ReadAt             *time.Time `pg:"read_at"`
+	EditedAt           *time.Time `pg:"edited_at"`
+	DeletedAt          *time.Time `pg:"deleted_at"`
+	DeletedByAuthor    bool       `pg:"deleted_by_author"`
+	DeletedByRecepient bool       `pg:"deleted_by_recepient"`
+}
+
+type sagaLogRow struct {
+	MessageID string    `pg:"message_id"`
+	MemberID  *string   `pg:"member_id"`
+	FromState *string   `pg:"from_state"`
+	ToState   string    `pg:"to_state"`
+	Reason    string    `pg:"reason"`
+	Attempt   int       `pg:"attempt"`
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+type groupMessageRow struct {
+	ID        string    `pg:"id"`
+	GroupID   string    `pg:"group_id"`
+	AuthorID  string    `pg:"author_id"`
+	CreatedAt time.Time `pg:"created_at"`
+	Text      string    `pg:"text"`
+}
+
+type groupReceiptRow struct {
+	MessageID      string     `pg:"message_id"`
+	GroupID        string     `pg:"group_id"`
+	MemberID       string     `pg:"member_id"`
+	State          string     `pg:"state"`
+	StateUpdatedAt time.Time  `pg:"state_updated_at"`
+	SagaAttempts   int        `pg:"saga_attempts"`
+	ReadAt         *time.Time `pg:"read_at"`
+}
+
+type messageEditRow struct {
+	MessageID string    `pg:"message_id"`
+	Text      string    `pg:"text"`
+	EditedAt  time.Time `pg:"edited_at"`
+}
+
+/* Messages of the dialog with the ids, all of them if ids is nil */
+func dbSelectMessageRows(ctx context.Context, shard *Shard, dialogID string, ids []string) ([]messageRow, error) {
+	res := []messageRow{}
+	query := `SELECT id, author_id, recepient_id, dialog_id, created_at, text, state, state_updated_at, saga_attempts, read_at, edited_at, deleted_at, deleted_by_author, deleted_by_recepient FROM dialogs WHERE dialog_id = $1`
+	args := []interface{}{dialogID}
+	if ids != nil {
+		query += ` AND id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+func dbSelectSagaLogRows(ctx context.Context, shard *Shard, dialogID string, ids []string) ([]sagaLogRow, error) {
+	res := []sagaLogRow{}
+	query := `SELECT message_id, member_id, from_state, to_state, reason, attempt, created_at FROM saga_log WHERE message_id IN (SELECT id FROM dialogs WHERE dialog_id = $1)`
+	args := []interface{}{dialogID}
+	if ids != nil {
+		query += ` AND message_id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+func dbSelectMessageEditRows(ctx context.Context, shard *Shard, dialogID string, ids []string) ([]messageEditRow, error) {
+	res := []messageEditRow{}
+	query := `SELECT message_id, text, edited_at FROM message_edits WHERE message_id IN (SELECT id FROM dialogs WHERE dialog_id = $1)`
+	args := []interface{}{dialogID}
+	if ids != nil {
+		query += ` AND message_id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* The state, the text and the deletion of the message are merged separately, the later one of each wins */
+func dbUpsertMessageRow(ctx context.Context, tx pgx.Tx, m *messageRow) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO dialogs (id, author_id, recepient_id, dialog_id, created_at, text, state, state_updated_at, saga_attempts, read_at, edited_at, deleted_at, deleted_by_author, deleted_by_recepient)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (id, dialog_id) DO UPDATE SET
+			state = CASE WHEN dialogs.state_updated_at <= EXCLUDED.state_updated_at THEN EXCLUDED.state ELSE dialogs.state END,
+			saga_attempts = CASE WHEN dialogs.state_updated_at <= EXCLUDED.state_updated_at THEN EXCLUDED.saga_attempts ELSE dialogs.saga_attempts END,
+			read_at = CASE WHEN dialogs.state_updated_at <= EXCLUDED.state_updated_at THEN EXCLUDED.read_at ELSE dialogs.read_at END,
+			state_updated_at = GREATEST(dialogs.state_updated_at, EXCLUDED.state_updated_at),
+			text = CASE WHEN COALESCE(dialogs.deleted_at, EXCLUDED.deleted_at) IS NOT NULL THEN ''
+				WHEN COALESCE(dialogs.edited_at, dialogs.created_at) <= COALESCE(EXCLUDED.edited_at, EXCLUDED.created_at) THEN EXCLUDED.text ELSE dialogs.text END,
+			edited_at = GREATEST(dialogs.edited_at, EXCLUDED.edited_at),
+			deleted_at = COALESCE(dialogs.deleted_at, EXCLUDED.deleted_at),
+			deleted_by_author = dialogs.deleted_by_author OR EXCLUDED.deleted_by_author,
+			deleted_by_recepient = dialogs.deleted_by_recepient OR EXCLUDED.deleted_by_recepient`,
+		m.ID, m.AuthorID, m.RecepientID, m.DialogID, m.CreatedAt, m.Text, m.State, m.StateUpdatedAt, m.SagaAttempts, m.ReadAt,
+		m.EditedAt, m.DeletedAt, m.DeletedByAuthor, m.DeletedByRecepient)
+	return err
+}
+
+func dbInsertMessageEditRow(ctx context.Context, tx pgx.Tx, e *messageEditRow) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO message_edits (message_id, text, edited_at) VALUES ($1, $2, $3) ON CONFLICT (message_id, edited_at) DO NOTHING`,
+		e.MessageID, e.Text, e.EditedAt)
+	return err
+}
+
+/* The history of the messages deleted for everyone is erased, a copy may bring it back */
+func dbEraseDeletedEdits(ctx context.Context, tx pgx.Tx, dialogID string) error {
+	_, err := tx.Exec(ctx,
+		`DELETE FROM message_edits WHERE message_id IN (SELECT id FROM dialogs WHERE dialog_id = $1 AND deleted_at IS NOT NULL)`,
+		dialogID)
+	return err
+}
+
+/* The saga log has no key of its own, a transition is copied unless the same one is there */
+func dbInsertSagaLogRow(ctx context.Context, tx pgx.Tx, l *sagaLogRow) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO saga_log (message_id, from_state, to_state, reason, attempt, created_at, member_id) SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE NOT EXISTS (SELECT 1 FROM saga_log WHERE message_id = $1 AND to_state = $3 AND reason = $4 AND attempt = $5 AND created_at = $6 AND member_id IS NOT DISTINCT FROM $7)`,
+		l.MessageID, l.FromState, l.ToState, l.Reason, l.Attempt, l.CreatedAt, l.MemberID)
+	return err
+}
+
+/* Recount the conversations of the dialog from its messages */
+func dbRebuildConversations(ctx context.Context, tx pgx.Tx, dialogID string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM conversations WHERE dialog_id = $1`, dialogID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO conversations (user_id, peer_id, dialog_id, last_message_id, last_author_id, last_message_text, last_message_at, unread_count)
+		SELECT DISTINCT ON (p.user_id, p.peer_id) p.user_id, p.peer_id, d.dialog_id, d.id, d.author_id, LEFT(d.text, $2), d.created_at,
+			(SELECT COUNT(*) FROM dialogs u WHERE u.dialog_id = d.dialog_id AND u.recepient_id = p.user_id AND u.state IN ($3, $4))
+		FROM dialogs d CROSS JOIN LATERAL (VALUES (d.author_id, d.recepient_id), (d.recepient_id, d.author_id)) AS p(user_id, peer_id)
+		WHERE d.dialog_id = $1 AND `+visibleTo("p.user_id")+`
+		ORDER BY p.user_id, p.peer_id, d.created_at DESC, d.id DESC`,
+		dialogID, CONVERSATION_PREVIEW_LENGTH, DIALOG_PENDING_UNREAD_STATE, DIALOG_UNREAD_STATE)
+	return err
+}
+
+/* Copy the messages of the dialog with the ids, all of them if ids is nil, and their saga log */
+func copyMessages(ctx context.Context, from, to *Shard, dialogID string, ids []string) error {
+	messages, err := dbSelectMessageRows(ctx, from, dialogID, ids)
+	if err != nil {
+		return err
+	}
+	logs, err := dbSelectSagaLogRows(ctx, from, dialogID, ids)
+	if err != nil {
+		return err
+	}
+	edits, err := dbSelectMessageEditRows(ctx, from, dialogID, ids)
+	if err != nil {
+		return err
+	}
+	_, err = HandleInTransaction(ctx, to, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		for i := range messages {
+			if err := dbUpsertMessageRow(ctx, tx, &messages[i]); err != nil {
+				return nil, err
+			}
+		}
+		for i := range logs {
+			if err := dbInsertSagaLogRow(ctx, tx, &logs[i]); err != nil {
+				return nil, err
+			}
+		}
+		for i := range edits {
+			if err := dbInsertMessageEditRow(ctx, tx, &edits[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := dbEraseDeletedEdits(ctx, tx, dialogID); err != nil {
+			return nil, err
+		}
+		return nil, dbRebuildConversations(ctx, tx, dialogID)
+	})
+	return err
+}
+
+/* Mirror the committed messages to the new shard if their dialog moves there */
+func mirrorMessages(ctx context.Context, dialogID string, ids []string) {
+	to := mirrorShardFor(dialogID)
+	if to == nil || len(ids) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+	defer cancel()
+	// The next reshard pass copies the messages missed here
+	if err := copyMessages(ctx, shardFor(dialogID), to, dialogID, ids); err != nil {
+		log.Printf("Cannot mirror messages of dialog %s to shard %s: %s", dialogID, to.Name, err)
+		metrics.MirrorFailed("dialog")
+	}
+}
+
+func dbSelectGroupMessageRows(ctx context.Context, shard *Shard, groupID string, ids []string) ([]groupMessageRow, error) {
+	res := []groupMessageRow{}
+	query := `SELECT id, group_id, author_id, created_at, text FROM group_messages WHERE group_id = $1`
+	args := []interface{}{groupID}
+	if ids != nil {
+		query += ` AND id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+func dbSelectGroupReceiptRows(ctx context.Context, shard *Shard, groupID string, ids []string) ([]groupReceiptRow, error) {
+	res := []groupReceiptRow{}
+	query := `SELECT message_id, group_id, member_id, state, state_updated_at, saga_attempts, read_at FROM group_receipts WHERE group_id = $1`
+	args := []interface{}{groupID}
+	if ids != nil {
+		query += ` AND message_id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+func dbSelectGroupSagaLogRows(ctx context.Context, shard *Shard, groupID string, ids []string) ([]sagaLogRow, error) {
+	res := []sagaLogRow{}
+	query := `SELECT message_id, member_id, from_state, to_state, reason, attempt, created_at FROM saga_log WHERE message_id IN (SELECT id FROM group_messages WHERE group_id = $1)`
+	args := []interface{}{groupID}
+	if ids != nil {
+		query += ` AND message_id = ANY($2)`
+		args = append(args, ids)
+	}
+	err := pgxscan.Select(ctx, shard.DB, &res, query, args...)
+	return res, err
+}
+
+/* The members are replaced, a member removed from the group is removed from the copy */
+func dbReplaceGroup(ctx context.Context, tx pgx.Tx, g *Group, members []GroupMember) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO groups (id, title, created_by, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title`,
+		g.ID, g.Title, g.CreatedBy, g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM group_members WHERE group_id = $1`, g.ID); err != nil {
+		return err
+	}
+	for i := range members {
+		if err := dbSetGroupMember(ctx, tx, &members[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dbInsertGroupMessageRow(ctx context.Context, tx pgx.Tx, m *groupMessageRow) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO group_messages (id, group_id, author_id, created_at, text) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id, group_id) DO NOTHING`,
+		m.ID, m.GroupID, m.AuthorID, m.CreatedAt, m.Text)
+	return err
+}
+
+func dbUpsertGroupReceiptRow(ctx context.Context, tx pgx.Tx, r *groupReceiptRow) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO group_receipts (message_id, group_id, member_id, state, state_updated_at, saga_attempts, read_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (message_id, member_id) DO UPDATE SET state = EXCLUDED.state, state_updated_at = EXCLUDED.state_updated_at, saga_attempts = EXCLUDED.saga_attempts, read_at = EXCLUDED.read_at
+		WHERE group_receipts.state_updated_at <= EXCLUDED.state_updated_at`,
+		r.MessageID, r.GroupID, r.MemberID, r.State, r.StateUpdatedAt, r.SagaAttempts, r.ReadAt)
+	return err
+}
+
+/* Copy the group with its members, the messages with the ids, all of them if ids is nil, and their receipts */
+func copyGroup(ctx context.Context, from, to *Shard, groupID string, ids []string) error {
+	g, err := dbGetGroup(ctx, from.DB, groupID)
+	if err != nil {
+		return err
+	}
+	members, err := dbGroupMembers(ctx, from.DB, groupID)
+	if err != nil {
+		return err
+	}
+	return copyGroupMessages(ctx, from, to, groupID, ids, g, members)
+}
+
+/* Copy the messages of the group with the ids and their receipts, along with the group itself unless it is nil */
+func copyGroupMessages(ctx context.Context, from, to *Shard, groupID string, ids []string, g *Group, members []GroupMember) error {
+	messages, err := dbSelectGroupMessageRows(ctx, from, groupID, ids)
+	if err != nil {
+		return err
+	}
+	receipts, err := dbSelectGroupReceiptRows(ctx, from, groupID, ids)
+	if err != nil {
+		return err
+	}
+	logs, err := dbSelectGroupSagaLogRows(ctx, from, groupID, ids)
+	if err != nil {
+		return err
+	}
+	_, err = HandleInTransaction(ctx, to, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		if g != nil {
+			if err := dbReplaceGroup(ctx, tx, g, members); err != nil {
+				return nil, err
+			}
+		}
+		for i := range messages {
+			if err := dbInsertGroupMessageRow(ctx, tx, &messages[i]); err != nil {
+				return nil, err
+			}
+		}
+		for i := range receipts {
+			if err := dbUpsertGroupReceiptRow(ctx, tx, &receipts[i]); err != nil {
+				return nil, err
+			}
+		}
+		for i := range logs {
+			if err := dbInsertSagaLogRow(ctx, tx, &logs[i]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+/* Mirror the committed group with the messages to the new shard if it moves there, see mirrorMessages */
+func mirrorGroup(ctx context.Context, groupID string, ids []string) {
+	to := mirrorShardFor(groupID)
+	if to == nil {
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	ctx, cancel := context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+	defer cancel()
+	if err := copyGroup(ctx, shardFor(groupID), to, groupID, ids); err != nil {
+		log.Printf("Cannot mirror group %s to shard %s: %s", groupID, to.Name, err)
+		metrics.MirrorFailed("group")
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"log"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Adding a shard:
+ *   1. add it to dialogs.shards, set dialogs.new_shard to it and restart the
+ *      instances, the writes of the moving dialogs are mirrored to it;
+ *   2. run reshard to copy the moving dialogs, again if a mirror write failed;
+ *   3. clear dialogs.new_shard and restart the instances to cut over;
+ *   4. run reshard cleanup to remove the moved dialogs from the old shards.
+ * The groups move along with the dialogs.
+ */
+
+const RESHARD_BATCH_SIZE = 100
+
+/* Dialog ids of the shard past the last one, ordered */
+func dbDialogIDs(ctx context.Context, shard *Shard, after string, limit int) ([]string, error) {
+	res := []string{}
+	err := pgxscan.Select(ctx, shard.DB, &res,
+		`SELECT DISTINCT dialog_id FROM dialogs WHERE dialog_id > $1 ORDER BY dialog_id LIMIT $2`,
+		after, limit)
+	return res, err
+}
+
+/* Group ids of the shard past the last one, ordered */
+func dbGroupIDs(ctx context.Context, shard *Shard, after string, limit int) ([]string, error) {
+	res := []string{}
+	err := pgxscan.Select(ctx, shard.DB, &res,
+		`SELECT id FROM groups WHERE id > $1 ORDER BY id LIMIT $2`,
+		after, limit)
+	return res, err
+}
+
+type listIDs func(ctx context.Context, shard *Shard, after string, limit int) ([]string, error)
+
+/* Call handle for every id listed past after, page by page */
+func forEach(ctx context.Context, shard *Shard, list listIDs, after string, handle func(id string) error) error {
+	for {
+		ids, err := list(ctx, shard, after, RESHARD_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := handle(id); err != nil {
+				return err
+			}
+		}
+		if len(ids) < RESHARD_BATCH_SIZE {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+/* Call handle for every dialog of the shard */
+func forEachDialog(ctx context.Context, shard *Shard, handle func(dialogID string) error) error {
+	return forEach(ctx, shard, dbDialogIDs, "", handle)
+}
+
+/* Call handle for every group of the shard, the nil id is before all the others */
+func forEachGroup(ctx context.Context, shard *Shard, handle func(groupID string) error) error {
+	return forEach(ctx, shard, dbGroupIDs, uuid.Nil.String(), handle)
+}
+
+/* Copy the dialogs and the groups moving to the new shard, safe to run again */
+func Reshard(ctx context.Context) error {
+	if config.Get().Dialogs.NewShard == "" {
+		return errors.Errorf("dialogs.new_shard is not set, nothing to reshard")
+	}
+	for _, shard := range owners {
+		copied := 0
+		err := forEachDialog(ctx, shard, func(dialogID string) error {
+			to := mirrorShardFor(dialogID)
+			if to == nil || !shard.owns(dialogID) {
+				return nil
+			}
+			copied++
+			return copyMessages(ctx, shard, to, dialogID, nil)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Copied %d dialogs of shard %s to %s", copied, shard.Name, config.Get().Dialogs.NewShard)
+		copied = 0
+		err = forEachGroup(ctx, shard, func(groupID string) error {
+			to := mirrorShardFor(groupID)
+			if to == nil || !shard.owns(groupID) {
+				return nil
+			}
+			copied++
+			return copyGroup(ctx, shard, to, groupID, nil)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Copied %d groups of shard %s to %s", copied, shard.Name, config.Get().Dialogs.NewShard)
+	}
+	return nil
+}
+
+func dbMessageIDs(ctx context.Context, shard *Shard, dialogID string) ([]string, error) {
+	res := []string{}
+	err := pgxscan.Select(ctx, shard.DB, &res, `SELECT id FROM dialogs WHERE dialog_id = $1`, dialogID)
+	return res, err
+}
+
+/* The ids not in have */
+func missingIDs(ids, have []string) []string {
+	known := make(map[string]bool, len(have))
+	for _, id := range have {
+		known[id] = true
+	}
+	missing := []string{}
+	for _, id := range ids {
+		if !known[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+/* Ids of the messages of the shard the owner has not got, a mirror write failed for them */
+func dbMissingMessageIDs(ctx context.Context, shard, owner *Shard, dialogID string) ([]string, error) {
+	ids, err := dbMessageIDs(ctx, shard, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	ownerIDs, err := dbMessageIDs(ctx, owner, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	return missingIDs(ids, ownerIDs), nil
+}
+
+func dbDeleteDialog(ctx context.Context, tx pgx.Tx, dialogID string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM saga_log WHERE message_id IN (SELECT id FROM dialogs WHERE dialog_id = $1)`, dialogID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM message_edits WHERE message_id IN (SELECT id FROM dialogs WHERE dialog_id = $1)`, dialogID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM conversations WHERE dialog_id = $1`, dialogID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM dialogs WHERE dialog_id = $1`, dialogID)
+	return err
+}
+
+func dbGroupMessageIDs(ctx context.Context, shard *Shard, groupID string) ([]string, error) {
+	res := []string{}
+	err := pgxscan.Select(ctx, shard.DB, &res, `SELECT id FROM group_messages WHERE group_id = $1`, groupID)
+	return res, err
+}
+
+/* Copy the group to the owner if it has not got it, otherwise the messages it has not got, returns the number copied */
+func copyMissingGroupMessages(ctx context.Context, shard, owner *Shard, groupID string) (int, error) {
+	ids, err := dbGroupMessageIDs(ctx, shard, groupID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = dbGetGroup(ctx, owner.DB, groupID)
+	if errors.Is(err, common.ErrGroupNotFound) {
+		return len(ids), copyGroup(ctx, shard, owner, groupID, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	ownerIDs, err := dbGroupMessageIDs(ctx, owner, groupID)
+	if err != nil {
+		return 0, err
+	}
+	missing := missingIDs(ids, ownerIDs)
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	// The owner's group and members are newer than the copy here
+	return len(missing), copyGroupMessages(ctx, shard, owner, groupID, missing, nil, nil)
+}
+
+func dbDeleteGroup(ctx context.Context, tx pgx.Tx, groupID string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM saga_log WHERE message_id IN (SELECT id FROM group_messages WHERE group_id = $1)`, groupID)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM group_receipts WHERE group_id = $1`,
+		`DELETE FROM group_messages WHERE group_id = $1`,
+		`DELETE FROM group_members WHERE group_id = $1`,
+		`DELETE FROM groups WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(ctx, query, groupID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Remove the groups owned by another shard, the messages it has not got are copied to it first */
+func cleanupGroups(ctx context.Context, shard *Shard) error {
+	removed, copied := 0, 0
+	err := forEachGroup(ctx, shard, func(groupID string) error {
+		if shard.owns(groupID) {
+			return nil
+		}
+		owner := shardFor(groupID)
+		count, err := copyMissingGroupMessages(ctx, shard, owner, groupID)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("Copied %d messages of group %s missing on the owner %s", count, groupID, owner.Name)
+			copied += count
+		}
+		removed++
+		_, err = HandleInTransaction(ctx, shard, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+			return nil, dbDeleteGroup(ctx, tx, groupID)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d moved groups from shard %s, copied %d missed messages", removed, shard.Name, copied)
+	return nil
+}
+
+/*
+ * Remove the dialogs owned by another shard. The mirror writes are best
+ * effort, so the messages the owner has not got are copied to it first.
+ */
+func CleanupShards(ctx context.Context) error {
+	if config.Get().Dialogs.NewShard != "" {
+		return errors.Errorf("dialogs.new_shard is set, cut over to %s first", config.Get().Dialogs.NewShard)
+	}
+	for _, shard := range owners {
+		removed, copied := 0, 0
+		err := forEachDialog(ctx, shard, func(dialogID string) error {
+			if shard.owns(dialogID) {
+				return nil
+			}
+			owner := shardFor(dialogID)
+			missing, err := dbMissingMessageIDs(ctx, shard, owner, dialogID)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				log.Printf("Copying %d messages of dialog %s missing on the owner %s", len(missing), dialogID, owner.Name)
+				if err := copyMessages(ctx, shard, owner, dialogID, missing); err != nil {
+					return err
+				}
+				copied += len(missing)
+			}
+			removed++
+			_, err = HandleInTransaction(ctx, shard, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+				return nil, dbDeleteDialog(ctx, tx, dialogID)
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Removed %d moved dialogs from shard %s, copied %d missed messages", removed, shard.Name, copied)
+		if err := cleanupGroups(ctx, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
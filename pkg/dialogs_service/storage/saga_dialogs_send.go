@@ -4,34 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"highload-arch/pkg/common"
+	"highload-arch/pkg/outbox"
 	"log"
 
+	"github.com/jackc/pgx/v4"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func SagaUpdateMessageCount(ctx context.Context, req *common.MessageCountRequest) error {
 	log.Printf("Dialog service: sending message to RabbitMQ on new dialog message with '%s' state", req.Action)
-	channel, err := rbmq.Channel()
-	if err != nil {
-		log.Println("RBMQ: Channel creation failed")
-		return err
-	}
-	defer channel.Close()
-
-	err = channel.ExchangeDeclare(
-		"unreadMessages", // name
-		"topic",          // type
-		false,            // durable
-		false,            // auto-deleted
-		false,            // internal
-		false,            // no-wait
-		nil,              // arguments
-	)
-
-	if err != nil {
-		log.Println("Cannot create exchange")
-		return err
-	}
 	reqBytes, err := json.Marshal(*req)
 	if err != nil {
 		log.Println("Cannot marshal post request to bytes array")
@@ -41,15 +22,21 @@ func SagaUpdateMessageCount(ctx context.Context, req *common.MessageCountRequest
 	// rounting key: userID.to, we need to increment the counter of messages
 	// sent from userID to user 'to'
 	// The body also contains the id of the message to return it in the response and update state in dialogs's db
-	err = channel.PublishWithContext(ctx,
+	return publisher.Publish(ctx,
 		"unreadMessages",                 // exchange
 		req.AuthorID+"."+req.RecepientID, // routing key
-		false,                            // mandatory
-		false,                            // immediate
 		amqp.Publishing{
 			ContentType: "text/plain",
 			Body:        reqBytes,
 		})
+}
 
-	return nil
+/* Add the counter update to the outbox, it is published once the transaction commits */
+func outboxUpdateMessageCount(ctx context.Context, tx pgx.Tx, req *common.MessageCountRequest) error {
+	reqBytes, err := json.Marshal(*req)
+	if err != nil {
+		log.Printf("Cannot marshal message count request of %s: %s", req.MessageID, err)
+		return err
+	}
+	return outbox.Add(ctx, tx, "unreadMessages", req.AuthorID+"."+req.RecepientID, reqBytes)
 }
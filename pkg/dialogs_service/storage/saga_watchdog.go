@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+/*
+ * A message stays pending until the counters service replies. The watchdog
+ * re-issues the counter request of a message pending longer than the saga
+ * timeout, and once the attempts are exhausted compensates the saga by
+ * moving the message back to UNREAD: it is shown to the users and marked as
+ * read again later, the counter is fixed by the next successful update.
+ * The receipts of the group messages are supervised the same way. Every
+ * transition is recorded in the saga log.
+ */
+
+const (
+	SAGA_REASON_CREATED     = "created"
+	SAGA_REASON_COUNTED     = "counted"
+	SAGA_REASON_READ        = "read"
+	SAGA_REASON_RETRIED     = "retried"
+	SAGA_REASON_COMPENSATED = "compensated"
+	SAGA_REASON_DELETED     = "deleted"
+	SAGA_REASON_LEFT        = "left"
+)
+
+const SAGA_WATCHDOG_BATCH_SIZE = 100
+
+type pendingMessage struct {
+	ID           string `pg:"id"`
+	AuthorID     string `pg:"author_id"`
+	RecepientID  string `pg:"recepient_id"`
+	DialogID     string `pg:"dialog_id"`
+	State        string `pg:"state"`
+	SagaAttempts int    `pg:"saga_attempts"`
+}
+
+func dbLogSagaTransition(ctx context.Context, tx pgx.Tx, id, from_state, to_state, reason string, attempt int) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	var from interface{}
+	if from_state != "" {
+		from = from_state
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO saga_log (message_id, from_state, to_state, reason, attempt, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		id, from, to_state, reason, attempt, now)
+	return err
+}
+
+/* Lock the messages pending since before the deadline, the other instances skip them */
+func dbLockPendingMessages(ctx context.Context, tx pgx.Tx, before time.Time, limit int) ([]pendingMessage, error) {
+	res := []pendingMessage{}
+	err := pgxscan.Select(ctx, tx, &res,
+		`SELECT id, author_id, recepient_id, dialog_id, state, saga_attempts FROM dialogs WHERE state IN ($1, $2) AND state_updated_at < $3 ORDER BY state_updated_at LIMIT $4 FOR UPDATE SKIP LOCKED`,
+		DIALOG_PENDING_UNREAD_STATE, DIALOG_PENDING_READ_STATE, before, limit)
+	return res, err
+}
+
+func dbRetryPendingMessage(ctx context.Context, tx pgx.Tx, id string) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`UPDATE dialogs SET saga_attempts = saga_attempts + 1, state_updated_at = $1 WHERE id = $2`, now, id)
+	return err
+}
+
+/* Revert the message to UNREAD, it is not read anymore if it was */
+func dbCompensatePendingMessage(ctx context.Context, tx pgx.Tx, id, from_state string) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`UPDATE dialogs SET state = $1, state_updated_at = $2, saga_attempts = 0, read_at = NULL WHERE id = $3 AND state = $4`,
+		DIALOG_UNREAD_STATE, now, id, from_state)
+	return err
+}
+
+func sagaAction(state string) string {
+	if state == DIALOG_PENDING_READ_STATE {
+		return common.DECREMENT_MESSAGE_COUNT_ACTION
+	}
+	return common.INCREMENT_MESSAGE_COUNT_ACTION
+}
+
+func superviseMessage(ctx context.Context, tx pgx.Tx, m *pendingMessage) error {
+	if m.SagaAttempts >= config.Get().Dialogs.SagaMaxAttempts {
+		log.Printf("Saga of message %s timed out in %s, compensating", m.ID, m.State)
+		metrics.SagaCompensated()
+		if err := dbCompensatePendingMessage(ctx, tx, m.ID, m.State); err != nil {
+			return err
+		}
+		// The message counts as unread in the conversation again
+		if m.State == DIALOG_PENDING_READ_STATE {
+			if err := dbAddConversationUnread(ctx, tx, m.RecepientID, m.AuthorID, 1); err != nil {
+				return err
+			}
+		}
+		return dbLogSagaTransition(ctx, tx, m.ID, m.State, DIALOG_UNREAD_STATE, SAGA_REASON_COMPENSATED, m.SagaAttempts)
+	}
+
+	attempt := m.SagaAttempts + 1
+	log.Printf("Saga of message %s timed out in %s, re-issuing the counter request, attempt %d", m.ID, m.State, attempt)
+	metrics.SagaRetried()
+	if err := dbRetryPendingMessage(ctx, tx, m.ID); err != nil {
+		return err
+	}
+	if err := dbLogSagaTransition(ctx, tx, m.ID, m.State, m.State, SAGA_REASON_RETRIED, attempt); err != nil {
+		return err
+	}
+	// The counters service skips the request if it was handled already, but replies again
+	msgReq := &common.MessageCountRequest{AuthorID: m.AuthorID, RecepientID: m.RecepientID, MessageID: m.ID, Action: sagaAction(m.State)}
+	return outboxUpdateMessageCount(ctx, tx, msgReq)
+}
+
+/* Handle a batch of the stuck messages of the shard, returns their number */
+func superviseSagas(ctx context.Context, shard *Shard) (int, error) {
+	before := time.Now().UTC().Add(-config.Get().Dialogs.SagaTimeout)
+	supervised := []pendingMessage{}
+	_, err := HandleInTransaction(ctx, shard, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		messages, err := dbLockPendingMessages(ctx, tx, before, SAGA_WATCHDOG_BATCH_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			// The messages moved to another shard are left to it
+			if !shard.owns(messages[i].DialogID) {
+				continue
+			}
+			if err := superviseMessage(ctx, tx, &messages[i]); err != nil {
+				return nil, err
+			}
+			supervised = append(supervised, messages[i])
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range supervised {
+		mirrorMessages(ctx, m.DialogID, []string{m.ID})
+	}
+	return len(supervised), nil
+}
+
+/* Look for the stuck messages until the context is done */
+func RunSagaWatchdog(ctx context.Context) {
+	if config.Get().Dialogs.UseTarantool {
+		log.Println("Saga watchdog disabled for Tarantool")
+		return
+	}
+	log.Println("Running saga watchdog")
+	for {
+		full := false
+		for _, shard := range owners {
+			count, err := superviseSagas(ctx, shard)
+			if err != nil {
+				log.Printf("Saga watchdog failed on shard %s: %s", shard.Name, err)
+			}
+			// A full batch means there are more stuck messages
+			full = full || (err == nil && count == SAGA_WATCHDOG_BATCH_SIZE)
+			count, err = superviseGroupSagas(ctx, shard)
+			if err != nil {
+				log.Printf("Saga watchdog of groups failed on shard %s: %s", shard.Name, err)
+			}
+			full = full || (err == nil && count == SAGA_WATCHDOG_BATCH_SIZE)
+		}
+		if full {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.Get().Dialogs.SagaCheckPeriod):
+		}
+	}
+}
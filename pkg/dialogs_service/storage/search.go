@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"html"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+/*
+ * Messages are searched among the ones the user sent or received and still
+ * sees, the newest first. Postgres matches the words with the GIN index on
+ * the text and highlights them with ts_headline, Tarantool has no full-text
+ * search, so the messages of the user are scanned for every word instead.
+ * The snippets are HTML, the text of the messages is escaped in them.
+ */
+
+const (
+	/* Text search configuration of dialogs_text_search_idx, the language neutral one */
+	SEARCH_TS_CONFIG = "simple"
+
+	SEARCH_HIGHLIGHT_START = "<b>"
+	SEARCH_HIGHLIGHT_STOP  = "</b>"
+	SEARCH_SNIPPET_LENGTH  = 100
+)
+
+var searchHeadlineOptions = fmt.Sprintf(`StartSel=%s, StopSel=%s, MinWords=5, MaxWords=20, MaxFragments=2, FragmentDelimiter=" ... "`,
+	SEARCH_HIGHLIGHT_START, SEARCH_HIGHLIGHT_STOP)
+
+type SearchResult struct {
+	ID          string    `pg:"id"`
+	AuthorID    string    `pg:"author_id"`
+	RecepientID string    `pg:"recepient_id"`
+	DialogID    string    `pg:"dialog_id"`
+	CreatedAt   time.Time `pg:"created_at"`
+	Snippet     string    `pg:"snippet"`
+}
+
+/* The column HTML-escaped in SQL, the same way as html.EscapeString does */
+func sqlEscapeHTML(column string) string {
+	return `replace(replace(replace(replace(replace(` + column + `, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+}
+
+/* The other participant of the dialog, the user for the messages to themselves */
+func (r *SearchResult) PeerID(userID string) string {
+	if r.AuthorID == userID {
+		return r.RecepientID
+	}
+	return r.AuthorID
+}
+
+func dbSearchMessages(ctx context.Context, shard *Shard, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	res := []SearchResult{}
+	match := `SELECT id, author_id, recepient_id, dialog_id, created_at, text FROM dialogs
+		WHERE (author_id = $1 OR recepient_id = $1) AND state = ANY($2) AND ` + visibleTo("$1") + `
+		AND to_tsvector('` + SEARCH_TS_CONFIG + `', text) @@ websearch_to_tsquery('` + SEARCH_TS_CONFIG + `', $3)`
+	args := []interface{}{userID, []string{DIALOG_UNREAD_STATE, DIALOG_PENDING_READ_STATE, DIALOG_READ_STATE}, query, searchHeadlineOptions}
+	if cursor != nil {
+		match += ` AND (created_at, id) < ($5, $6)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	match += fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+	// The headlines are built for the page only
+	err := pgxscan.Select(ctx, shard.DB, &res,
+		`SELECT id, author_id, recepient_id, dialog_id, created_at, ts_headline('`+SEARCH_TS_CONFIG+`', `+sqlEscapeHTML("text")+`, websearch_to_tsquery('`+SEARCH_TS_CONFIG+`', $3), $4) AS snippet
+		FROM (`+match+`) m ORDER BY created_at DESC, id DESC`,
+		args...)
+	return res, err
+}
+
+/* Newest first, the messages created at the same moment by the id */
+func searchResultBefore(a, b *SearchResult) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID > b.ID
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+func sortSearchResults(res []SearchResult, limit int) []SearchResult {
+	sort.Slice(res, func(i, j int) bool { return searchResultBefore(&res[i], &res[j]) })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+/* Messages of the user matching the query older than the cursor, the newest first */
+func SearchMessagesDB(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	g := &shardGather[SearchResult, *common.Cursor]{
+		page: func(shard *Shard, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+			return dbSearchMessages(ctx, shard, userID, query, cursor, limit)
+		},
+		next: func(m *SearchResult) *common.Cursor {
+			return &common.Cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+		},
+		owner: func(m *SearchResult) string { return m.DialogID },
+		less:  searchResultBefore,
+	}
+	return g.read(cursor, limit)
+}
+
+/* Lowercase words of the query for the substring search */
+func searchWords(query string) []string {
+	return strings.Fields(strings.Map(unicode.ToLower, query))
+}
+
+func hasRunesAt(text []rune, i int, word []rune) bool {
+	if i+len(word) > len(text) {
+		return false
+	}
+	for j, r := range word {
+		if text[i+j] != r {
+			return false
+		}
+	}
+	return true
+}
+
+/* The HTML-escaped text around the first match with the words highlighted, for the stores without ts_headline */
+func highlight(text string, words []string) string {
+	runes := []rune(text)
+	lower := []rune(strings.Map(unicode.ToLower, text))
+	marked := make([]bool, len(runes))
+	first := len(runes)
+	for _, w := range words {
+		word := []rune(w)
+		for i := range lower {
+			if !hasRunesAt(lower, i, word) {
+				continue
+			}
+			for j := i; j < i+len(word); j++ {
+				marked[j] = true
+			}
+			if i < first {
+				first = i
+			}
+		}
+	}
+	start := 0
+	if first > SEARCH_SNIPPET_LENGTH/2 && len(runes) > SEARCH_SNIPPET_LENGTH {
+		start = first - SEARCH_SNIPPET_LENGTH/2
+	}
+	end := start + SEARCH_SNIPPET_LENGTH
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("... ")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString(SEARCH_HIGHLIGHT_START)
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString(SEARCH_HIGHLIGHT_STOP)
+		}
+	}
+	if end < len(runes) {
+		b.WriteString(" ...")
+	}
+	return b.String()
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"hash/fnv"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+/*
+ * Dialogs are spread over the Postgres shards of dialogs.shards by their
+ * dialog id with consistent hashing: every shard owns dialogs.shard_vnodes
+ * points of a hash ring, and a dialog belongs to the shard of the first point
+ * after its hash. Adding a shard moves only the dialogs of the points it
+ * takes over. The whole dialog, its saga log, outbox events and the
+ * conversation rows live on one shard, so the writes stay local transactions.
+ *
+ * A shard set as dialogs.new_shard is being filled: it is not an owner yet,
+ * but the writes of the dialogs moving to it are mirrored there after commit
+ * (dual-write) while the reshard command copies the existing ones. Clearing
+ * dialogs.new_shard cuts the dialogs over to it.
+ */
+
+const DEFAULT_SHARD = "default"
+
+type Shard struct {
+	Name string
+	DB   *pgxpool.Pool
+}
+
+type shardRing struct {
+	points []uint64
+	shards []string
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func newShardRing(names []string, vnodes int) *shardRing {
+	r := &shardRing{}
+	type point struct {
+		hash  uint64
+		shard string
+	}
+	points := []point{}
+	for _, name := range names {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{hash: hashKey(name + "#" + strconv.Itoa(i)), shard: name})
+		}
+	}
+	// Equal hashes of different shards are ordered by name to keep the ring stable
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].shard < points[j].shard
+		}
+		return points[i].hash < points[j].hash
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.shards = append(r.shards, p.shard)
+	}
+	return r
+}
+
+/* Shard owning the key */
+func (r *shardRing) Get(key string) string {
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+var shards map[string]*Shard
+
+/* Shards owning dialogs, ordered by name */
+var owners []*Shard
+
+/* Ring of the owners and the ring with the new shard, nil unless resharding */
+var ring, targetRing *shardRing
+
+/* Shard DSNs by name, dialogs.db is the only shard if none are set */
+func shardDSNs() map[string]string {
+	if len(config.Get().Dialogs.Shards) == 0 {
+		return map[string]string{DEFAULT_SHARD: config.Get().Dialogs.DB}
+	}
+	return config.Get().Dialogs.Shards
+}
+
+func CreateConnectionPool() {
+	newShard := config.Get().Dialogs.NewShard
+	shards = map[string]*Shard{}
+	owners = []*Shard{}
+	ownerNames, all := []string{}, []string{}
+	for name, dsn := range shardDSNs() {
+		pool, err := tracing.ConnectPool(context.Background(), dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if name == DEFAULT_SHARD {
+			metrics.RegisterPool("dialogs", pool)
+		} else {
+			metrics.RegisterPool("dialogs_"+name, pool)
+		}
+		shards[name] = &Shard{Name: name, DB: pool}
+		all = append(all, name)
+		if name != newShard {
+			owners = append(owners, shards[name])
+			ownerNames = append(ownerNames, name)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Name < owners[j].Name })
+	vnodes := config.Get().Dialogs.ShardVnodes
+	ring = newShardRing(ownerNames, vnodes)
+	if newShard != "" {
+		log.Printf("Resharding dialogs to %s", newShard)
+		targetRing = newShardRing(all, vnodes)
+	}
+}
+
+/* Shard owning the dialog */
+func shardFor(dialogID string) *Shard {
+	return shards[ring.Get(dialogID)]
+}
+
+/* New shard the writes of the dialog are mirrored to, nil unless the dialog moves there */
+func mirrorShardFor(dialogID string) *Shard {
+	if targetRing == nil {
+		return nil
+	}
+	name := targetRing.Get(dialogID)
+	if name == ring.Get(dialogID) {
+		return nil
+	}
+	return shards[name]
+}
+
+/* Rows of the moved dialogs stay on the old shard until cleaned up, they are skipped */
+func (s *Shard) owns(dialogID string) bool {
+	return ring.Get(dialogID) == s.Name
+}
+
+/*
+ * Scatter-gather read of a list spread over the owner shards. Every shard is
+ * paged from the cursor until limit rows it owns are found, the rows of the
+ * moved dialogs and groups left on it are skipped. The rows of the shards are
+ * merged in the list order and cut to limit.
+ */
+type shardGather[T, C any] struct {
+	// Page of the shard past the cursor in the list order
+	page func(shard *Shard, cursor C, limit int) ([]T, error)
+	// Cursor past the row
+	next func(row *T) C
+	// Dialog or group id of the row
+	owner func(row *T) string
+	less  func(a, b *T) bool
+}
+
+/* Up to limit rows owned by the shard past the cursor */
+func (g *shardGather[T, C]) shard(shard *Shard, cursor C, limit int) ([]T, error) {
+	res := []T{}
+	for len(res) < limit {
+		page, err := g.page(shard, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		for i := range page {
+			if shard.owns(g.owner(&page[i])) {
+				res = append(res, page[i])
+			}
+		}
+		if len(page) < limit {
+			break
+		}
+		cursor = g.next(&page[len(page)-1])
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+/* Up to limit rows of all the owner shards past the cursor, in the list order */
+func (g *shardGather[T, C]) read(cursor C, limit int) ([]T, error) {
+	res := []T{}
+	for _, shard := range owners {
+		rows, err := g.shard(shard, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rows...)
+	}
+	sort.Slice(res, func(i, j int) bool { return g.less(&res[i], &res[j]) })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+)
+
+/* Storage of the dialog messages, Postgres or Tarantool by dialogs.use_tarantool */
+type DialogStore interface {
+	/* Store the message and start its counter saga, returns the message id */
+	SendMessage(ctx context.Context, userID, to, text string) (string, error)
+	/* Messages of the dialog older than the cursor, newest first */
+	DialogList(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error)
+	/* Mark the messages received from the user as read */
+	MarkRead(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error)
+	/* Move the message to the next state once the counters service replies */
+	MessageUpdated(ctx context.Context, req *common.MessageCountRequest) error
+	/* Replace the text of the message sent by the user within the edit window */
+	EditMessage(ctx context.Context, userID, to, id, text string) (*SendRequest, error)
+	/* Delete the message for the user, or for everyone if the user sent it */
+	DeleteMessage(ctx context.Context, userID, to, id string, everyone bool) error
+	/* Messages sent or received by the user matching the query older than the cursor, newest first */
+	SearchMessages(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error)
+}
+
+type postgresStore struct{}
+
+func (postgresStore) SendMessage(ctx context.Context, userID, to, text string) (string, error) {
+	return SendMessageDB(ctx, userID, to, text)
+}
+
+func (postgresStore) DialogList(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	return DialogListDB(ctx, userID, to, cursor, limit)
+}
+
+func (postgresStore) MarkRead(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error) {
+	return MarkReadDB(ctx, userID, from, req)
+}
+
+func (postgresStore) MessageUpdated(ctx context.Context, req *common.MessageCountRequest) error {
+	return MessageUpdatedDB(ctx, req)
+}
+
+func (postgresStore) EditMessage(ctx context.Context, userID, to, id, text string) (*SendRequest, error) {
+	return EditMessageDB(ctx, userID, to, id, text)
+}
+
+func (postgresStore) DeleteMessage(ctx context.Context, userID, to, id string, everyone bool) error {
+	return DeleteMessageDB(ctx, userID, to, id, everyone)
+}
+
+func (postgresStore) SearchMessages(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	return SearchMessagesDB(ctx, userID, query, cursor, limit)
+}
+
+type tarantoolStore struct{}
+
+func (tarantoolStore) SendMessage(ctx context.Context, userID, to, text string) (string, error) {
+	return SendMessageTT(ctx, userID, to, text)
+}
+
+func (tarantoolStore) DialogList(ctx context.Context, userID, to string, cursor *common.Cursor, limit int) ([]SendRequest, error) {
+	return DialogListTT(ctx, userID, to, cursor, limit)
+}
+
+func (tarantoolStore) MarkRead(ctx context.Context, userID, from string, req *ReadRequest) ([]ReadReceipt, error) {
+	return MarkReadTT(ctx, userID, from, req)
+}
+
+func (tarantoolStore) MessageUpdated(ctx context.Context, req *common.MessageCountRequest) error {
+	return MessageUpdatedTT(ctx, req)
+}
+
+func (tarantoolStore) EditMessage(ctx context.Context, userID, to, id, text string) (*SendRequest, error) {
+	return nil, common.ErrNotSupported
+}
+
+func (tarantoolStore) DeleteMessage(ctx context.Context, userID, to, id string, everyone bool) error {
+	return common.ErrNotSupported
+}
+
+func (tarantoolStore) SearchMessages(ctx context.Context, userID, query string, cursor *common.Cursor, limit int) ([]SearchResult, error) {
+	return SearchMessagesTT(ctx, userID, query, cursor, limit)
+}
+
+func dialogStore() DialogStore {
+	if config.Get().Dialogs.UseTarantool {
+		return tarantoolStore{}
+	}
+	return postgresStore{}
+}
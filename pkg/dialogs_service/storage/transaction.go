@@ -8,21 +8,17 @@ import (
 
 type Callback func(context.Context, pgx.Tx) (interface{}, error)
 
-func HandleInTransaction(ctx context.Context, callback Callback) (interface{}, error) {
-	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+func HandleInTransaction(ctx context.Context, shard *Shard, callback Callback) (interface{}, error) {
+	tx, err := shard.DB.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			tx.Commit(ctx)
-		}
-	}()
-	var val interface{}
-	val, err = callback(ctx, tx)
+	val, err := callback(ctx, tx)
 	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
 
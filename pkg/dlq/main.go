@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/queue"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Inspect and replay the dead-lettered saga messages:
+ *
+ *   dlq [flags] list|replay|purge QUEUE [LIMIT]
+ *
+ * QUEUE is the consumer queue, e.g. counters.unreadMessages, its messages
+ * are read from QUEUE.dead. Replayed messages go back to QUEUE with the
+ * retry count reset.
+ */
+
+const PUBLISH_TIMEOUT = 5 * time.Second
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: dlq [flags] list|replay|purge QUEUE [LIMIT]")
+	os.Exit(2)
+}
+
+func main() {
+	config.Load("local-config.yaml")
+	args := config.Args()
+	if len(args) < 2 {
+		usage()
+	}
+	command, name := args[0], args[1]
+	limit := -1
+	if len(args) > 2 {
+		var err error
+		limit, err = strconv.Atoi(args[2])
+		if err != nil {
+			usage()
+		}
+	}
+
+	conn, err := queue.Dial()
+	if err != nil {
+		log.Fatalf("Could not connect to rabbitmq: %s", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		log.Fatalf("Could not create rabbitmq channel: %s", err)
+	}
+	defer ch.Close()
+
+	switch command {
+	case "list":
+		list(ch, name, limit)
+	case "replay":
+		replay(ch, name, limit)
+	case "purge":
+		count, err := ch.QueuePurge(name+queue.DEAD_SUFFIX, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Purged %d messages from %s", count, name+queue.DEAD_SUFFIX)
+	default:
+		usage()
+	}
+}
+
+func describe(d *amqp.Delivery) string {
+	var req common.MessageCountRequest
+	if err := json.Unmarshal(d.Body, &req); err != nil {
+		return fmt.Sprintf("unreadable body %q", d.Body)
+	}
+	reason := ""
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			reason = fmt.Sprintf(" reason=%v time=%v", death["reason"], death["time"])
+		}
+	}
+	return fmt.Sprintf("message=%s author=%s recepient=%s action=%s retries=%d%s",
+		req.MessageID, req.AuthorID, req.RecepientID, req.Action, queue.RetryCount(d), reason)
+}
+
+/* Messages are left unacked, they return to the dead queue once the channel is closed */
+func list(ch *amqp.Channel, name string, limit int) {
+	for count := 0; limit < 0 || count < limit; count++ {
+		d, ok, err := ch.Get(name+queue.DEAD_SUFFIX, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			return
+		}
+		fmt.Println(describe(&d))
+	}
+}
+
+func replay(ch *amqp.Channel, name string, limit int) {
+	if err := ch.Confirm(false); err != nil {
+		log.Fatal(err)
+	}
+	count := 0
+	for ; limit < 0 || count < limit; count++ {
+		d, ok, err := ch.Get(name+queue.DEAD_SUFFIX, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if err := republish(ch, name, &d); err != nil {
+			d.Nack(false, true)
+			log.Fatalf("Could not replay %s: %s", describe(&d), err)
+		}
+		if err := d.Ack(false); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Replayed %s", describe(&d))
+	}
+	log.Printf("Replayed %d messages to %s", count, name)
+}
+
+func republish(ch *amqp.Channel, name string, d *amqp.Delivery) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		if k != "x-death" && k != queue.RETRY_COUNT_HEADER {
+			headers[k] = v
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_TIMEOUT)
+	defer cancel()
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		"",    // exchange
+		name,  // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Headers:      headers,
+			Body:         d.Body,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return common.ErrMessageNotConfirmed
+	}
+	return nil
+}
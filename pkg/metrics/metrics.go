@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+ * Metrics of a service are exposed at /metrics in the Prometheus text format,
+ * the dialogs and counters services serve them on a separate internal port.
+ * Requests are labeled with the route names of the routers, so the load test
+ * results can be matched with the handlers. The default registry also has
+ * the Go runtime and the process collectors.
+ */
+
+const (
+	NAMESPACE    = "highload"
+	METRICS_PATH = "/metrics"
+)
+
+const (
+	CACHE_HIT  = "hit"
+	CACHE_MISS = "miss"
+
+	QUEUE_PUBLISHED = "published"
+	QUEUE_CONSUMED  = "consumed"
+	QUEUE_RETRIED   = "retried"
+	QUEUE_DEAD      = "dead_lettered"
+
+	SAGA_RETRIED     = "retried"
+	SAGA_COMPENSATED = "compensated"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route", "method"})
+
+	requestsTimedOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_timed_out_total",
+		Help:      "HTTP requests which ran out of the route deadline.",
+	}, []string{"route"})
+
+	requestsCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_cancelled_total",
+		Help:      "HTTP requests abandoned by the client.",
+	}, []string{"route"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "cache_requests_total",
+		Help:      "Redis cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+
+	queueMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "queue_messages_total",
+		Help:      "RabbitMQ messages by exchange and direction.",
+	}, []string{"exchange", "direction"})
+
+	sagaStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "saga_step_duration_seconds",
+		Help:      "Latency of the saga steps by step and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"step", "outcome"})
+
+	sagaWatchdogActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "saga_watchdog_actions_total",
+		Help:      "Stuck sagas re-issued or compensated by the watchdog.",
+	}, []string{"action"})
+
+	reshardMirrorFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "reshard_mirror_failures_total",
+		Help:      "Writes not mirrored to the new shard, another reshard pass has to copy them.",
+	}, []string{"entity"})
+
+	countersDrifted = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "counters_drifted_dialogs",
+		Help:      "Dialogs which unread counter differed from the dialogs database on the last reconciliation.",
+	})
+
+	countersDriftedMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "counters_drifted_messages",
+		Help:      "Sum of the unread counter differences found on the last reconciliation.",
+	})
+
+	countersRepaired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "counters_repaired_total",
+		Help:      "Unread counters repaired by the reconciliation.",
+	})
+
+	countersReconciled = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "counters_reconciled_timestamp_seconds",
+		Help:      "Time the last reconciliation of the unread counters finished.",
+	})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+/* Serve the metrics on the internal listener, apart from the public routes */
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, Handler())
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func ObserveRequest(route, method string, code int, latency time.Duration) {
+	requestsTotal.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(route, method).Observe(latency.Seconds())
+}
+
+func RequestTimedOut(route string) {
+	requestsTimedOut.WithLabelValues(route).Inc()
+}
+
+func RequestCancelled(route string) {
+	requestsCancelled.WithLabelValues(route).Inc()
+}
+
+func CacheHit(cache string) {
+	cacheRequests.WithLabelValues(cache, CACHE_HIT).Inc()
+}
+
+func CacheMiss(cache string) {
+	cacheRequests.WithLabelValues(cache, CACHE_MISS).Inc()
+}
+
+func QueuePublished(exchange string) {
+	queueMessages.WithLabelValues(exchange, QUEUE_PUBLISHED).Inc()
+}
+
+func QueueConsumed(exchange string) {
+	queueMessages.WithLabelValues(exchange, QUEUE_CONSUMED).Inc()
+}
+
+func QueueRetried(exchange string) {
+	queueMessages.WithLabelValues(exchange, QUEUE_RETRIED).Inc()
+}
+
+func QueueDeadLettered(exchange string) {
+	queueMessages.WithLabelValues(exchange, QUEUE_DEAD).Inc()
+}
+
+/* Measure a saga step, call the returned function with the step error once it is done */
+func SagaStep(step string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		sagaStepDuration.WithLabelValues(step, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+func SagaRetried() {
+	sagaWatchdogActions.WithLabelValues(SAGA_RETRIED).Inc()
+}
+
+func SagaCompensated() {
+	sagaWatchdogActions.WithLabelValues(SAGA_COMPENSATED).Inc()
+}
+
+/* Count a write of the dialog or the group not mirrored to the new shard */
+func MirrorFailed(entity string) {
+	reshardMirrorFailures.WithLabelValues(entity).Inc()
+}
+
+func CountersRepaired(count int) {
+	countersRepaired.Add(float64(count))
+}
+
+/* Report the discrepancies found by the finished reconciliation */
+func CountersReconciled(dialogs, messages int) {
+	countersDrifted.Set(float64(dialogs))
+	countersDriftedMessages.Set(float64(messages))
+	countersReconciled.SetToCurrentTime()
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Report the pgxpool stats, the pools are labeled with their role, e.g.
+ * master or replica. A single collector reports all the pools, the
+ * registry refuses a second one with the same descriptions.
+ */
+type poolCollector struct {
+	mu    sync.Mutex
+	pools map[string]*pgxpool.Pool
+}
+
+var (
+	pools         = &poolCollector{pools: map[string]*pgxpool.Pool{}}
+	registerPools sync.Once
+)
+
+var (
+	poolAcquiredDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_acquired_conns",
+		"Connections currently in use.", []string{"pool"}, nil)
+	poolIdleDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_idle_conns",
+		"Idle connections.", []string{"pool"}, nil)
+	poolTotalDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_total_conns",
+		"All the connections of the pool.", []string{"pool"}, nil)
+	poolMaxDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_max_conns",
+		"Max size of the pool.", []string{"pool"}, nil)
+	poolAcquiresDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_acquires_total",
+		"Successful acquires.", []string{"pool"}, nil)
+	poolWaitsDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_empty_acquires_total",
+		"Acquires which had to wait for a connection.", []string{"pool"}, nil)
+	poolWaitDurationDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_acquire_duration_seconds_total",
+		"Total time spent acquiring the connections.", []string{"pool"}, nil)
+	poolCanceledDesc = prometheus.NewDesc(NAMESPACE+"_db_pool_canceled_acquires_total",
+		"Acquires cancelled by the context.", []string{"pool"}, nil)
+)
+
+/* Report the pool under the name, a pool registered again under the same name replaces the old one */
+func RegisterPool(name string, pool *pgxpool.Pool) {
+	pools.mu.Lock()
+	pools.pools[name] = pool
+	pools.mu.Unlock()
+	registerPools.Do(func() {
+		prometheus.MustRegister(pools)
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredDesc
+	ch <- poolIdleDesc
+	ch <- poolTotalDesc
+	ch <- poolMaxDesc
+	ch <- poolAcquiresDesc
+	ch <- poolWaitsDesc
+	ch <- poolWaitDurationDesc
+	ch <- poolCanceledDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, pool := range c.pools {
+		collectPool(ch, name, pool)
+	}
+}
+
+func collectPool(ch chan<- prometheus.Metric, name string, pool *pgxpool.Pool) {
+	stat := pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stat.IdleConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(stat.TotalConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolMaxDesc, prometheus.GaugeValue, float64(stat.MaxConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(stat.AcquireCount()), name)
+	ch <- prometheus.MustNewConstMetric(poolWaitsDesc, prometheus.CounterValue, float64(stat.EmptyAcquireCount()), name)
+	ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stat.AcquireDuration().Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(poolCanceledDesc, prometheus.CounterValue, float64(stat.CanceledAcquireCount()), name)
+}
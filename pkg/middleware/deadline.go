@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+/* Limit the request with the deadline configured for the route */
+func Deadline(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := config.Get().Server.RouteTimeout(name)
+			// Websockets live as long as the client stays connected
+			if timeout == 0 || websocket.IsWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+
+			switch ctx.Err() {
+			case context.DeadlineExceeded:
+				metrics.RequestTimedOut(name)
+			case context.Canceled:
+				metrics.RequestCancelled(name)
+			}
+		})
+	}
+}
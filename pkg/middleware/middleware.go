@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"encoding/json"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * Handlers are wrapped into the chain:
+ *   RequestID -> Trace -> AccessLog -> Metrics -> Recover -> Deadline -> Authenticate -> JSONContent -> handler
+ * so every request has an id and a span, is logged and measured with its final
+ * status, and panics are turned into JSON errors before they reach the access log. The deadline
+ * covers the authentication too, as it may query the storage.
+ */
+
+type Middleware func(http.Handler) http.Handler
+
+/* Authenticate the request, returns the user and the session */
+type Authenticator func(r *http.Request) (string, string, error)
+
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Route     string  `json:"route"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	LatencyMs float64 `json:"latency_ms"`
+	UserID    string  `json:"user_id,omitempty"`
+	TraceID   string  `json:"trace_id,omitempty"`
+	Remote    string  `json:"remote"`
+}
+
+/* Apply the middlewares, the first one is the outermost */
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+/* Wrap the route handler into the common chain, auth is nil for public routes */
+func Wrap(handler http.Handler, name string, auth Authenticator) http.Handler {
+	middlewares := []Middleware{RequestID, Trace(name), AccessLog(name), Metrics(name), Recover, Deadline(name)}
+	if auth != nil {
+		middlewares = append(middlewares, Authenticate(auth))
+	}
+	middlewares = append(middlewares, JSONContent)
+	return Chain(handler, middlewares...)
+}
+
+/* Take the request id from the client or generate one, and return it in the response */
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(common.REQUEST_ID_HEADER)
+		if requestID == "" {
+			requestID = uuid.NewString()
+			r.Header.Set(common.REQUEST_ID_HEADER, requestID)
+		}
+		w.Header().Set(common.REQUEST_ID_HEADER, requestID)
+		next.ServeHTTP(w, r.WithContext(common.ContextWithRequestID(r.Context(), requestID)))
+	})
+}
+
+/* Continue the trace of the caller, the span covers the whole handling of the request */
+func Trace(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracing.StartServer(r, name)
+			span.SetAttributes(attribute.String("request_id", common.RequestIDFromContext(ctx)))
+			rec := record(w)
+			next.ServeHTTP(rec, r.WithContext(ctx))
+			tracing.EndHTTP(span, rec.finalStatus())
+		})
+	}
+}
+
+func traceID(r *http.Request) string {
+	spanContext := trace.SpanContextFromContext(r.Context())
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+func AccessLog(name string) Middleware {
+	// Resolved on wrapping, after the service has redirected its log
+	logger := log.New(log.Writer(), "", 0)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := record(w)
+			// The user is known only after authentication, which happens deeper in the chain
+			var userID string
+			next.ServeHTTP(rec, r.WithContext(withUserIDSink(r.Context(), &userID)))
+
+			status := rec.finalStatus()
+			entry, err := json.Marshal(&accessLogEntry{
+				Time:      start.UTC().Format(time.RFC3339Nano),
+				RequestID: common.RequestIDFromContext(r.Context()),
+				Route:     name,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    status,
+				Bytes:     rec.bytes,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				UserID:    userID,
+				TraceID:   traceID(r),
+				Remote:    r.RemoteAddr,
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			logger.Println(string(entry))
+		})
+	}
+}
+
+/* Count the requests of the route and measure their latency */
+func Metrics(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := record(w)
+			next.ServeHTTP(rec, r)
+			metrics.ObserveRequest(name, r.Method, rec.finalStatus(), time.Since(start))
+		})
+	}
+}
+
+/* Turn a panic into a JSON 500 response */
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := record(w)
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+				if rec.written() {
+					// The response is already on its way, nothing to report the error with
+					return
+				}
+				rec.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				common.RespondError(rec, r, http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+/* Authenticate the request once and put the user and the session into its context */
+func Authenticate(auth Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, sessionID, err := auth(r)
+			if err != nil {
+				if err != common.ErrRequestNotAuthorized {
+					log.Println("Authentication failed: ", err)
+				}
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				common.RespondError(w, r, http.StatusUnauthorized)
+				return
+			}
+			setUserID(r.Context(), userID)
+			ctx := common.ContextWithUserID(r.Context(), userID)
+			ctx = common.ContextWithSessionID(ctx, sessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func JSONContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,16 @@
+package middleware
+
+import "context"
+
+type userIDSinkKey struct{}
+
+/* Let an inner middleware report the authenticated user to the access log */
+func withUserIDSink(ctx context.Context, userID *string) context.Context {
+	return context.WithValue(ctx, userIDSinkKey{}, userID)
+}
+
+func setUserID(ctx context.Context, userID string) {
+	if sink, ok := ctx.Value(userIDSinkKey{}).(*string); ok {
+		*sink = userID
+	}
+}
@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"context"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/queue"
+	"highload-arch/pkg/tracing"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Events are written to the outbox table in the transaction of the business
+ * row and published by the relay afterwards, so an event is never lost
+ * between the commit and the publish. The relay marks an event sent only
+ * once the broker has confirmed it, which gives at-least-once delivery:
+ * an event may be published again if the relay fails before marking it.
+ */
+
+const PURGE_PERIOD = time.Minute
+
+type Event struct {
+	ID         int64             `pg:"id"`
+	Exchange   string            `pg:"exchange"`
+	RoutingKey string            `pg:"routing_key"`
+	Payload    []byte            `pg:"payload"`
+	Headers    map[string]string `pg:"headers"`
+}
+
+/* Add the event to the outbox within the transaction */
+func Add(ctx context.Context, tx pgx.Tx, exchange, key string, payload []byte) error {
+	// Timestamps are stored without time zone and with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err := tx.Exec(ctx,
+		`INSERT INTO outbox (exchange, routing_key, payload, headers, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		exchange, key, payload, tracing.Inject(ctx), now)
+	return err
+}
+
+/* Publish the pending events of the database until the context is done */
+func Relay(ctx context.Context, db *pgxpool.Pool, publisher *queue.Publisher) {
+	log.Println("Running outbox relay")
+	var purged time.Time
+	for {
+		sent, err := relay(ctx, db, publisher)
+		if err != nil {
+			log.Printf("Outbox relay failed: %s", err)
+		}
+		// A full batch means there are more events waiting
+		if err == nil && sent == config.Get().Outbox.BatchSize {
+			continue
+		}
+		if err == nil && sent == 0 && time.Since(purged) > PURGE_PERIOD {
+			purge(ctx, db)
+			purged = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.Get().Outbox.PollInterval):
+		}
+	}
+}
+
+/* Publish a batch of the pending events in order, stopping at the first failure */
+func relay(ctx context.Context, db *pgxpool.Pool, publisher *queue.Publisher) (int, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Concurrent relays of the other instances skip the locked events
+	events := []Event{}
+	err = pgxscan.Select(ctx, tx, &events,
+		`SELECT id, exchange, routing_key, payload, headers FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		config.Get().Outbox.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := []int64{}
+	var publishErr error
+	for _, e := range events {
+		publishCtx, cancel := context.WithTimeout(tracing.Extract(ctx, e.Headers), config.Get().Server.RequestTimeout)
+		publishErr = publisher.Publish(publishCtx, e.Exchange, e.RoutingKey, amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        e.Payload,
+		})
+		cancel()
+		if publishErr != nil {
+			break
+		}
+		sent = append(sent, e.ID)
+	}
+	if len(sent) > 0 {
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		_, err = tx.Exec(ctx, `UPDATE outbox SET sent_at = $1 WHERE id = ANY($2)`, now, sent)
+		if err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return len(sent), publishErr
+}
+
+/* Remove the events sent longer than the retention period ago */
+func purge(ctx context.Context, db *pgxpool.Pool) {
+	before := time.Now().UTC().Add(-config.Get().Outbox.Retention)
+	if _, err := db.Exec(ctx, `DELETE FROM outbox WHERE sent_at < $1`, before); err != nil {
+		log.Printf("Outbox purge failed: %s", err)
+	}
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"context"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/* Handles the delivery, the message is acknowledged only if no error is returned */
+type Handler func(ctx context.Context, d *amqp.Delivery) error
+
+/* Consume the queue of the binding until the context is done, reconnecting on failures */
+func Consume(ctx context.Context, b Binding, handle Handler) error {
+	retries, err := NewPublisher()
+	if err != nil {
+		log.Printf("Could not create retry publisher for %s: %s", b.Queue, err)
+		return err
+	}
+	defer retries.Close()
+
+	for attempt := 1; ; attempt++ {
+		err := consume(ctx, b, handle, retries)
+		if ctx.Err() != nil {
+			return nil
+		}
+		delay := RetryDelay(attempt)
+		if err == nil {
+			// The deliveries stopped after the consumer was set up, still wait so a closing broker is not hammered
+			attempt = 0
+			log.Printf("Consumer of %s stopped, reconnecting in %s", b.Queue, delay)
+		} else {
+			log.Printf("Consumer of %s failed: %s, reconnecting in %s", b.Queue, err, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+/* Returns nil if the deliveries stopped after the consumer was set up */
+func consume(ctx context.Context, b Binding, handle Handler, retries *Publisher) error {
+	conn, err := Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := Declare(ch, b); err != nil {
+		return err
+	}
+	if err := ch.Qos(config.Get().RabbitMQ.Prefetch, 0, false); err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(
+		b.Queue, // queue
+		"",      // consumer
+		false,   // auto ack
+		false,   // exclusive
+		false,   // no local
+		false,   // no wait
+		nil,     // args
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(" [*] Waiting for messages in %s", b.Queue)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				log.Printf("Deliveries of %s stopped", b.Queue)
+				return nil
+			}
+			deliver(ctx, b, handle, retries, &d)
+		}
+	}
+}
+
+func deliver(ctx context.Context, b Binding, handle Handler, retries *Publisher, d *amqp.Delivery) {
+	metrics.QueueConsumed(b.Exchange)
+	// Every message is handled within its own deadline
+	msgCtx, cancel := context.WithTimeout(ctx, config.Get().Server.RequestTimeout)
+	defer cancel()
+	msgCtx, span := tracing.StartConsume(msgCtx, b.Exchange, d.Headers)
+	err := handle(msgCtx, d)
+	tracing.End(span, err)
+	if err == nil {
+		if err := d.Ack(false); err != nil {
+			log.Printf("Could not ack message from %s: %s", b.Queue, err)
+		}
+		return
+	}
+
+	attempt := RetryCount(d) + 1
+	if IsPermanent(err) || attempt > config.Get().RabbitMQ.MaxRetries {
+		log.Printf("Dead-lettering message from %s after %d attempts: %s", b.Queue, attempt, err)
+		metrics.QueueDeadLettered(b.Exchange)
+		if err := d.Nack(false, false); err != nil {
+			log.Printf("Could not reject message from %s: %s", b.Queue, err)
+		}
+		return
+	}
+
+	delay := RetryDelay(attempt)
+	log.Printf("Retrying message from %s in %s, attempt %d: %s", b.Queue, delay, attempt, err)
+	// The retry is published before the ack, so the message is never lost in between
+	err = retries.Publish(msgCtx, "", b.Queue+RETRY_SUFFIX, retryOf(d, attempt, delay))
+	if err != nil {
+		log.Printf("Could not publish retry of message from %s: %s", b.Queue, err)
+		d.Nack(false, true)
+		return
+	}
+	metrics.QueueRetried(b.Exchange)
+	if err := d.Ack(false); err != nil {
+		log.Printf("Could not ack message from %s: %s", b.Queue, err)
+	}
+}
+
+/*
+ * The retry expires back to the queue after the delay. The broker expires
+ * only the head of the retry queue, so a short delay may wait for a longer
+ * one queued before it.
+ */
+func retryOf(d *amqp.Delivery, attempt int, delay time.Duration) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		if k != "x-death" {
+			headers[k] = v
+		}
+	}
+	headers[RETRY_COUNT_HEADER] = int32(attempt)
+	return amqp.Publishing{
+		ContentType: d.ContentType,
+		Headers:     headers,
+		Expiration:  strconv.FormatInt(delay.Milliseconds(), 10),
+		Body:        d.Body,
+	}
+}
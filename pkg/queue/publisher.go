@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Publisher waiting for the broker to confirm every message, safe for
+ * concurrent use. The broker confirms the messages no queue is bound for
+ * and drops them, so the queues of the bindings are declared along with
+ * their exchange before the first publish.
+ */
+type Publisher struct {
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	bindings []Binding
+	declared map[string]bool
+}
+
+func NewPublisher(bindings ...Binding) (*Publisher, error) {
+	p := &Publisher{bindings: bindings}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.channel(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/* Confirm mode channel, the connection and the channel are reopened once closed */
+func (p *Publisher) channel() (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	if p.conn == nil || p.conn.IsClosed() {
+		conn, err := Dial()
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	p.ch = ch
+	p.declared = map[string]bool{}
+	return ch, nil
+}
+
+/* Publish the persistent message, returns once the broker has confirmed it */
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	name := exchange
+	if name == "" {
+		name = key
+	}
+	ctx, span, headers := tracing.StartPublish(ctx, name)
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	for k, v := range headers {
+		msg.Headers[k] = v
+	}
+	msg.DeliveryMode = amqp.Persistent
+
+	confirm, err := p.publish(ctx, exchange, key, msg)
+	if err == nil {
+		var acked bool
+		acked, err = confirm.WaitContext(ctx)
+		if err == nil && !acked {
+			err = common.ErrMessageNotConfirmed
+		}
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	metrics.QueuePublished(name)
+	return nil
+}
+
+func (p *Publisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, err := p.channel()
+	if err != nil {
+		return nil, err
+	}
+	if exchange != "" && !p.declared[exchange] {
+		if err := p.declare(ch, exchange); err != nil {
+			return nil, err
+		}
+		p.declared[exchange] = true
+	}
+	return ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg)
+}
+
+/* Declare the exchange and the queues of the bindings to it */
+func (p *Publisher) declare(ch *amqp.Channel, exchange string) error {
+	if err := declareExchange(ch, exchange, "topic"); err != nil {
+		return err
+	}
+	for _, b := range p.bindings {
+		if b.Exchange != exchange {
+			continue
+		}
+		if err := Declare(ch, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
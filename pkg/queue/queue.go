@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"highload-arch/pkg/config"
+	"time"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Saga messages go through durable topic exchanges to durable named queues.
+ * A failed message is republished to the <queue>.retry queue, where it waits
+ * out its backoff and expires back to the queue. Messages out of retries are
+ * rejected and routed by the dead letter exchange to the <queue>.dead queue,
+ * they stay there until replayed or purged with the dlq tool.
+ */
+
+const DEAD_LETTER_EXCHANGE = "deadLetters"
+
+const (
+	RETRY_SUFFIX = ".retry"
+	DEAD_SUFFIX  = ".dead"
+)
+
+const RETRY_COUNT_HEADER = "x-retry-count"
+
+/* Queue of a consumer bound to the exchange */
+type Binding struct {
+	Exchange   string
+	Queue      string
+	RoutingKey string
+}
+
+/*
+ * Queues of the counters saga. The publishers declare them as well, so the
+ * messages confirmed before the consumer has ever started are kept.
+ */
+var (
+	UNREAD_MESSAGES_BINDING = Binding{
+		Exchange:   "unreadMessages",
+		Queue:      "counters.unreadMessages",
+		RoutingKey: "*.*",
+	}
+	UNREAD_MESSAGES_COUNTED_BINDING = Binding{
+		Exchange:   "unreadMessagesCounted",
+		Queue:      "dialogs.unreadMessagesCounted",
+		RoutingKey: "*.*",
+	}
+)
+
+func Dial() (*amqp.Connection, error) {
+	return amqp.Dial(config.Get().RabbitMQ.URL)
+}
+
+func declareExchange(ch *amqp.Channel, name, kind string) error {
+	return ch.ExchangeDeclare(
+		name,  // name
+		kind,  // type
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
+}
+
+func declareQueue(ch *amqp.Channel, name string, args amqp.Table) error {
+	_, err := ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		args,  // arguments
+	)
+	return err
+}
+
+/* Declare the exchange, the queue bound to it and the retry and dead queues of the binding */
+func Declare(ch *amqp.Channel, b Binding) error {
+	if err := declareExchange(ch, b.Exchange, "topic"); err != nil {
+		return err
+	}
+	if err := declareExchange(ch, DEAD_LETTER_EXCHANGE, "direct"); err != nil {
+		return err
+	}
+	err := declareQueue(ch, b.Queue, amqp.Table{
+		"x-dead-letter-exchange":    DEAD_LETTER_EXCHANGE,
+		"x-dead-letter-routing-key": b.Queue,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil); err != nil {
+		return err
+	}
+	// Expired retries go back to the queue through the default exchange
+	err = declareQueue(ch, b.Queue+RETRY_SUFFIX, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": b.Queue,
+	})
+	if err != nil {
+		return err
+	}
+	if err := declareQueue(ch, b.Queue+DEAD_SUFFIX, nil); err != nil {
+		return err
+	}
+	return ch.QueueBind(b.Queue+DEAD_SUFFIX, b.Queue, DEAD_LETTER_EXCHANGE, false, nil)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+/* Mark the error as one retries can't fix, the message is dead-lettered at once */
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+/* Number of times the delivery has been retried */
+func RetryCount(d *amqp.Delivery) int {
+	switch count := d.Headers[RETRY_COUNT_HEADER].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	}
+	return 0
+}
+
+/* Delay before the retry, doubled with every attempt up to the configured max */
+func RetryDelay(attempt int) time.Duration {
+	cfg := config.Get().RabbitMQ
+	delay := cfg.RetryBackoff
+	for i := 1; i < attempt && delay < cfg.RetryBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.RetryBackoffMax {
+		delay = cfg.RetryBackoffMax
+	}
+	return delay
+}
@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+ * Subscribe a temporary queue to the keys of the exchange. The queue lives as
+ * long as the subscription, so the messages published while no one listens
+ * are lost, which suits the events pushed to the connected clients. The
+ * subscriptions of the process share one connection, each one has its own
+ * channel and queue. The deliveries are closed once the context is done or
+ * the connection fails.
+ */
+func Subscribe(ctx context.Context, exchange string, keys []string) (<-chan amqp.Delivery, error) {
+	ch, err := subscriptions.channel()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := subscribe(ch, exchange, keys)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		ch.Close()
+	}()
+	return msgs, nil
+}
+
+type subscriptionConn struct {
+	mu   sync.Mutex
+	conn *amqp.Connection
+}
+
+var subscriptions subscriptionConn
+
+/* New channel on the shared connection, the connection is reopened once closed */
+func (s *subscriptionConn) channel() (*amqp.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil || s.conn.IsClosed() {
+		conn, err := Dial()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	return s.conn.Channel()
+}
+
+func subscribe(ch *amqp.Channel, exchange string, keys []string) (<-chan amqp.Delivery, error) {
+	if err := declareExchange(ch, exchange, "topic"); err != nil {
+		return nil, err
+	}
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := ch.QueueBind(q.Name, key, exchange, false, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto ack
+		true,   // exclusive
+		false,  // no local
+		false,  // no wait
+		nil,    // args
+	)
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/config"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * Celebrities are authors followed by more users than the configured threshold.
+ * Their posts are excluded from fan-out on write and merged into feeds on read.
+ */
+
+type celebritySet struct {
+	sync.RWMutex
+	authors map[string]struct{}
+}
+
+var celebrities = &celebritySet{authors: map[string]struct{}{}}
+
+func (s *celebritySet) empty() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.authors) == 0
+}
+
+func (s *celebritySet) contains(userID string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.authors[userID]
+	return ok
+}
+
+/* Select the celebrities among the user's friends */
+func (s *celebritySet) filter(friends []string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	var res []string
+	for _, friend := range friends {
+		if _, ok := s.authors[friend]; ok {
+			res = append(res, friend)
+		}
+	}
+	return res
+}
+
+/* Replace the set and return the authors which are not celebrities anymore */
+func (s *celebritySet) replace(authors map[string]struct{}) []string {
+	s.Lock()
+	defer s.Unlock()
+	var removed []string
+	for author := range s.authors {
+		if _, ok := authors[author]; !ok {
+			removed = append(removed, author)
+		}
+	}
+	s.authors = authors
+	return removed
+}
+
+func dbLoadCelebrities(ctx context.Context, threshold int) ([]string, error) {
+	res := []string{}
+
+	rows, err := Db(ctx).Query(ctx, `SELECT friend_id FROM friends GROUP BY friend_id HAVING count(*) >= $1;`, threshold)
+
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+
+	return res, rows.Err()
+}
+
+func refreshCelebrities(ctx context.Context) {
+	// The threshold is re-read on every refresh, so it can be tuned without restart
+	threshold := config.Get().Cache.CelebrityThreshold
+	ids, err := dbLoadCelebrities(ctx, threshold)
+	if err != nil {
+		log.Println("Load celebrities failed: ", err)
+		return
+	}
+
+	authors := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		authors[id] = struct{}{}
+	}
+	removed := celebrities.replace(authors)
+
+	// Posts of former celebrities are missing in the materialized feeds of their followers
+	for _, author := range removed {
+		cacheInvalidateFollowerFeeds(ctx, author)
+	}
+}
+
+func RefreshCelebrities(ctx context.Context) {
+	refreshCelebrities(ctx)
+	ticker := time.NewTicker(config.Get().Cache.CelebrityRefreshPeriod)
+	go func() {
+		for range ticker.C {
+			refreshCelebrities(ctx)
+		}
+	}()
+}
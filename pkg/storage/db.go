@@ -2,12 +2,16 @@ package storage
 
 import (
 	"context"
+	"highload-arch/pkg/common"
 	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/outbox"
+	"highload-arch/pkg/queue"
+	"highload-arch/pkg/tracing"
 	"log"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/redis/go-redis/v9"
 	"github.com/tarantool/go-tarantool/v2"
 )
@@ -18,67 +22,66 @@ const (
 )
 
 var db *pgxpool.Pool
-var replicaDb *pgxpool.Pool
 var cache *redis.Client
 
 var tt *tarantool.Connection
-var rbmq *amqp.Connection
+var publisher *queue.Publisher
 
-const DB_USE_REPLICA = false
-const DB_CITUS_ENABLED = false
-
-func Db() *pgxpool.Pool {
-	if !DB_USE_REPLICA {
+/* Get the pool to serve read queries made with the context */
+func Db(ctx context.Context) *pgxpool.Pool {
+	if !config.Get().DB.UseReplica {
 		return db
 	}
-	return replicaDb
+	return router.read(ctx)
 }
 
 func CreateConnectionPool() {
 	var err error
-	default_db := "db.master"
-	if DB_CITUS_ENABLED {
-		default_db = "citus.master"
+	dsn := config.Get().DB.Master
+	if config.Get().Citus.Enabled {
+		dsn = config.Get().Citus.Master
 	}
-	db, err = pgxpool.Connect(context.Background(), config.GetString(default_db))
+	db, err = tracing.ConnectPool(context.Background(), dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics.RegisterPool("master", db)
 }
 
 func CreateReplicaConnectionPool() {
-	if !DB_USE_REPLICA {
+	if !config.Get().DB.UseReplica {
 		return
 	}
-	var err error
-	replicaDb, err = pgxpool.Connect(context.Background(), config.GetString("db.replica"))
-	if err != nil {
-		log.Fatal(err)
-	}
+	router.connect(config.Get().DB.Replica)
 }
 
 func ConnectToCache() {
-	opt, err := redis.ParseURL(config.GetString("cache.url"))
+	opt, err := redis.ParseURL(config.Get().Cache.URL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	cache = redis.NewClient(opt)
-	CacheUpdatePosts(context.Background())
+	tracing.InstrumentRedis(cache)
+	RefreshCelebrities(context.Background())
 }
 
 type Callback func(context.Context, pgx.Tx) (interface{}, error)
 
 func ConnectToRabbitMQ() {
-	url := config.GetString("rabbitmq.url")
 	var err error
-	rbmq, err = amqp.Dial(url)
+	publisher, err = queue.NewPublisher()
 	if err != nil {
 		panic(err)
 	}
 }
 
 func CloseRabbitMQ() {
-	rbmq.Close()
+	publisher.Close()
+}
+
+/* Publish the events of the outbox, e.g. the created posts, until the context is done */
+func RunOutboxRelay(ctx context.Context) {
+	outbox.Relay(ctx, db, publisher)
 }
 
 func CloseTarantoolConnection() {
@@ -92,18 +95,22 @@ func HandleInTransaction(ctx context.Context, callback Callback) (interface{}, e
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			tx.Commit(ctx)
-		}
-	}()
-	var val interface{}
-	val, err = callback(ctx, tx)
+	val, err := callback(ctx, tx)
 	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
+	markCtx, cancel := afterCommit(ctx)
+	defer cancel()
+	router.markWrite(markCtx, common.UserIDFromContext(ctx))
 
 	return val, nil
 }
+
+/* Context of the work following a commit, which must not be abandoned along with the request */
+func afterCommit(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(common.Detach(ctx), config.Get().Server.RequestTimeout)
+}
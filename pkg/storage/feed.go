@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+ * Materialized feeds are kept in Redis:
+ *   feed:<user_id> - sorted set of post ids scored by post creation time,
+ *     an empty feed holds only the "" marker scored 0
+ *   post:<post_id> - hash with the post fields
+ *   author_posts:<user_id> - sorted set of the author's own post ids
+ *   friends:<user_id> - set of the user's friend ids, "" marks a user without friends
+ * A feed is built from Postgres on cache miss and kept up to date by
+ * fan-out on write from CreatePost, UpdatePost and DeletePost.
+ * Posts of celebrities are not fanned out, they are merged into the feed on read.
+ * The friends are cached to find the celebrities among them, the set is dropped
+ * by AddFriend and DeleteFriend.
+ */
+
+var errFeedNotCached = errors.Errorf("Feed is not cached")
+
+/* Member of a cached list with no posts, so the empty list is not rebuilt on every read */
+const emptyFeedMarker = ""
+
+/* Push post into the feed only if it is materialized and trim it to the max length */
+var feedPushScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -tonumber(ARGV[3]) - 1)
+return 1
+`)
+
+func feedKey(userID string) string {
+	return "feed:" + userID
+}
+
+func postKey(postID string) string {
+	return "post:" + postID
+}
+
+func feedLength() int {
+	return config.Get().Cache.FeedLength
+}
+
+func feedScore(post *PostRequest) float64 {
+	return float64(post.CreatedAt.UnixMicro())
+}
+
+func authorPostsKey(authorID string) string {
+	return "author_posts:" + authorID
+}
+
+func friendsKey(userID string) string {
+	return "friends:" + userID
+}
+
+func FeedPosts(ctx context.Context, userID string, cursor *common.Cursor, limit int) ([]PostRequest, error) {
+	var stars []string
+	if !celebrities.empty() {
+		friends, err := cacheFriendIDs(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		stars = celebrities.filter(friends)
+	}
+	if len(stars) == 0 {
+		return cachePostsPage(ctx, feedKey(userID), cursor, limit, func(cursor *common.Cursor, limit int) ([]PostRequest, error) {
+			return dbFeedPosts(ctx, userID, nil, cursor, limit)
+		})
+	}
+
+	// Celebrities' posts are not fanned out, so they are merged into the feed on read
+	pages := make([][]PostRequest, 0, len(stars)+1)
+	posts, err := cachePostsPage(ctx, feedKey(userID), cursor, limit, func(cursor *common.Cursor, limit int) ([]PostRequest, error) {
+		return dbFeedPosts(ctx, userID, stars, cursor, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pages = append(pages, posts)
+	for _, star := range stars {
+		authorID := star
+		posts, err := cachePostsPage(ctx, authorPostsKey(authorID), cursor, limit, func(cursor *common.Cursor, limit int) ([]PostRequest, error) {
+			return dbAuthorPosts(ctx, authorID, cursor, limit)
+		})
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, posts)
+	}
+
+	posts = mergePosts(pages...)
+	if len(posts) > limit {
+		return posts[:limit], nil
+	}
+	return posts, nil
+}
+
+/* Merge pages of posts into a single list ordered by creation time, newest first */
+func mergePosts(pages ...[]PostRequest) []PostRequest {
+	seen := map[string]struct{}{}
+	res := []PostRequest{}
+	for _, page := range pages {
+		for _, post := range page {
+			if _, ok := seen[post.ID]; ok {
+				continue
+			}
+			seen[post.ID] = struct{}{}
+			res = append(res, post)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAt.Equal(res[j].CreatedAt) {
+			return res[i].ID > res[j].ID
+		}
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res
+}
+
+type postsLoader func(cursor *common.Cursor, limit int) ([]PostRequest, error)
+
+/*
+ * Read a page of the cached posts list after the cursor. The list is built with load
+ * on cache miss, pages past the oldest cached post are read with load as well.
+ */
+func cachePostsPage(ctx context.Context, key string, cursor *common.Cursor, limit int, load postsLoader) ([]PostRequest, error) {
+	ids, complete, err := cacheGetPostIDs(ctx, key, cursor, limit)
+	if err == errFeedNotCached {
+		metrics.CacheMiss("feed")
+		posts, err := cacheRebuildPosts(ctx, key, load)
+		if err != nil {
+			return nil, err
+		}
+		page := []PostRequest{}
+		for _, post := range posts {
+			if len(page) == limit {
+				break
+			}
+			if cursor.Before(post.CreatedAt, post.ID) {
+				page = append(page, post)
+			}
+		}
+		if len(page) < limit && len(posts) >= feedLength() {
+			return load(cursor, limit)
+		}
+		return page, nil
+	}
+	if err != nil {
+		log.Println("Feed cache read failed: ", err)
+		return load(cursor, limit)
+	}
+	if len(ids) < limit && !complete {
+		// The page is past the oldest cached post
+		metrics.CacheMiss("feed")
+		return load(cursor, limit)
+	}
+	metrics.CacheHit("feed")
+	posts, missing, err := cacheGetPosts(ctx, ids)
+	if err != nil || len(missing) == 0 {
+		return posts, err
+	}
+	// The deleted posts are dropped from the list and the page is read from Postgres in full
+	if err := cache.ZRem(ctx, key, missing).Err(); err != nil {
+		log.Println("Feed cache update failed: ", err)
+	}
+	return load(cursor, limit)
+}
+
+/* Read post ids after the cursor, also report whether the cached list is not trimmed */
+func cacheGetPostIDs(ctx context.Context, key string, cursor *common.Cursor, limit int) ([]string, bool, error) {
+	var exists, card *redis.IntCmd
+	var ties, ids *redis.StringSliceCmd
+	_, err := cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, key)
+		card = pipe.ZCard(ctx, key)
+		if cursor == nil {
+			ids = pipe.ZRevRange(ctx, key, 0, int64(limit-1))
+		} else {
+			// Posts created at the same moment as the cursor are ordered by id
+			score := strconv.FormatInt(cursor.CreatedAt.UnixMicro(), 10)
+			ties = pipe.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{Max: score, Min: score})
+			ids = pipe.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{Max: "(" + score, Min: "-inf", Count: int64(limit)})
+		}
+		pipe.Expire(ctx, key, config.Get().Cache.TTL)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if exists.Val() == 0 {
+		return nil, false, errFeedNotCached
+	}
+
+	res := []string{}
+	if ties != nil {
+		for _, id := range ties.Val() {
+			if id < cursor.ID {
+				res = append(res, id)
+			}
+		}
+	}
+	complete := card.Val() < int64(feedLength())
+	for _, id := range ids.Val() {
+		if id == emptyFeedMarker {
+			// The marker is the oldest member, the list holds every post there is
+			complete = true
+			continue
+		}
+		res = append(res, id)
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, complete, nil
+}
+
+func cacheRebuildPosts(ctx context.Context, key string, load postsLoader) ([]PostRequest, error) {
+	posts, err := load(nil, feedLength())
+	if err != nil {
+		return nil, err
+	}
+	members := make([]redis.Z, 0, len(posts))
+	for i := range posts {
+		members = append(members, redis.Z{Score: feedScore(&posts[i]), Member: posts[i].ID})
+	}
+	if len(members) == 0 {
+		members = append(members, redis.Z{Score: 0, Member: emptyFeedMarker})
+	}
+	_, err = cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.ZAdd(ctx, key, members...)
+		pipe.Expire(ctx, key, config.Get().Cache.TTL)
+		for i := range posts {
+			cacheSetPost(ctx, pipe, &posts[i])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Feed cache rebuild failed: ", err)
+	}
+	return posts, nil
+}
+
+/* Read the posts by ids, also return the ids of the deleted posts */
+func cacheGetPosts(ctx context.Context, ids []string) ([]PostRequest, []string, error) {
+	cmds := make([]*redis.MapStringStringCmd, 0, len(ids))
+	_, err := cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			cmds = append(cmds, pipe.HGetAll(ctx, postKey(id)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var missing []string
+	posts := make([]PostRequest, 0, len(ids))
+	for i, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) == 0 {
+			metrics.CacheMiss("post")
+			post, err := dbGetPost(ctx, ids[i])
+			if err == common.ErrPostNotFound {
+				missing = append(missing, ids[i])
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := cacheSetPost(ctx, cache, post); err != nil {
+				log.Println("Cache update failed: ", err)
+			}
+			posts = append(posts, *post)
+			continue
+		}
+
+		metrics.CacheHit("post")
+		createdAt, err := time.Parse(time.RFC3339Nano, values["created_at"])
+		if err != nil {
+			return nil, nil, err
+		}
+		updatedAt, err := time.Parse(time.RFC3339Nano, values["updated_at"])
+		if err != nil {
+			return nil, nil, err
+		}
+		posts = append(posts, PostRequest{ID: values["post_id"],
+			AuthorUserID: values["author_user_id"],
+			CreatedAt:    createdAt,
+			UpdatedAt:    updatedAt,
+			Text:         values["text"],
+		})
+	}
+	return posts, missing, nil
+}
+
+func cacheSetPost(ctx context.Context, c redis.Cmdable, post *PostRequest) error {
+	key := postKey(post.ID)
+	err := c.HSet(ctx, key, map[string]interface{}{
+		"post_id":        post.ID,
+		"author_user_id": post.AuthorUserID,
+		"created_at":     post.CreatedAt.Format(time.RFC3339Nano),
+		"updated_at":     post.UpdatedAt.Format(time.RFC3339Nano),
+		"text":           post.Text,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return c.Expire(ctx, key, config.Get().Cache.TTL).Err()
+}
+
+/*
+ * Fan-out on write: push the new post into the author's posts list and into every
+ * materialized feed of the author's followers, unless the author is a celebrity
+ */
+func cacheFanOutPost(ctx context.Context, post *PostRequest) {
+	var followers []string
+	var err error
+	if !celebrities.contains(post.AuthorUserID) {
+		followers, err = dbLoadFollowers(ctx, post.AuthorUserID)
+		if err != nil {
+			log.Println("Feed fan-out failed: ", err)
+			return
+		}
+	}
+	if err := feedPushScript.Load(ctx, cache).Err(); err != nil {
+		log.Println("Feed fan-out failed: ", err)
+		return
+	}
+
+	length := feedLength()
+	_, err = cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		cacheSetPost(ctx, pipe, post)
+		feedPushScript.EvalSha(ctx, pipe, []string{authorPostsKey(post.AuthorUserID)}, feedScore(post), post.ID, length)
+		for _, follower := range followers {
+			feedPushScript.EvalSha(ctx, pipe, []string{feedKey(follower)}, feedScore(post), post.ID, length)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Feed fan-out failed: ", err)
+	}
+}
+
+func cacheRemovePost(ctx context.Context, post *PostRequest) {
+	followers, err := dbLoadFollowers(ctx, post.AuthorUserID)
+	if err != nil {
+		log.Println("Feed cache update failed: ", err)
+	}
+	_, err = cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, postKey(post.ID))
+		pipe.ZRem(ctx, authorPostsKey(post.AuthorUserID), post.ID)
+		for _, follower := range followers {
+			pipe.ZRem(ctx, feedKey(follower), post.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Feed cache update failed: ", err)
+	}
+}
+
+/* Drop feeds of the author's followers, so they are rebuilt with the author's posts on next read */
+func cacheInvalidateFollowerFeeds(ctx context.Context, authorID string) {
+	followers, err := dbLoadFollowers(ctx, authorID)
+	if err != nil {
+		log.Println("Cache invalidation failed: ", err)
+		return
+	}
+	if len(followers) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(followers))
+	for _, follower := range followers {
+		keys = append(keys, feedKey(follower))
+	}
+	if err := cache.Unlink(ctx, keys...).Err(); err != nil {
+		log.Println("Cache invalidation failed: ", err)
+	}
+}
+
+func cacheInvalidatePost(ctx context.Context, postID string) {
+	if err := cache.Del(ctx, postKey(postID)).Err(); err != nil {
+		log.Println("Cache invalidation failed: ", err)
+	}
+}
+
+func cacheInvalidateFeed(ctx context.Context, userID string) {
+	if err := cache.Del(ctx, feedKey(userID), friendsKey(userID)).Err(); err != nil {
+		log.Println("Cache invalidation failed: ", err)
+	}
+}
+
+/* Ids of the user's friends, the set is built from Postgres on cache miss */
+func cacheFriendIDs(ctx context.Context, userID string) ([]string, error) {
+	key := friendsKey(userID)
+	members, err := cache.SMembers(ctx, key).Result()
+	if err != nil {
+		log.Println("Friends cache read failed: ", err)
+	}
+	if err == nil && len(members) > 0 {
+		metrics.CacheHit("friends")
+		ids := make([]string, 0, len(members))
+		for _, id := range members {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	metrics.CacheMiss("friends")
+	friends, err := dbLoadFriendsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(friends))
+	members = []string{""}
+	for _, friend := range friends {
+		ids = append(ids, friend.FriendID)
+		members = append(members, friend.FriendID)
+	}
+	_, err = cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, members)
+		pipe.Expire(ctx, key, config.Get().Cache.TTL)
+		return nil
+	})
+	if err != nil {
+		log.Println("Friends cache update failed: ", err)
+	}
+	return ids, nil
+}
@@ -31,7 +31,7 @@ func (req *FriendRequest) dbDeleteFriend(ctx context.Context, tx pgx.Tx) error {
 func dbLoadFriends(ctx context.Context) ([]FriendRequest, error) {
 	res := []FriendRequest{}
 
-	rows, err := db.Query(ctx, `SELECT id, friend_id FROM friends;`)
+	rows, err := Db(ctx).Query(ctx, `SELECT id, friend_id FROM friends;`)
 
 	defer rows.Close()
 	if err != nil {
@@ -48,7 +48,7 @@ func dbLoadFriends(ctx context.Context) ([]FriendRequest, error) {
 func dbLoadFriendsByUser(ctx context.Context, userID string) ([]FriendRequest, error) {
 	res := []FriendRequest{}
 
-	rows, err := db.Query(ctx, `SELECT id, friend_id FROM friends WHERE id = $1;`, userID)
+	rows, err := Db(ctx).Query(ctx, `SELECT id, friend_id FROM friends WHERE id = $1;`, userID)
 
 	defer rows.Close()
 	if err != nil {
@@ -62,6 +62,28 @@ func dbLoadFriendsByUser(ctx context.Context, userID string) ([]FriendRequest, e
 	return res, err
 }
 
+/* Load ids of the users who have userID in their friends list */
+func dbLoadFollowers(ctx context.Context, userID string) ([]string, error) {
+	res := []string{}
+
+	rows, err := Db(ctx).Query(ctx, `SELECT id FROM friends WHERE friend_id = $1;`, userID)
+
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+
+	return res, rows.Err()
+}
+
 func AddFriend(ctx context.Context, userID string, friendID string) error {
 	req := &FriendRequest{ID: userID, FriendID: friendID}
 	_, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
@@ -71,7 +93,13 @@ func AddFriend(ctx context.Context, userID string, friendID string) error {
 		}
 		return nil, nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	cacheInvalidateFeed(ctx, userID)
+	return nil
 }
 
 func DeleteFriend(ctx context.Context, userID string, friendID string) error {
@@ -83,7 +111,13 @@ func DeleteFriend(ctx context.Context, userID string, friendID string) error {
 		}
 		return nil, nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	cacheInvalidateFeed(ctx, userID)
+	return nil
 }
 
 func GetFriends(ctx context.Context) ([]FriendRequest, error) {
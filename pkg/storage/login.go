@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
 	"log"
 	"time"
 
@@ -12,10 +13,7 @@ import (
 	"github.com/jackc/pgx/v4"
 )
 
-const (
-	TokenLength         = 15
-	TokenValidityPeriod = 24 // In hours
-)
+const TokenLength = 15
 
 type Login struct {
 	ID       string `pg:"id"`
@@ -24,70 +22,44 @@ type Login struct {
 
 type LoginToken struct {
 	ID         string    `pg:"id"`
+	SessionID  string    `pg:"session_id"`
 	Token      string    `pg:"token"`
 	ValidUntil time.Time `pg:"valid_until"`
 }
 
-func LoginUser(ctx context.Context, login *Login) (*LoginToken, error) {
+/* Every login starts a new session, so the user can stay logged in on several devices */
+func LoginUser(ctx context.Context, login *Login, userAgent string) (*LoginToken, error) {
 	if err := CheckUserPassword(ctx, login.ID, login.Password); err != nil {
 		return nil, err
 	}
-	loginToken, err := login.getLoginToken(ctx)
-	if err != nil && err != common.ErrTokenNotFound && err != common.ErrTokenExpired {
-		return nil, err
-	}
-	if err == common.ErrTokenNotFound || err == common.ErrTokenExpired {
-		// generate token
-		log.Println("Generating new token for user ", login.ID)
-		token := generateSecureToken(TokenLength)
-		newLoginToken, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-			loginToken, err := login.dbAddLoginToken(ctx, tx, token)
-			if err != nil {
-				return nil, err
-			}
-
-			return loginToken, nil
-		})
+	log.Println("Generating new token for user ", login.ID)
+	token := generateSecureToken(TokenLength)
+	loginToken, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		sessionID, err := dbAddSession(ctx, tx, login.ID, userAgent)
 		if err != nil {
 			return nil, err
 		}
-		return newLoginToken.(*LoginToken), nil
-	}
-	return loginToken, nil
-}
-
-func (login *Login) dbAddLoginToken(ctx context.Context, tx pgx.Tx, token string) (*LoginToken, error) {
-	valid_until := time.Now().Add(time.Hour * time.Duration(TokenValidityPeriod))
-	_, err := tx.Exec(ctx,
-		`INSERT INTO user_tokens (id, token, valid_until) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET token = EXCLUDED.token, valid_until = EXCLUDED.valid_until`,
-		login.ID, token, valid_until)
-
-	return &LoginToken{login.ID, token, valid_until}, err
-}
-
-func (login *Login) dbReadToken(ctx context.Context, tx pgx.Tx, token string) (*LoginToken, error) {
-	res := []*LoginToken{}
-
-	rows, err := Db().Query(context.Background(), `SELECT * FROM user_tokens WHERE token = $1`, token)
-	defer rows.Close()
+		return login.dbAddLoginToken(ctx, tx, sessionID, token)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return loginToken.(*LoginToken), nil
+}
 
-	if err := pgxscan.ScanAll(&res, rows); err != nil {
-		return nil, err
-	}
+func (login *Login) dbAddLoginToken(ctx context.Context, tx pgx.Tx, sessionID, token string) (*LoginToken, error) {
+	valid_until := time.Now().UTC().Add(config.Get().Auth.TokenValidityPeriod)
+	_, err := tx.Exec(ctx,
+		`INSERT INTO user_tokens (token, id, session_id, valid_until) VALUES ($1, $2, $3, $4)`,
+		token, login.ID, sessionID, valid_until)
 
-	if len(res) == 0 {
-		return nil, common.ErrTokenNotFound
-	}
-	return res[0], nil
+	return &LoginToken{ID: login.ID, SessionID: sessionID, Token: token, ValidUntil: valid_until}, err
 }
 
-func (login *Login) dbReadTokenByID(ctx context.Context, tx pgx.Tx, userID string) (*LoginToken, error) {
+func dbReadToken(ctx context.Context, token string) (*LoginToken, error) {
 	res := []*LoginToken{}
 
-	rows, err := Db().Query(context.Background(), `SELECT * FROM user_tokens WHERE id = $1`, userID)
+	rows, err := Db(ctx).Query(ctx, `SELECT id, session_id, token, valid_until FROM user_tokens WHERE token = $1`, token)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -111,40 +83,18 @@ func generateSecureToken(length int) string {
 	return hex.EncodeToString(b)
 }
 
-func (login *Login) getLoginToken(ctx context.Context) (*LoginToken, error) {
-	loginToken, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-		loginToken, err := login.dbReadTokenByID(ctx, tx, login.ID)
-		if err != nil {
-			return "", err
-		}
-		return loginToken, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	loginTokenStruct := loginToken.(*LoginToken)
-	if loginTokenStruct.ValidUntil.Before(time.Now()) {
-		return nil, common.ErrTokenExpired
+/* Get token and make sure it's not expired, returns the user and the session of the token */
+func ValidateLoginToken(ctx context.Context, token string) (string, string, error) {
+	loginToken, err := dbReadToken(ctx, token)
+	if err == common.ErrTokenNotFound && config.Get().DB.UseReplica {
+		// The token may be issued too recently to be replicated
+		loginToken, err = dbReadToken(WithMaster(ctx), token)
 	}
-	return loginToken.(*LoginToken), nil
-}
-
-/* Get token and make sure it's not expired */
-func ValidateLoginToken(ctx context.Context, token string) (string, error) {
-	loginToken, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-		login := &Login{}
-		loginToken, err := login.dbReadToken(ctx, tx, token)
-		if err != nil {
-			return "", err
-		}
-		return loginToken, nil
-	})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	loginTokenStruct := loginToken.(*LoginToken)
-	if loginTokenStruct.ValidUntil.Before(time.Now()) {
-		return "", common.ErrTokenExpired
+	if loginToken.ValidUntil.Before(time.Now().UTC()) {
+		return "", "", common.ErrTokenExpired
 	}
-	return loginTokenStruct.ID, nil
+	return loginToken.ID, loginToken.SessionID, nil
 }
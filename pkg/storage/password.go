@@ -5,34 +5,26 @@ import (
 	"highload-arch/pkg/common"
 
 	"github.com/georgysavva/scany/pgxscan"
-	"github.com/jackc/pgx/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func CheckUserPassword(ctx context.Context, userID string, password string) error {
-	requestLogin := &Login{ID: userID, Password: password}
-	dbLogin, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-		dbLogin, err := requestLogin.dbReadPassword(ctx, tx, userID)
-		if err != nil {
-			return nil, err
-		}
-		return dbLogin, nil
-	})
+	dbLogin, err := dbReadPassword(ctx, userID)
 	if err != nil {
 		return err
 	}
 
-	if CheckPasswordHash(requestLogin.Password, dbLogin.(*Login).Password) {
+	if CheckPasswordHash(password, dbLogin.Password) {
 		return nil
 	} else {
 		return common.ErrPasswordInvalid
 	}
 }
 
-func (login *Login) dbReadPassword(ctx context.Context, tx pgx.Tx, userID string) (*Login, error) {
+func dbReadPassword(ctx context.Context, userID string) (*Login, error) {
 	res := []*Login{}
 
-	rows, err := Db().Query(context.Background(), `SELECT * FROM user_credentials WHERE id = $1`, userID)
+	rows, err := Db(ctx).Query(ctx, `SELECT * FROM user_credentials WHERE id = $1`, userID)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -3,14 +3,14 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"highload-arch/pkg/common"
+	"highload-arch/pkg/outbox"
 	"log"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4"
-	amqp "github.com/rabbitmq/amqp091-go"
-	"golang.org/x/exp/slices"
 )
 
 type PostRequest struct {
@@ -22,35 +22,47 @@ type PostRequest struct {
 	//UserID       string
 }
 
-const CACHE_TTL = 10 // Cache TTl in seconds
-
 func (req *PostRequest) dbAddPost(ctx context.Context, tx pgx.Tx) error {
-	_, err := tx.Exec(ctx,
-		`INSERT INTO posts (author_user_id, text, created_at, updated_at) VALUES ($1, $2, $3, $4)`,
-		req.AuthorUserID, req.Text, req.CreatedAt, req.UpdatedAt)
-
-	return err
+	return tx.QueryRow(ctx,
+		`INSERT INTO posts (author_user_id, text, created_at, updated_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+		req.AuthorUserID, req.Text, req.CreatedAt, req.UpdatedAt).Scan(&req.ID)
 }
 
 func (req *PostRequest) dbDeletePost(ctx context.Context, tx pgx.Tx) error {
-	_, err := tx.Exec(ctx,
-		`DELETE FROM posts WHERE id = $1`, req.ID)
-
+	err := tx.QueryRow(ctx,
+		`DELETE FROM posts WHERE id = $1 RETURNING author_user_id`, req.ID).Scan(&req.AuthorUserID)
+	if err == pgx.ErrNoRows {
+		return common.ErrPostNotFound
+	}
 	return err
 }
 
 func (req *PostRequest) dbUpdatePost(ctx context.Context, tx pgx.Tx) error {
-	_, err := tx.Exec(ctx,
-		`UPDATE posts SET text = $1, updated_at = $2 WHERE id = $3`, req.Text, time.Now(), req.ID)
-
+	err := tx.QueryRow(ctx,
+		`UPDATE posts SET text = $1, updated_at = $2 WHERE id = $3 RETURNING author_user_id`, req.Text, time.Now(), req.ID).Scan(&req.AuthorUserID)
+	if err == pgx.ErrNoRows {
+		return common.ErrPostNotFound
+	}
 	return err
 }
 
-func dbFeedPosts(ctx context.Context, userID string, offset, limit int) ([]PostRequest, error) {
+/* Load the user's friends posts older than the cursor except the excluded authors, newest first */
+func dbFeedPosts(ctx context.Context, userID string, excluded []string, cursor *common.Cursor, limit int) ([]PostRequest, error) {
 	res := []PostRequest{}
+	if excluded == nil {
+		excluded = []string{}
+	}
+
+	query := `SELECT id, author_user_id, created_at, updated_at, text FROM posts WHERE author_user_id in (SELECT friend_id FROM friends WHERE id = $1) AND NOT (author_user_id = ANY($2::uuid[]))`
+	args := []interface{}{userID, excluded}
+	if cursor != nil {
+		query += ` AND (created_at, id) < ($3, $4)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
 
-	rows, err := db.Query(ctx,
-		`SELECT id, author_user_id, created_at, updated_at, text FROM posts WHERE author_user_id in (SELECT friend_id FROM friends WHERE id = $1)`, userID)
+	rows, err := Db(ctx).Query(ctx, query, args...)
 
 	defer rows.Close()
 	if err != nil {
@@ -61,21 +73,23 @@ func dbFeedPosts(ctx context.Context, userID string, offset, limit int) ([]PostR
 		return nil, err
 	}
 
-	if offset >= len(res) {
-		return nil, nil
-	}
-	if offset+limit > len(res) {
-		return res[offset:], nil
-	}
-	return res[offset:limit], nil
+	return res, err
 }
 
-/* Load last 1000 updated posts from DB */
-func dbLoadPosts(ctx context.Context, limit int) ([]PostRequest, error) {
+/* Load the author's posts older than the cursor, newest first */
+func dbAuthorPosts(ctx context.Context, authorID string, cursor *common.Cursor, limit int) ([]PostRequest, error) {
 	res := []PostRequest{}
 
-	rows, err := db.Query(ctx,
-		`SELECT id, author_user_id, created_at, updated_at, text FROM posts WHERE author_user_id in (SELECT friend_id FROM friends) ORDER BY updated_at LIMIT $1`, limit)
+	query := `SELECT id, author_user_id, created_at, updated_at, text FROM posts WHERE author_user_id = $1`
+	args := []interface{}{authorID}
+	if cursor != nil {
+		query += ` AND (created_at, id) < ($2, $3)`
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, limit)
+
+	rows, err := Db(ctx).Query(ctx, query, args...)
 
 	defer rows.Close()
 	if err != nil {
@@ -92,7 +106,7 @@ func dbLoadPosts(ctx context.Context, limit int) ([]PostRequest, error) {
 func dbGetPost(ctx context.Context, id string) (*PostRequest, error) {
 	res := []PostRequest{}
 
-	rows, err := db.Query(ctx,
+	rows, err := Db(ctx).Query(ctx,
 		`SELECT id, author_user_id, created_at, updated_at, text from posts WHERE id = $1`, id)
 
 	defer rows.Close()
@@ -111,64 +125,41 @@ func dbGetPost(ctx context.Context, id string) (*PostRequest, error) {
 	return &res[0], err
 }
 
+/*
+ * Exchange of the created posts. It replaces the non-durable createdPosts one,
+ * which the brokers deployed before the outbox still have.
+ */
+const POSTS_CREATED_EXCHANGE = "postsCreated"
+
 func CreatePost(ctx context.Context, userID string, text string) error {
-	req := &PostRequest{AuthorUserID: userID, Text: text, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	// Timestamps are stored without time zone and with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	req := &PostRequest{AuthorUserID: userID, Text: text, CreatedAt: now, UpdatedAt: now}
 	_, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
 		err := req.dbAddPost(ctx, tx)
 		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		return nil, outboxPostCreated(ctx, tx, req)
 	})
 	if err != nil {
 		return err
 	}
-	err = QueuePostCreatedMessage(ctx, req)
-	if err != nil {
-		return err
-	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	cacheFanOutPost(ctx, req)
 	return nil
 }
 
-func QueuePostCreatedMessage(ctx context.Context, req *PostRequest) error {
-	channel, err := rbmq.Channel()
-	if err != nil {
-		log.Println("RBMQ: Channel creation failed")
-		return err
-	}
-	defer channel.Close()
-
-	err = channel.ExchangeDeclare(
-		"createdPosts", // name
-		"topic",        // type
-		false,          // durable
-		false,          // auto-deleted
-		false,          // internal
-		false,          // no-wait
-		nil,            // arguments
-	)
-
-	if err != nil {
-		log.Println("Cannot create exchange")
-		return err
-	}
+/* The post is published by the outbox relay whether or not the websocket is served */
+func outboxPostCreated(ctx context.Context, tx pgx.Tx, req *PostRequest) error {
 	reqBytes, err := json.Marshal(*req)
 	if err != nil {
 		log.Println("Cannot marshal post request to bytes array")
 		return err
 	}
 	// rounting key: userID.postID
-	err = channel.PublishWithContext(ctx,
-		"createdPosts",              // exchange
-		req.AuthorUserID+"."+req.ID, // routing key
-		false,                       // mandatory
-		false,                       // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        reqBytes,
-		})
-
-	return nil
+	return outbox.Add(ctx, tx, POSTS_CREATED_EXCHANGE, req.AuthorUserID+"."+req.ID, reqBytes)
 }
 
 func DeletePost(ctx context.Context, id string) error {
@@ -180,7 +171,13 @@ func DeletePost(ctx context.Context, id string) error {
 		}
 		return nil, nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	cacheRemovePost(ctx, req)
+	return nil
 }
 
 func GetPost(ctx context.Context, id string) (*PostRequest, error) {
@@ -201,143 +198,11 @@ func UpdatePost(ctx context.Context, id string, text string) error {
 		}
 		return nil, nil
 	})
-	return err
-}
-
-func FeedPosts(ctx context.Context, userID string, offset, limit int) ([]PostRequest, error) {
-	friends, err := cacheGetFriends(ctx, userID)
 	if err != nil {
-		return nil, err
-	}
-	var posts []PostRequest
-	if len(friends) != 0 {
-		posts, err = cacheGetPosts(ctx, friends, offset, limit)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if len(posts) == 0 {
-		posts, err = dbFeedPosts(ctx, userID, offset, limit)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return posts, nil
-}
-
-func cacheGetFriends(ctx context.Context, userID string) ([]string, error) {
-	var friends []string
-
-	iter := cache.Scan(ctx, 0, "user_friends:*", 0).Iterator()
-
-	for iter.Next(ctx) {
-		key := iter.Val()
-		values, err := cache.HGetAll(ctx, key).Result()
-		if err != nil {
-			return nil, err
-		}
-		if values["user_id"] != userID {
-			continue
-		}
-
-		friend := values["friend_id"]
-		friends = append(friends, friend)
-
-	}
-	if err := iter.Err(); err != nil {
-		return nil, err
-	}
-	return friends, nil
-}
-
-func cacheGetPosts(ctx context.Context, friends []string, offset, limit int) ([]PostRequest, error) {
-	var posts []PostRequest
-	iter := cache.Scan(ctx, 0, "post:*", 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-		values, err := cache.HGetAll(ctx, key).Result()
-		if err != nil {
-			return nil, err
-		}
-		if !slices.Contains(friends, values["author_user_id"]) {
-			continue
-		}
-
-		createdAt, err := time.Parse(time.RFC3339, values["created_at"])
-		if err != nil {
-			return nil, err
-		}
-		updatedAt, err := time.Parse(time.RFC3339, values["updated_at"])
-		if err != nil {
-			return nil, err
-		}
-		post := PostRequest{ID: values["post_id"],
-			AuthorUserID: values["author_user_id"],
-			CreatedAt:    createdAt,
-			UpdatedAt:    updatedAt,
-			Text:         values["text"],
-		}
-
-		posts = append(posts, post)
-
-	}
-	if err := iter.Err(); err != nil {
-		return nil, err
-	}
-
-	if offset >= len(posts) {
-		return nil, nil
-	}
-	if offset+limit > len(posts) {
-		return posts[offset:], nil
-	}
-	return posts[offset:limit], nil
-}
-
-func cacheUpdatePosts(ctx context.Context) {
-	posts, err := dbLoadPosts(ctx, 1000)
-	if err != nil {
-		log.Println("Load posts failed: ", err)
-	}
-
-	for _, post := range posts {
-		postSettings := map[string]string{"post_id": post.ID, "author_user_id": post.AuthorUserID, "created_at": post.CreatedAt.Format(time.RFC3339), "updated_at": post.UpdatedAt.Format(time.RFC3339), "text": post.Text}
-		for k, v := range postSettings {
-			err := cache.HSet(ctx, "post:"+post.ID, k, v).Err()
-			if err != nil {
-				log.Println("Cache update failed: ", err)
-				return
-			}
-		}
-	}
-
-	friends, err := GetFriends(ctx)
-	if err == nil {
-		for _, friend := range friends {
-			friendSettings := map[string]string{"user_id": friend.ID, "friend_id": friend.FriendID}
-			for k, v := range friendSettings {
-				err := cache.HSet(ctx, "user_friends:"+friend.ID, k, v).Err()
-				if err != nil {
-					log.Println("Cache update failed: ", err)
-					return
-				}
-			}
-		}
+		return err
 	}
-}
-
-func CacheUpdatePosts(ctx context.Context) {
-	ticker := time.NewTicker(CACHE_TTL * time.Second)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				cacheUpdatePosts(ctx)
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	cacheInvalidatePost(ctx, req.ID)
+	return nil
 }
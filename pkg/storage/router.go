@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/config"
+	"highload-arch/pkg/metrics"
+	"highload-arch/pkg/tracing"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+/*
+ * Read queries are routed to the replicas, writes always go to the master.
+ * A replica is skipped while it is unhealthy or lags behind the master more
+ * than db.replica_max_lag. Reads of a user who has just written are served by
+ * the master for db.read_your_writes_window, so the user sees own changes.
+ * The writes are marked in Redis, so every backend instance sees them:
+ *   recent_write:<user_id> - set on commit, expires after the window
+ */
+
+const replicaLagQuery = `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+type replica struct {
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+	lag     atomic.Int64
+}
+
+type dbRouter struct {
+	replicas []*replica
+	next     atomic.Uint32
+}
+
+var router = &dbRouter{}
+
+type masterContextKey struct{}
+
+/* Force reads made with the context to be served by the master */
+func WithMaster(ctx context.Context) context.Context {
+	return context.WithValue(ctx, masterContextKey{}, true)
+}
+
+func (r *dbRouter) connect(dsns []string) {
+	for i, dsn := range dsns {
+		cfg, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Replicas may be down at startup, they are picked up by the health check
+		cfg.LazyConnect = true
+		tracing.ConfigurePool(cfg)
+		pool, err := pgxpool.ConnectConfig(context.Background(), cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics.RegisterPool(fmt.Sprintf("replica%d", i), pool)
+		r.replicas = append(r.replicas, &replica{pool: pool})
+	}
+	r.checkReplicas(context.Background())
+	go func() {
+		ticker := time.NewTicker(config.Get().DB.ReplicaCheckPeriod)
+		for range ticker.C {
+			r.checkReplicas(context.Background())
+		}
+	}()
+}
+
+func (r *dbRouter) checkReplicas(ctx context.Context) {
+	for _, rep := range r.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, config.Get().DB.ReplicaCheckPeriod)
+		var lag float64
+		err := rep.pool.QueryRow(checkCtx, replicaLagQuery).Scan(&lag)
+		cancel()
+		if err != nil {
+			if rep.healthy.Swap(false) {
+				log.Printf("Replica %s is unhealthy: %s", rep.pool.Config().ConnConfig.Host, err)
+			}
+			continue
+		}
+		rep.lag.Store(int64(lag * float64(time.Second)))
+		if !rep.healthy.Swap(true) {
+			log.Printf("Replica %s is healthy", rep.pool.Config().ConnConfig.Host)
+		}
+	}
+}
+
+func recentWriteKey(userID string) string {
+	return "recent_write:" + userID
+}
+
+func (r *dbRouter) markWrite(ctx context.Context, userID string) {
+	if userID == "" || !config.Get().DB.UseReplica {
+		return
+	}
+	err := cache.Set(ctx, recentWriteKey(userID), 1, config.Get().DB.ReadYourWritesWindow).Err()
+	if err != nil {
+		log.Printf("Cannot mark the write of %s: %s", userID, err)
+	}
+}
+
+/* The reads are served by the master if Redis can't tell */
+func (r *dbRouter) recentlyWrote(ctx context.Context, userID string) bool {
+	if userID == "" {
+		return false
+	}
+	n, err := cache.Exists(ctx, recentWriteKey(userID)).Result()
+	if err != nil {
+		log.Printf("Cannot check the recent writes of %s: %s", userID, err)
+		return true
+	}
+	return n > 0
+}
+
+/* Pick the pool to serve a read query, falls back to the master if no replica fits */
+func (r *dbRouter) read(ctx context.Context) *pgxpool.Pool {
+	if ctx.Value(masterContextKey{}) != nil || r.recentlyWrote(ctx, common.UserIDFromContext(ctx)) {
+		return db
+	}
+
+	maxLag := config.Get().DB.ReplicaMaxLag
+	candidates := make([]*replica, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		if rep.healthy.Load() && time.Duration(rep.lag.Load()) <= maxLag {
+			candidates = append(candidates, rep)
+		}
+	}
+	if len(candidates) == 0 {
+		return db
+	}
+
+	if config.Get().DB.ReplicaBalancing == config.REPLICA_BALANCING_LEAST_CONN {
+		best := candidates[0]
+		for _, rep := range candidates[1:] {
+			if rep.pool.Stat().AcquiredConns() < best.pool.Stat().AcquiredConns() {
+				best = rep
+			}
+		}
+		return best.pool
+	}
+	return candidates[int(r.next.Add(1))%len(candidates)].pool
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"highload-arch/pkg/common"
+	"highload-arch/pkg/metrics"
+	"log"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type Session struct {
+	ID        string    `pg:"id"`
+	UserAgent string    `pg:"user_agent"`
+	CreatedAt time.Time `pg:"created_at"`
+	LastSeen  time.Time `pg:"last_seen"`
+}
+
+func dbAddSession(ctx context.Context, tx pgx.Tx, userID, userAgent string) (string, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	var sessionID string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO user_sessions (user_id, user_agent, created_at, last_seen) VALUES ($1, $2, $3, $3) RETURNING id`,
+		userID, userAgent, now).Scan(&sessionID)
+	return sessionID, err
+}
+
+/* Update last_seen of the session and report whether it is still active */
+func dbTouchSession(ctx context.Context, userID, sessionID string) (bool, error) {
+	var active bool
+	err := db.QueryRow(ctx,
+		`UPDATE user_sessions SET last_seen = $1 WHERE id = $2 AND user_id = $3 RETURNING revoked_at IS NULL`,
+		time.Now().UTC().Truncate(time.Microsecond), sessionID, userID).Scan(&active)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+func cacheSetSessionState(ctx context.Context, sessionIDs []string, state string) error {
+	ttl := common.SESSION_ACTIVE_CACHE_TTL
+	if state == common.SESSION_STATE_REVOKED {
+		ttl = common.SESSION_REVOKED_CACHE_TTL
+	}
+	_, err := cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range sessionIDs {
+			pipe.Set(ctx, common.SessionKey(id), state, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+/* Make sure the session is not revoked, last_seen is updated once the cached state expires */
+func CheckSession(ctx context.Context, userID, sessionID string) error {
+	state, err := cache.Get(ctx, common.SessionKey(sessionID)).Result()
+	if err != nil && err != redis.Nil {
+		log.Println("Session cache lookup failed: ", err)
+	}
+	switch state {
+	case common.SESSION_STATE_ACTIVE:
+		metrics.CacheHit("session")
+		return nil
+	case common.SESSION_STATE_REVOKED:
+		metrics.CacheHit("session")
+		return common.ErrTokenRevoked
+	}
+	metrics.CacheMiss("session")
+
+	active, err := dbTouchSession(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	state = common.SESSION_STATE_ACTIVE
+	if !active {
+		state = common.SESSION_STATE_REVOKED
+	}
+	if err := cacheSetSessionState(ctx, []string{sessionID}, state); err != nil {
+		log.Println("Session cache update failed: ", err)
+	}
+	if !active {
+		return common.ErrTokenRevoked
+	}
+	return nil
+}
+
+func ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	res := []Session{}
+
+	rows, err := Db(ctx).Query(ctx,
+		`SELECT id, user_agent, created_at, last_seen FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL ORDER BY last_seen DESC`, userID)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pgxscan.ScanAll(&res, rows); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/* Revoke the sessions along with their refresh and login tokens */
+func dbRevokeSessions(ctx context.Context, tx pgx.Tx, userID, sessionID string, others bool) ([]string, error) {
+	query := `UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND id = $3 AND revoked_at IS NULL RETURNING id`
+	if others {
+		query = `UPDATE user_sessions SET revoked_at = $1 WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL RETURNING id`
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	rows, err := tx.Query(ctx, query, now, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE session_id = ANY($2::uuid[]) AND revoked_at IS NULL`, now, ids); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM user_tokens WHERE session_id = ANY($1::uuid[])`, ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func revokeSessions(ctx context.Context, userID, sessionID string, others bool) (int, error) {
+	ids, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
+		return dbRevokeSessions(ctx, tx, userID, sessionID, others)
+	})
+	if err != nil {
+		return 0, err
+	}
+	revoked := ids.([]string)
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	if err := cacheSetSessionState(ctx, revoked, common.SESSION_STATE_REVOKED); err != nil {
+		// The cached active state expires shortly, so revocation is only delayed
+		log.Println("Session cache update failed: ", err)
+	}
+	return len(revoked), nil
+}
+
+func RevokeSession(ctx context.Context, userID, sessionID string) error {
+	_, err := revokeSessions(ctx, userID, sessionID, false)
+	return err
+}
+
+/* Revoke all the sessions of the user except the current one */
+func RevokeOtherSessions(ctx context.Context, userID, sessionID string) (int, error) {
+	return revokeSessions(ctx, userID, sessionID, true)
+}
@@ -37,6 +37,10 @@ func AddUser(ctx context.Context, user *User, password string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// The new user is going to log in right away, so the reads go to the master
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+	router.markWrite(ctx, user.ID)
 	return user.ID, nil
 }
 
@@ -60,17 +64,11 @@ func (u *User) dbAddUserCredentials(ctx context.Context, tx pgx.Tx, password str
 }
 
 func GetUser(ctx context.Context, id string) (*User, error) {
-	user, err := HandleInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) (interface{}, error) {
-		user, err := dbGetUserById(ctx, tx, id)
-		if err != nil {
-			return nil, err
-		}
-		return user, nil
-	})
+	user, err := dbGetUserById(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	return user.(*User), nil
+	return user, nil
 }
 
 func SearchUsers(ctx context.Context, firstName string, secondName string) ([]User, error) {
@@ -84,10 +82,10 @@ func SearchUsers(ctx context.Context, firstName string, secondName string) ([]Us
 	return users, nil
 }
 
-func dbGetUserById(ctx context.Context, tx pgx.Tx, userID string) (*User, error) {
+func dbGetUserById(ctx context.Context, userID string) (*User, error) {
 	res := []*User{}
 
-	rows, err := Db().Query(context.Background(), `SELECT * FROM users WHERE id = $1`, userID)
+	rows, err := Db(ctx).Query(ctx, `SELECT * FROM users WHERE id = $1`, userID)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -124,7 +122,7 @@ func dbGetUsersByRegex(ctx context.Context, regexMap map[string]string) ([]User,
 		}
 	}
 	regexFilter = `SELECT * FROM users WHERE ` + regexFilter + ` ORDER BY id`
-	rows, err := Db().Query(context.Background(), regexFilter)
+	rows, err := Db(ctx).Query(ctx, regexFilter)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
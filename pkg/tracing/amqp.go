@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* Trace context carried in the AMQP message headers */
+type amqpCarrier amqp.Table
+
+func (c amqpCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/* Start a span of publishing to the exchange, the returned headers carry it to the consumer */
+func StartPublish(ctx context.Context, exchange string) (context.Context, trace.Span, amqp.Table) {
+	ctx, span := tracer.Start(ctx, exchange+" publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("rabbitmq"),
+		semconv.MessagingDestinationName(exchange),
+		semconv.MessagingOperationPublish,
+	))
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, amqpCarrier(headers))
+	return ctx, span, headers
+}
+
+/* Continue the trace of the publisher with a span of handling the delivery */
+func StartConsume(ctx context.Context, exchange string, headers amqp.Table) (context.Context, trace.Span) {
+	if headers != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, amqpCarrier(headers))
+	}
+	return tracer.Start(ctx, exchange+" receive", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("rabbitmq"),
+		semconv.MessagingDestinationName(exchange),
+		semconv.MessagingOperationReceive,
+	))
+}
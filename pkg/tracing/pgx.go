@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * pgx v4 has no tracer hooks, but it logs every query along with its duration
+ * once the query is done, so the spans are made of the log records afterwards.
+ */
+type pgxTracer struct{}
+
+func (pgxTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	switch msg {
+	case "Query", "Exec", "SendBatch":
+	default:
+		return
+	}
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		// Background queries, e.g. the replica health checks, are not traced
+		return
+	}
+	duration, _ := data["time"].(time.Duration)
+	end := time.Now()
+	sql, _ := data["sql"].(string)
+	_, span := tracer.Start(ctx, "postgres "+msg, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-duration)), trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(sql),
+		))
+	var err error
+	if cause, ok := data["err"].(error); ok {
+		err = cause
+	} else if level <= pgx.LogLevelError {
+		err = errors.Errorf("%s failed", msg)
+	}
+	if err != nil {
+		End(span, err)
+		return
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+/* Connect the pool, tracing its queries when the tracing is enabled */
+func ConnectPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	ConfigurePool(cfg)
+	return pgxpool.ConnectConfig(ctx, cfg)
+}
+
+func ConfigurePool(cfg *pgxpool.Config) {
+	if !Enabled() {
+		return
+	}
+	cfg.ConnConfig.Logger = pgxTracer{}
+	cfg.ConnConfig.LogLevel = pgx.LogLevelInfo
+}
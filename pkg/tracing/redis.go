@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* Span for every Redis command and pipeline, cache misses are not errors */
+type redisHook struct{}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			return next(ctx, cmd)
+		}
+		ctx, span := StartClient(ctx, "redis "+cmd.Name(), semconv.DBSystemRedis, semconv.DBOperation(cmd.Name()))
+		err := next(ctx, cmd)
+		if err == redis.Nil {
+			span.End()
+			return err
+		}
+		End(span, err)
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			return next(ctx, cmds)
+		}
+		ctx, span := StartClient(ctx, "redis pipeline", semconv.DBSystemRedis, semconv.DBOperation("pipeline"))
+		err := next(ctx, cmds)
+		if err == redis.Nil {
+			span.End()
+			return err
+		}
+		End(span, err)
+		return err
+	}
+}
+
+func InstrumentRedis(client *redis.Client) {
+	if Enabled() {
+		client.AddHook(redisHook{})
+	}
+}
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"highload-arch/pkg/config"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * Traces follow a request through the services: the W3C trace context is
+ * passed in the HTTP headers and in the AMQP message headers, so the whole
+ * send message saga ends up in one trace. With the exporter disabled the
+ * context is still propagated, but no spans are recorded.
+ */
+
+const TRACER_NAME = "highload-arch"
+
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+var tracer = otel.Tracer(TRACER_NAME)
+
+/* Set up the exporter of the service, the returned function flushes the spans left */
+func Init(service string) func() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	cfg := config.Get().Tracing
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case config.TRACING_EXPORTER_NONE:
+		return func() {}
+	case config.TRACING_EXPORTER_OTLP:
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithInsecure())
+	case config.TRACING_EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case config.TRACING_EXPORTER_FILE:
+		var f *os.File
+		f, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	}
+	if err != nil {
+		log.Fatalf("Can't create the trace exporter: %s", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(service)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Sampling is decided once, at the root of the trace
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Tracing enabled, exporter %s", cfg.Exporter)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Println("Tracing shutdown failed: ", err)
+		}
+	}
+}
+
+func Enabled() bool {
+	return config.Get().Tracing.Exporter != config.TRACING_EXPORTER_NONE
+}
+
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, opts...)
+}
+
+/* Start a span of a call to a database, Redis or Tarantool */
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+/* Trace context of the span to be stored along with a deferred event */
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+/* Continue the trace stored with Inject */
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+/* End the span, marking it failed with the error if there is one */
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,34 +1,206 @@
 box.cfg{listen=3301}
 
-dialogs = box.schema.create_space('dialogs')
+fiber = require('fiber')
+uuid = require('uuid')
+utf8 = require('utf8')
+
+-- Message states, the same as in the Postgres backend
+PENDING_UNREAD = 'PENDING_UNREAD'
+UNREAD = 'UNREAD'
+PENDING_READ = 'PENDING_READ'
+READ = 'READ'
+
+dialogs = box.schema.create_space('dialogs', { if_not_exists = true })
+
+-- Dialogs created before the states keep their messages as read, the
+-- timestamps are moved from seconds to microseconds
+box.once('dialogs_states', function()
+    for _, t in ipairs(dialogs:select()) do
+        if #t == 6 then
+            dialogs:replace{t[1], t[2], t[3], t[4], t[5] * 1000000, t[6], READ, 0}
+        end
+    end
+end)
 
 dialogs:format({
     { name = 'id', type = 'string' },
     { name = 'author_id', type = 'string' },
     { name = 'recepient_id', type = 'string' },
     { name = 'dialog_id', type = 'string' },
-    { name = 'created_at', type = 'unsigned' },
+    { name = 'created_at', type = 'unsigned' }, -- microseconds since epoch, UTC
     { name = 'text', type = 'string' },
+    { name = 'state', type = 'string' },
+    { name = 'read_at', type = 'unsigned' }, -- 0 until read
+})
+
+dialogs:create_index('primary', { parts = { { 'id' } }, if_not_exists = true })
+
+box.once('dialogs_paging', function()
+    if dialogs.index.dialog ~= nil then
+        dialogs.index.dialog:drop()
+    end
+end)
 
+dialogs:create_index('dialog', {
+    parts = { { 'dialog_id' }, { 'created_at' }, { 'id' } },
+    unique = true,
+    if_not_exists = true,
 })
 
-dialogs:create_index(
-    'primary', { parts={ {'id'}} }
-)
+-- Messages sent and received by the user for the search
+dialogs:create_index('author', {
+    parts = { { 'author_id' }, { 'created_at' }, { 'id' } },
+    unique = true,
+    if_not_exists = true,
+})
 
-dialogs:create_index('dialog', { parts = { { 'dialog_id' } }, unique = false })
+dialogs:create_index('recepient', {
+    parts = { { 'recepient_id' }, { 'created_at' }, { 'id' } },
+    unique = true,
+    if_not_exists = true,
+})
 
-uuid = require('uuid')
+local function contains(list, value)
+    for _, v in ipairs(list) do
+        if v == value then
+            return true
+        end
+    end
+    return false
+end
 
 function send_message(authorID, recepientID, dialogID, text)
+    return dialogs:insert{uuid.str(), authorID, recepientID, dialogID, fiber.time64(), text, PENDING_UNREAD, 0}
+end
+
+-- Messages of the dialog in the states older than the cursor, newest first
+function get_dialog(dialogID, states, cursorCreatedAt, cursorID, limit)
+    local key, iterator = { dialogID }, 'LE'
+    if cursorID ~= nil and cursorID ~= '' then
+        key, iterator = { dialogID, cursorCreatedAt, cursorID }, 'LT'
+    end
+    local res = {}
+    for _, t in dialogs.index.dialog:pairs(key, { iterator = iterator }) do
+        if t.dialog_id ~= dialogID or (limit > 0 and #res == limit) then
+            break
+        end
+        if contains(states, t.state) then
+            table.insert(res, t)
+        end
+    end
+    return res
+end
+
+-- Move the unread messages received by the user to PENDING_READ, either the
+-- listed ones or every one up to and including upTo. Returns the messages
+-- read now and the receipts of the listed ones read before
+function mark_read(userID, dialogID, ids, upTo, now)
+    local read, receipts = {}, {}
+    box.begin()
+    if upTo ~= nil and upTo ~= '' then
+        local last = dialogs:get(upTo)
+        if last ~= nil and last.dialog_id == dialogID then
+            for _, t in dialogs.index.dialog:pairs({ dialogID, last.created_at, last.id }, { iterator = 'LE' }) do
+                if t.dialog_id ~= dialogID then
+                    break
+                end
+                if t.recepient_id == userID and t.state == UNREAD then
+                    table.insert(read, dialogs:update(t.id, { { '=', 'state', PENDING_READ }, { '=', 'read_at', now } }))
+                end
+            end
+        end
+        receipts = read
+    else
+        for _, id in ipairs(ids) do
+            local t = dialogs:get(id)
+            if t ~= nil and t.dialog_id == dialogID and t.recepient_id == userID then
+                if t.state == UNREAD then
+                    t = dialogs:update(id, { { '=', 'state', PENDING_READ }, { '=', 'read_at', now } })
+                    table.insert(read, t)
+                end
+                if t.read_at > 0 then
+                    table.insert(receipts, t)
+                end
+            end
+        end
+    end
+    box.commit()
+    return read, receipts
+end
+
+-- Move the message of the failed saga back to UNREAD, it is not read
+-- anymore if it was. False if it was not in the expected state
+function compensate(id, fromState)
     box.begin()
-    dialogs:insert{uuid.str(), authorID, recepientID, dialogID, os.time(os.date("!*t")), text}
+    local t = dialogs:get(id)
+    if t == nil or t.state ~= fromState then
+        box.commit()
+        return false
+    end
+    dialogs:update(id, { { '=', 'state', UNREAD }, { '=', 'read_at', 0 } })
     box.commit()
+    return true
 end
 
-function get_dialog(dialog_id)
+-- Move the message to the state, false if it was not in the expected one
+function update_state(id, fromState, toState)
     box.begin()
-    x = dialogs.index.dialog:select{dialog_id}
+    local t = dialogs:get(id)
+    if t == nil or t.state ~= fromState then
+        box.commit()
+        return false
+    end
+    dialogs:update(id, { { '=', 'state', toState } })
     box.commit()
-    return x
+    return true
+end
+
+local function has_words(text, words)
+    text = utf8.lower(text)
+    for _, word in ipairs(words) do
+        if string.find(text, word, 1, true) == nil then
+            return false
+        end
+    end
+    return true
+end
+
+-- Up to limit messages of the index with the user in the field, in the
+-- states and containing every lowercase word, older than the cursor
+local function search_index(res, index, field, userID, states, words, cursorCreatedAt, cursorID, limit)
+    local key, iterator = { userID }, 'LE'
+    if cursorID ~= nil and cursorID ~= '' then
+        key, iterator = { userID, cursorCreatedAt, cursorID }, 'LT'
+    end
+    local found = 0
+    for _, t in index:pairs(key, { iterator = iterator }) do
+        if t[field] ~= userID or found == limit then
+            break
+        end
+        -- The messages to themselves are found by the author index
+        local own = field == 'recepient_id' and t.author_id == userID
+        if not own and contains(states, t.state) and has_words(t.text, words) then
+            table.insert(res, t)
+            found = found + 1
+        end
+    end
+end
+
+-- Messages sent or received by the user containing every word, older than
+-- the cursor, newest first. There is no full-text index, so the messages of
+-- the user are scanned until limit of them match
+function search_messages(userID, states, words, cursorCreatedAt, cursorID, limit)
+    local res = {}
+    search_index(res, dialogs.index.author, 'author_id', userID, states, words, cursorCreatedAt, cursorID, limit)
+    search_index(res, dialogs.index.recepient, 'recepient_id', userID, states, words, cursorCreatedAt, cursorID, limit)
+    table.sort(res, function(a, b)
+        if a.created_at == b.created_at then
+            return a.id > b.id
+        end
+        return a.created_at > b.created_at
+    end)
+    while #res > limit do
+        table.remove(res)
+    end
+    return res
 end